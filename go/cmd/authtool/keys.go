@@ -0,0 +1,203 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/opstrace/opstrace/go/pkg/authenticator"
+)
+
+func generateKey(keyType string, bits int, curve string) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa":
+		if bits < 2048 {
+			return nil, fmt.Errorf("RSA key size must be at least 2048 bits")
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case "ecdsa":
+		switch curve {
+		case "P-256":
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		case "P-384":
+			return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s (expected: P-256, P-384)", curve)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s (expected: rsa, ecdsa)", keyType)
+	}
+}
+
+func encodePrivateKeyPEM(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// Encode public key in the format expected by the authenticator (X.509
+// SubjectPublicKeyInfo, as written by `openssl ... -pubout`).
+func encodePublicKeyPEM(key crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// Decode private key PEM file: PKCS#8 (`PRIVATE KEY`), PKCS#1 (`RSA PRIVATE
+// KEY`) or SEC 1 (`EC PRIVATE KEY`), as written by openssl.
+func decodePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type: %T", key)
+		}
+		return signer, nil
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type: %s", block.Type)
+	}
+}
+
+// Key set JSON document with one key, as expected in
+// API_AUTHTOKEN_VERIFICATION_PUBKEY_SET.
+func keySetSnippet(pubPEM string) (string, error) {
+	snippet, err := json.Marshal(map[string]string{authenticator.KeyIDFromPEM(pubPEM): pubPEM})
+	if err != nil {
+		return "", err
+	}
+	return string(snippet), nil
+}
+
+// The signing algorithm the authenticator binds to the corresponding public
+// key.
+func signingMethodForKey(key crypto.Signer) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		}
+		return nil, fmt.Errorf("unsupported curve: %s", k.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return authenticator.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type: %T", key)
+}
+
+type mintOptions struct {
+	kid      string
+	tenant   string
+	expiry   time.Duration
+	scope    string
+	audience string
+	issuer   string
+}
+
+type tokenClaims struct {
+	jwt.StandardClaims
+	Scope string `json:"scope,omitempty"`
+}
+
+func mintToken(key crypto.Signer, opts mintOptions) (string, error) {
+	method, err := signingMethodForKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	kid := opts.kid
+	if kid == "" {
+		pubPEM, err := encodePublicKeyPEM(key.Public())
+		if err != nil {
+			return "", err
+		}
+		kid = authenticator.KeyIDFromPEM(string(pubPEM))
+	}
+
+	// Unique token ID, so that the token can be revoked individually.
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(method, &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "tenant-" + opts.tenant,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(opts.expiry).Unix(),
+			Id:        hex.EncodeToString(jti),
+			Audience:  opts.audience,
+			Issuer:    opts.issuer,
+		},
+		Scope: opts.scope,
+	})
+	token.Header["kid"] = kid
+
+	return token.SignedString(key)
+}
+
+// Decode (without verifying) token header and claims, for display.
+func decodeToken(token string) (string, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("token is not a JWT (expected three dot-separated parts)")
+	}
+
+	header, err := jwt.DecodeSegment(parts[0])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid header: %s", err)
+	}
+	claims, err := jwt.DecodeSegment(parts[1])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid claims: %s", err)
+	}
+
+	return string(header), string(claims), nil
+}
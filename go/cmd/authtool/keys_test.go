@@ -0,0 +1,76 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/authenticator"
+)
+
+func TestGenKeyMintVerify(t *testing.T) {
+	for _, tc := range []struct{ keyType, curve string }{
+		{"rsa", ""},
+		{"ecdsa", "P-256"},
+		{"ecdsa", "P-384"},
+	} {
+		key, err := generateKey(tc.keyType, 2048, tc.curve)
+		assert.NoError(t, err)
+
+		// Round trip through PEM, as when reading the key file written by
+		// genkey.
+		privPEM, err := encodePrivateKeyPEM(key)
+		assert.NoError(t, err)
+		key, err = decodePrivateKeyPEM(privPEM)
+		assert.NoError(t, err)
+
+		pubPEM, err := encodePublicKeyPEM(key.Public())
+		assert.NoError(t, err)
+		snippet, err := keySetSnippet(string(pubPEM))
+		assert.NoError(t, err)
+
+		keySetFile := filepath.Join(t.TempDir(), "keyset.json")
+		assert.NoError(t, ioutil.WriteFile(keySetFile, []byte(snippet), 0600))
+
+		token, err := mintToken(key, mintOptions{tenant: "foo", expiry: time.Hour, scope: "metrics:write"})
+		assert.NoError(t, err)
+
+		a, err := authenticator.NewAuthenticatorFromFile(keySetFile)
+		assert.NoError(t, err, tc.keyType)
+
+		identity, err := a.ValidateAuthToken(token)
+		assert.NoError(t, err, tc.keyType)
+		assert.Equal(t, "foo", identity.TenantName)
+		assert.Equal(t, []string{"metrics:write"}, identity.Scopes)
+
+		_, claims, err := decodeToken(token)
+		assert.NoError(t, err)
+		assert.Contains(t, claims, `"sub":"tenant-foo"`)
+	}
+}
+
+func TestGenerateKey_Invalid(t *testing.T) {
+	_, err := generateKey("rsa", 1024, "")
+	assert.Error(t, err)
+	_, err = generateKey("ecdsa", 0, "P-521")
+	assert.Error(t, err)
+	_, err = generateKey("dsa", 0, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,240 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Command-line tool for managing tenant API authentication: generate key pairs,
+mint tenant tokens, and decode / verify existing tokens. See README.md.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/opstrace/opstrace/go/pkg/authenticator"
+)
+
+const usage = `usage: authtool <command> [flags]
+
+commands:
+  genkey   generate key pair, print key ID and key set JSON snippet
+  keyid    print key ID for a public key (PEM file)
+  mint     mint tenant API authentication token
+  verify   decode token, and verify it against a key set
+
+Run 'authtool <command> -h' for the flags of a command.
+`
+
+func main() {
+	// Keep output clean: the authenticator logs a lot at info level.
+	log.SetLevel(log.WarnLevel)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "genkey":
+		err = runGenKey(args)
+	case "keyid":
+		err = runKeyID(args)
+	case "mint":
+		err = runMint(args)
+	case "verify":
+		err = runVerify(args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
+func runGenKey(args []string) error {
+	fs := flag.NewFlagSet("genkey", flag.ExitOnError)
+	keyType := fs.String("type", "rsa", "rsa|ecdsa")
+	bits := fs.Int("bits", 2048, "RSA key size")
+	curve := fs.String("curve", "P-256", "ECDSA curve: P-256|P-384")
+	out := fs.String("out", "", "write private key to <out>.key and public key to <out>.pub (required)")
+	_ = fs.Parse(args)
+
+	if *out == "" {
+		return fmt.Errorf("genkey: -out is required")
+	}
+
+	privkey, err := generateKey(*keyType, *bits, *curve)
+	if err != nil {
+		return err
+	}
+
+	privPEM, err := encodePrivateKeyPEM(privkey)
+	if err != nil {
+		return err
+	}
+	pubPEM, err := encodePublicKeyPEM(privkey.Public())
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(*out+".key", privPEM, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*out+".pub", pubPEM, 0644); err != nil {
+		return err
+	}
+
+	snippet, err := keySetSnippet(string(pubPEM))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("private key: %s.key\npublic key: %s.pub\n", *out, *out)
+	fmt.Printf("kid: %s\n\n", authenticator.KeyIDFromPEM(string(pubPEM)))
+	fmt.Printf("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET snippet:\n%s\n", snippet)
+	return nil
+}
+
+func runKeyID(args []string) error {
+	fs := flag.NewFlagSet("keyid", flag.ExitOnError)
+	pub := fs.String("pub", "", "public key PEM file (required)")
+	_ = fs.Parse(args)
+
+	if *pub == "" {
+		return fmt.Errorf("keyid: -pub is required")
+	}
+
+	data, err := ioutil.ReadFile(*pub)
+	if err != nil {
+		return err
+	}
+
+	snippet, err := keySetSnippet(string(data))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("kid: %s\n\n", authenticator.KeyIDFromPEM(string(data)))
+	fmt.Printf("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET snippet:\n%s\n", snippet)
+	return nil
+}
+
+func runMint(args []string) error {
+	fs := flag.NewFlagSet("mint", flag.ExitOnError)
+	keyFile := fs.String("key", "", "private key PEM file (required)")
+	kid := fs.String("kid", "", "key ID (default: calculated from the public key)")
+	tenant := fs.String("tenant", "", "tenant name (required)")
+	expiry := fs.Duration("expiry", 365*24*time.Hour, "token lifetime")
+	scope := fs.String("scope", "", "space-separated scopes (default: not restricted)")
+	audience := fs.String("aud", "", "aud claim (optional)")
+	issuer := fs.String("iss", "", "iss claim (optional)")
+	_ = fs.Parse(args)
+
+	if *keyFile == "" || *tenant == "" {
+		return fmt.Errorf("mint: -key and -tenant are required")
+	}
+
+	data, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	privkey, err := decodePrivateKeyPEM(data)
+	if err != nil {
+		return err
+	}
+
+	token, err := mintToken(privkey, mintOptions{
+		kid:      *kid,
+		tenant:   *tenant,
+		expiry:   *expiry,
+		scope:    *scope,
+		audience: *audience,
+		issuer:   *issuer,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(token)
+	return nil
+}
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	keySetFile := fs.String("keyset", "", "key set JSON file (API_AUTHTOKEN_VERIFICATION_PUBKEY_SET format)")
+	verbose := fs.Bool("v", false, "log the reason for verification failures")
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("verify: expected token as argument ('-' to read from stdin)")
+	}
+
+	token := fs.Arg(0)
+	if token == "-" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		token = string(data)
+	}
+	token = strings.TrimSpace(token)
+
+	header, claims, err := decodeToken(token)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("header: %s\nclaims: %s\n", header, claims)
+
+	if *keySetFile == "" {
+		fmt.Println("not verified (no -keyset given)")
+		return nil
+	}
+
+	if *verbose {
+		log.SetLevel(log.InfoLevel)
+	}
+
+	a, err := authenticator.NewAuthenticatorFromFile(*keySetFile)
+	if err != nil {
+		return err
+	}
+
+	identity, err := a.ValidateAuthToken(token)
+	if err != nil {
+		if !*verbose {
+			return fmt.Errorf("verification failed (run with -v for details)")
+		}
+		return fmt.Errorf("verification failed")
+	}
+
+	if tenants := identity.Tenants(); tenants != nil {
+		fmt.Printf("valid token for tenants: %s\n", strings.Join(tenants, ", "))
+	} else {
+		fmt.Printf("valid token for tenant: %s\n", identity.TenantName)
+	}
+	if identity.Scopes != nil {
+		fmt.Printf("scopes: %s\n", strings.Join(identity.Scopes, " "))
+	}
+	return nil
+}
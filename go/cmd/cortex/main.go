@@ -16,13 +16,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -39,6 +40,19 @@ var (
 	cortexDistributorURL     string
 	tenantName               string
 	disableAPIAuthentication bool
+	tlsCertFile              string
+	tlsKeyFile               string
+	tlsClientCAFile          string
+	tlsClientCertTenantField string
+	stripRequestHeaders      string
+	rejectRequestHeaders     string
+	backendLBStrategy        string
+	backendHealthCheckPath   string
+	rateLimitOverridesFile   string
+	rateLimitReloadInterval  time.Duration
+	// Circuit breakers of the querier and distributor backend pools.
+	querierCircuitBreaker     = middleware.DefaultQueryCircuitBreakerConfig()
+	distributorCircuitBreaker = middleware.DefaultCircuitBreakerConfig()
 )
 
 func main() {
@@ -48,6 +62,26 @@ func main() {
 	flag.StringVar(&tenantName, "tenantname", "", "")
 	flag.StringVar(&loglevel, "loglevel", "info", "error|info|debug")
 	flag.BoolVar(&disableAPIAuthentication, "disable-api-authn", false, "")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", "", "serve TLS with this certificate (PEM)")
+	flag.StringVar(&tlsKeyFile, "tls-key-file", "", "private key for -tls-cert-file (PEM)")
+	flag.StringVar(&tlsClientCAFile, "tls-client-ca-file", "",
+		"accept client certificates signed by a CA in this file (PEM) as authentication proof")
+	flag.StringVar(&tlsClientCertTenantField, "tls-client-cert-tenant-field", "cn",
+		"where to read the tenant name from in client certificates: cn|san-uri:<regex>|ou:<regex>")
+	flag.StringVar(&stripRequestHeaders, "strip-request-headers", "",
+		"comma-separated list of client-supplied request headers to remove before proxying")
+	flag.StringVar(&rejectRequestHeaders, "reject-request-headers", "",
+		"comma-separated list of request headers that clients must not set (400 response)")
+	flag.StringVar(&backendLBStrategy, "backend-lb-strategy", middleware.RoundRobin,
+		"how requests are balanced across backends: round-robin|least-connections")
+	flag.StringVar(&backendHealthCheckPath, "backend-health-check-path", "/ready",
+		"path for active backend health checks (empty: disabled)")
+	flag.StringVar(&rateLimitOverridesFile, "rate-limit-overrides-file", "",
+		"per-tenant rate limits (YAML); empty: no rate limiting")
+	flag.DurationVar(&rateLimitReloadInterval, "rate-limit-reload-interval", 10*time.Second,
+		"how often the rate limit overrides file is checked for changes")
+	querierCircuitBreaker.RegisterFlags(flag.CommandLine, "querier-")
+	distributorCircuitBreaker.RegisterFlags(flag.CommandLine, "distributor-")
 
 	flag.Parse()
 
@@ -57,18 +91,36 @@ func main() {
 	}
 	log.SetLevel(level)
 
-	cortexqurl, uerr := url.Parse(cortexQuerierURL)
-	if uerr != nil {
-		log.Fatalf("bad cortex querier URL: %s", uerr)
+	// Each URL flag is a comma-separated list of backend URLs, or a DNS SRV
+	// spec (dnssrv+http://<SRV record name>).
+	poolConfig := middleware.DefaultBackendPoolConfig()
+	poolConfig.Strategy = backendLBStrategy
+	poolConfig.HealthCheckPath = backendHealthCheckPath
+
+	poolConfig.CircuitBreaker = querierCircuitBreaker
+	querierPool, perr := middleware.NewBackendPool(cortexQuerierURL, poolConfig)
+	if perr != nil {
+		log.Fatalf("bad cortex querier URL: %s", perr)
+	}
+
+	poolConfig.CircuitBreaker = distributorCircuitBreaker
+	distributorPool, perr := middleware.NewBackendPool(cortexDistributorURL, poolConfig)
+	if perr != nil {
+		log.Fatalf("bad cortex distributor URL: %s", perr)
 	}
 
-	cortexdurl, uerr := url.Parse(cortexDistributorURL)
-	if uerr != nil {
-		log.Fatalf("bad cortex distributor URL: %s", uerr)
+	var rateLimiter *middleware.RateLimiter
+	if rateLimitOverridesFile != "" {
+		var err error
+		rateLimiter, err = middleware.NewRateLimiter(rateLimitOverridesFile, rateLimitReloadInterval)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		log.Infof("rate limit overrides file: %s", rateLimitOverridesFile)
 	}
 
-	log.Infof("cortex querier URL: %s", cortexqurl)
-	log.Infof("cortex distributor URL: %s", cortexdurl)
+	log.Infof("cortex querier URL: %s", cortexQuerierURL)
+	log.Infof("cortex distributor URL: %s", cortexDistributorURL)
 	log.Infof("listen address: %s", listenAddress)
 	log.Infof("tenant name: %s", tenantName)
 	log.Infof("API authentication enabled: %v", !disableAPIAuthentication)
@@ -77,44 +129,76 @@ func main() {
 		authenticator.ReadConfigFromEnvOrCrash()
 	}
 
+	var tlsConfig *tls.Config
+	if tlsClientCAFile != "" {
+		if tlsCertFile == "" {
+			log.Fatalf("-tls-client-ca-file requires -tls-cert-file")
+		}
+
+		var err error
+		tlsConfig, err = authenticator.NewClientCertTLSConfig(tlsClientCAFile)
+		if err != nil {
+			log.Fatalf("bad client CA: %s", err)
+		}
+
+		if !disableAPIAuthentication {
+			if err := authenticator.Default().EnableClientCertAuthentication(tlsClientCertTenantField); err != nil {
+				log.Fatalf("%s", err)
+			}
+		}
+	}
+
 	// See: https://github.com/cortexproject/cortex/blob/master/docs/api/_index.md
 	cortexTenantHeader := "X-Scope-OrgID"
+	headerPolicy := middleware.NewHeaderPolicy(stripRequestHeaders, rejectRequestHeaders)
 	querierProxy := middleware.NewReverseProxyFixedTenant(
 		tenantName,
 		cortexTenantHeader,
-		cortexqurl,
+		querierPool.URL(),
 		disableAPIAuthentication,
-	)
+	).WithHeaderPolicy(headerPolicy).WithBackendPool(querierPool)
+	if rateLimiter != nil {
+		querierProxy.WithRateLimiter(rateLimiter)
+	}
 	distributorProxy := middleware.NewReverseProxyFixedTenant(
 		tenantName,
 		cortexTenantHeader,
-		cortexdurl,
+		distributorPool.URL(),
 		disableAPIAuthentication,
-	)
+	).WithHeaderPolicy(headerPolicy).WithBackendPool(distributorPool)
+	if rateLimiter != nil {
+		distributorProxy.WithRateLimiter(rateLimiter)
+	}
 
 	// mux matches based on registration order, not prefix length.
 	router := mux.NewRouter()
 
+	// Report the identity of the presented credentials, and (admin scope)
+	// verify tokens on behalf of the caller. Not proxied.
+	router.Path("/api/v1/whoami").HandlerFunc(authenticator.Default().WhoamiHandler(&tenantName, disableAPIAuthentication))
+	router.Path("/api/v1/introspect").HandlerFunc(authenticator.Default().IntrospectionHandler(&tenantName, disableAPIAuthentication)).Methods(http.MethodPost)
+
 	// Require non-deprecated push path (instead of also allowing /api/prom/push)
-	router.PathPrefix("/api/v1/push").HandlerFunc(distributorProxy.HandleWithProxy)
+	router.PathPrefix("/api/v1/push").HandlerFunc(distributorProxy.HandleWithScope(authenticator.ScopeMetricsWrite))
 
 	// /api/v1/read, /api/v1/query, /api/v1/labels etc: direct everything that's not
 	// /api/v1/push to the querier for now.
-	router.PathPrefix("/api/v1").HandlerFunc(querierProxy.HandleWithProxy)
+	router.PathPrefix("/api/v1").HandlerFunc(querierProxy.HandleWithScope(authenticator.ScopeMetricsRead))
 
 	// All Cortex components expose various endpoints with configuration /
 	// debug details. https://cortexmetrics.io/docs/api/#all-services Expose
 	// some of them here. Maybe remove / restrict some of these later for
 	// security / isolation reasons. Note that /runtime_config and /config and
 	// /services are expected to look the same regardless of which Cortex
-	// component serves them (use the distributor, here).
-	router.PathPrefix("/runtime_config").HandlerFunc(distributorProxy.HandleWithProxy)
-	router.PathPrefix("/config").HandlerFunc(distributorProxy.HandleWithProxy)
-	router.PathPrefix("/services").HandlerFunc(distributorProxy.HandleWithProxy)
+	// component serves them (use the distributor, here). Tokens with
+	// restricted scopes need the admin scope for these.
+	router.PathPrefix("/runtime_config").HandlerFunc(distributorProxy.HandleWithScope(authenticator.ScopeAdmin))
+	router.PathPrefix("/config").HandlerFunc(distributorProxy.HandleWithScope(authenticator.ScopeAdmin))
+	router.PathPrefix("/services").HandlerFunc(distributorProxy.HandleWithScope(authenticator.ScopeAdmin))
 	// This is distributor-specific (must be served by the Cortex distributor).
 	// "Displays a web page with the distributor hash ring status, including
 	// the state, healthy and last heartbeat time of each distributor.""
-	router.PathPrefix("/distributor/ring").HandlerFunc(distributorProxy.HandleWithProxy)
+	router.PathPrefix("/distributor/ring").HandlerFunc(distributorProxy.HandleWithScope(authenticator.ScopeAdmin))
 
 	// Expose a special endpoint /metrics exposing metrics for _this API
 	// proxy_.
@@ -125,7 +209,12 @@ func main() {
 	// to `/api/v1/push`.
 	distributorProxy.Revproxy.ModifyResponse = CortexPushRewrite429
 
-	log.Fatalf("terminated: %s", http.ListenAndServe(listenAddress, router))
+	server := &http.Server{Addr: listenAddress, Handler: router, TLSConfig: tlsConfig}
+	if tlsCertFile != "" {
+		log.Infof("serving TLS (client certificates accepted: %v)", tlsConfig != nil)
+		log.Fatalf("terminated: %s", server.ListenAndServeTLS(tlsCertFile, tlsKeyFile))
+	}
+	log.Fatalf("terminated: %s", server.ListenAndServe())
 }
 
 /*
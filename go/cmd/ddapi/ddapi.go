@@ -18,6 +18,7 @@ import (
 	"flag"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -34,6 +35,9 @@ var (
 	remoteWriteURL           string
 	tenantName               string
 	disableAPIAuthentication bool
+	maxSeriesPerMetric       int
+	maxSeriesPerTenant       int
+	seriesActiveWindow       time.Duration
 )
 
 func main() {
@@ -45,6 +49,12 @@ func main() {
 	flag.StringVar(&loglevel, "loglevel", "info", "error|info|debug")
 	flag.StringVar(&tenantName, "tenantname", "", "")
 	flag.BoolVar(&disableAPIAuthentication, "disable-api-authn", false, "")
+	flag.IntVar(&maxSeriesPerMetric, "max-series-per-metric", 0,
+		"Drop new series for a metric beyond this many active series (0: no limit)")
+	flag.IntVar(&maxSeriesPerTenant, "max-series-per-tenant", 0,
+		"Drop new series for a tenant beyond this many active series (0: no limit)")
+	flag.DurationVar(&seriesActiveWindow, "series-active-window", 30*time.Minute,
+		"Consider a series to be inactive when it has not been seen for this long")
 
 	flag.Parse()
 	level, lerr := log.ParseLevel(loglevel)
@@ -77,8 +87,23 @@ func main() {
 
 	ddcp := ddapi.NewDDCortexProxy(tenantName, remoteWriteURL, disableAPIAuthentication)
 
+	if maxSeriesPerMetric > 0 || maxSeriesPerTenant > 0 {
+		log.Infof("cardinality limits: %d series per metric, %d series per tenant (active window: %s)",
+			maxSeriesPerMetric, maxSeriesPerTenant, seriesActiveWindow)
+		ddcp.CardinalityLimiter = ddapi.NewCardinalityLimiter(ddapi.CardinalityLimiterConfig{
+			MaxSeriesPerMetric: maxSeriesPerMetric,
+			MaxSeriesPerTenant: maxSeriesPerTenant,
+			ActiveWindow:       seriesActiveWindow,
+		})
+	}
+
 	router := mux.NewRouter()
 
+	// Report the identity of the presented credentials, and (admin scope)
+	// verify tokens on behalf of the caller. Not proxied.
+	router.Path("/api/v1/whoami").HandlerFunc(authenticator.Default().WhoamiHandler(&tenantName, disableAPIAuthentication))
+	router.Path("/api/v1/introspect").HandlerFunc(authenticator.Default().IntrospectionHandler(&tenantName, disableAPIAuthentication)).Methods(http.MethodPost)
+
 	// DD API for "submitting metrics", which are actually time series
 	// fragments. Served by DD at /api/v1/series. See
 	// https://docs.datadoghq.com/api/v1/metrics/#submit-metrics
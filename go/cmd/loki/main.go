@@ -15,9 +15,10 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"net/http"
-	"net/url"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -34,6 +35,19 @@ var (
 	lokiDistributorURL       string
 	tenantName               string
 	disableAPIAuthentication bool
+	tlsCertFile              string
+	tlsKeyFile               string
+	tlsClientCAFile          string
+	tlsClientCertTenantField string
+	stripRequestHeaders      string
+	rejectRequestHeaders     string
+	backendLBStrategy        string
+	backendHealthCheckPath   string
+	rateLimitOverridesFile   string
+	rateLimitReloadInterval  time.Duration
+	// Circuit breakers of the querier and distributor backend pools.
+	querierCircuitBreaker     = middleware.DefaultQueryCircuitBreakerConfig()
+	distributorCircuitBreaker = middleware.DefaultCircuitBreakerConfig()
 )
 
 func main() {
@@ -43,6 +57,26 @@ func main() {
 	flag.StringVar(&tenantName, "tenantname", "", "")
 	flag.StringVar(&loglevel, "loglevel", "info", "error|info|debug")
 	flag.BoolVar(&disableAPIAuthentication, "disable-api-authn", false, "")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", "", "serve TLS with this certificate (PEM)")
+	flag.StringVar(&tlsKeyFile, "tls-key-file", "", "private key for -tls-cert-file (PEM)")
+	flag.StringVar(&tlsClientCAFile, "tls-client-ca-file", "",
+		"accept client certificates signed by a CA in this file (PEM) as authentication proof")
+	flag.StringVar(&tlsClientCertTenantField, "tls-client-cert-tenant-field", "cn",
+		"where to read the tenant name from in client certificates: cn|san-uri:<regex>|ou:<regex>")
+	flag.StringVar(&stripRequestHeaders, "strip-request-headers", "",
+		"comma-separated list of client-supplied request headers to remove before proxying")
+	flag.StringVar(&rejectRequestHeaders, "reject-request-headers", "",
+		"comma-separated list of request headers that clients must not set (400 response)")
+	flag.StringVar(&backendLBStrategy, "backend-lb-strategy", middleware.RoundRobin,
+		"how requests are balanced across backends: round-robin|least-connections")
+	flag.StringVar(&backendHealthCheckPath, "backend-health-check-path", "/ready",
+		"path for active backend health checks (empty: disabled)")
+	flag.StringVar(&rateLimitOverridesFile, "rate-limit-overrides-file", "",
+		"per-tenant rate limits (YAML); empty: no rate limiting")
+	flag.DurationVar(&rateLimitReloadInterval, "rate-limit-reload-interval", 10*time.Second,
+		"how often the rate limit overrides file is checked for changes")
+	querierCircuitBreaker.RegisterFlags(flag.CommandLine, "querier-")
+	distributorCircuitBreaker.RegisterFlags(flag.CommandLine, "distributor-")
 
 	flag.Parse()
 
@@ -52,18 +86,36 @@ func main() {
 	}
 	log.SetLevel(level)
 
-	lokiqurl, uerr := url.Parse(lokiQuerierURL)
-	if uerr != nil {
-		log.Fatalf("bad loki querier URL: %s", uerr)
+	// Each URL flag is a comma-separated list of backend URLs, or a DNS SRV
+	// spec (dnssrv+http://<SRV record name>).
+	poolConfig := middleware.DefaultBackendPoolConfig()
+	poolConfig.Strategy = backendLBStrategy
+	poolConfig.HealthCheckPath = backendHealthCheckPath
+
+	poolConfig.CircuitBreaker = querierCircuitBreaker
+	querierPool, perr := middleware.NewBackendPool(lokiQuerierURL, poolConfig)
+	if perr != nil {
+		log.Fatalf("bad loki querier URL: %s", perr)
+	}
+
+	poolConfig.CircuitBreaker = distributorCircuitBreaker
+	distributorPool, perr := middleware.NewBackendPool(lokiDistributorURL, poolConfig)
+	if perr != nil {
+		log.Fatalf("bad loki distributor URL: %s", perr)
 	}
 
-	lokidurl, uerr := url.Parse(lokiDistributorURL)
-	if uerr != nil {
-		log.Fatalf("bad loki distributor URL: %s", uerr)
+	var rateLimiter *middleware.RateLimiter
+	if rateLimitOverridesFile != "" {
+		var err error
+		rateLimiter, err = middleware.NewRateLimiter(rateLimitOverridesFile, rateLimitReloadInterval)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		log.Infof("rate limit overrides file: %s", rateLimitOverridesFile)
 	}
 
-	log.Infof("loki querier URL: %s", lokiqurl)
-	log.Infof("loki distributor URL: %s", lokidurl)
+	log.Infof("loki querier URL: %s", lokiQuerierURL)
+	log.Infof("loki distributor URL: %s", lokiDistributorURL)
 	log.Infof("listen address: %s", listenAddress)
 	log.Infof("tenant name: %s", tenantName)
 	log.Infof("API authentication enabled: %v", !disableAPIAuthentication)
@@ -72,33 +124,64 @@ func main() {
 		authenticator.ReadConfigFromEnvOrCrash()
 	}
 
+	var tlsConfig *tls.Config
+	if tlsClientCAFile != "" {
+		if tlsCertFile == "" {
+			log.Fatalf("-tls-client-ca-file requires -tls-cert-file")
+		}
+
+		var err error
+		tlsConfig, err = authenticator.NewClientCertTLSConfig(tlsClientCAFile)
+		if err != nil {
+			log.Fatalf("bad client CA: %s", err)
+		}
+
+		if !disableAPIAuthentication {
+			if err := authenticator.Default().EnableClientCertAuthentication(tlsClientCertTenantField); err != nil {
+				log.Fatalf("%s", err)
+			}
+		}
+	}
+
 	// See: https://github.com/grafana/loki/blob/master/docs/api.md#microservices-mode
 	lokiTenantHeader := "X-Scope-OrgID"
+	headerPolicy := middleware.NewHeaderPolicy(stripRequestHeaders, rejectRequestHeaders)
 	querierProxy := middleware.NewReverseProxyFixedTenant(
 		tenantName,
 		lokiTenantHeader,
-		lokiqurl,
+		querierPool.URL(),
 		disableAPIAuthentication,
-	)
+	).WithHeaderPolicy(headerPolicy).WithBackendPool(querierPool)
+	if rateLimiter != nil {
+		querierProxy.WithRateLimiter(rateLimiter)
+	}
 	distributorProxy := middleware.NewReverseProxyFixedTenant(
 		tenantName,
 		lokiTenantHeader,
-		lokidurl,
+		distributorPool.URL(),
 		disableAPIAuthentication,
-	)
+	).WithHeaderPolicy(headerPolicy).WithBackendPool(distributorPool)
+	if rateLimiter != nil {
+		distributorProxy.WithRateLimiter(rateLimiter)
+	}
 
 	// mux matches based on registration order, not prefix length.
 	router := mux.NewRouter()
 
+	// Report the identity of the presented credentials, and (admin scope)
+	// verify tokens on behalf of the caller. Not proxied.
+	router.Path("/api/v1/whoami").HandlerFunc(authenticator.Default().WhoamiHandler(&tenantName, disableAPIAuthentication))
+	router.Path("/api/v1/introspect").HandlerFunc(authenticator.Default().IntrospectionHandler(&tenantName, disableAPIAuthentication)).Methods(http.MethodPost)
+
 	// The intended push path.
-	router.PathPrefix("/loki/api/v1/push").HandlerFunc(distributorProxy.HandleWithProxy)
+	router.PathPrefix("/loki/api/v1/push").HandlerFunc(distributorProxy.HandleWithScope(authenticator.ScopeLogsWrite))
 
 	// Maybe we should not expose this?
 	// From loki API docs: WARNING: /api/prom/push is DEPRECATED; use /loki/api/v1/push instead.
 	// router.PathPrefix("/api/prom/push").HandlerFunc(reverseProxy.HandleWithDistributorProxy)
 
 	// The intended query / readout path(s)
-	router.PathPrefix("/loki/api/v1/").HandlerFunc(querierProxy.HandleWithProxy)
+	router.PathPrefix("/loki/api/v1/").HandlerFunc(querierProxy.HandleWithScope(authenticator.ScopeLogsRead))
 
 	// I think we can outcomment this one here, too. Want to encourage to use
 	// /loki/api/v1/ for readout.
@@ -107,5 +190,10 @@ func main() {
 	router.Handle("/metrics", promhttp.Handler())
 	router.Use(middleware.PrometheusMetrics("loki_api_proxy"))
 
-	log.Fatalf("terminated: %s", http.ListenAndServe(listenAddress, router))
+	server := &http.Server{Addr: listenAddress, Handler: router, TLSConfig: tlsConfig}
+	if tlsCertFile != "" {
+		log.Infof("serving TLS (client certificates accepted: %v)", tlsConfig != nil)
+		log.Fatalf("terminated: %s", server.ListenAndServeTLS(tlsCertFile, tlsKeyFile))
+	}
+	log.Fatalf("terminated: %s", server.ListenAndServe())
 }
@@ -0,0 +1,211 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Authentication failure reasons, used as metric label values.
+const (
+	reasonMissingHeader         = "missing_header"
+	reasonBadFormat             = "bad_format"
+	reasonMissingAPIKey         = "missing_api_key"
+	reasonNoKid                 = "no_kid"
+	reasonUnknownKid            = "unknown_kid"
+	reasonBadAlg                = "bad_alg"
+	reasonMalformedToken        = "malformed_token"
+	reasonBadSignature          = "bad_signature"
+	reasonExpired               = "expired"
+	reasonNotYetValid           = "not_yet_valid"
+	reasonMissingExpiry         = "missing_exp"
+	reasonLifetimeExceeded      = "lifetime_exceeded"
+	reasonInvalidToken          = "invalid_token"
+	reasonInvalidSubject        = "invalid_subject"
+	reasonClaimMismatch         = "claim_mismatch"
+	reasonRevoked               = "revoked"
+	reasonUnknownIntegrationKey = "unknown_integration_key"
+	reasonWrongTenant           = "wrong_tenant"
+	reasonUnknownTenant         = "unknown_tenant"
+	reasonTenantNotSelected     = "tenant_not_selected"
+	reasonInsufficientScope     = "insufficient_scope"
+	reasonClientCertNoTenant    = "client_cert_no_tenant"
+	reasonOIDCBadToken          = "oidc_bad_token"
+	reasonOIDCUnknownUser       = "oidc_unknown_user"
+	reasonOIDCLookupFailed      = "oidc_lookup_failed"
+	reasonOIDCTenantForbidden   = "oidc_tenant_not_allowed"
+)
+
+// Authentication methods, used as metric label values and in the audit log.
+const (
+	methodToken          = "token"
+	methodClientCert     = "client_cert"
+	methodOIDC           = "oidc"
+	methodAPIKey         = "api_key"
+	methodIntegrationKey = "integration"
+)
+
+var authFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "authenticator",
+	Name:      "failures_total",
+	Help:      "Rejected requests by reason.",
+}, []string{"reason"})
+
+var authSuccessesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "authenticator",
+	Name:      "successes_total",
+	Help:      "Authenticated requests by tenant and authentication method.",
+}, []string{"tenant", "method"})
+
+var integrationSuccessesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "authenticator",
+	Name:      "integration_successes_total",
+	Help:      "Requests authenticated with an integration key, by tenant and integration name.",
+}, []string{"tenant", "integration"})
+
+func init() {
+	prometheus.MustRegister(authFailuresTotal)
+	prometheus.MustRegister(authSuccessesTotal)
+	prometheus.MustRegister(integrationSuccessesTotal)
+}
+
+/*
+Authentication failure. `msg` is meant to be exposed in an HTTP response (see
+writeAuthError()), `reason` is counted.
+*/
+type authFailure struct {
+	reason string
+	msg    string
+}
+
+func (e *authFailure) Error() string {
+	return e.msg
+}
+
+// Return the failure reason for `err`. The reason for errors that are not
+// an `authFailure` is `invalid_token`.
+func failureReason(err error) string {
+	var af *authFailure
+	if errors.As(err, &af) {
+		return af.reason
+	}
+	return reasonInvalidToken
+}
+
+// Classify jwt-go verification error. Errors returned by the key lookup
+// callback carry their own reason. Time claims are checked separately, see
+// checkTimeClaims().
+func jwtFailureReason(err error) string {
+	var ve *jwt.ValidationError
+	if !errors.As(err, &ve) {
+		return reasonInvalidToken
+	}
+
+	if ve.Inner != nil {
+		var af *authFailure
+		if errors.As(ve.Inner, &af) {
+			return af.reason
+		}
+	}
+
+	switch {
+	case ve.Errors&jwt.ValidationErrorMalformed != 0:
+		return reasonMalformedToken
+	case ve.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		return reasonBadSignature
+	}
+	return reasonInvalidToken
+}
+
+// Count failure, then write error response and return false (see
+// writeAuthError()).
+func exitAuthFailure(w http.ResponseWriter, r *http.Request, reason string, errmsg string) bool {
+	authFailuresTotal.WithLabelValues(reason).Inc()
+	return writeAuthError(w, r, responseForFailure(reason, errmsg), errmsg)
+}
+
+// Like exitAuthFailure(), taking reason and message from `err`.
+func exitAuthFailureForError(w http.ResponseWriter, r *http.Request, err error) bool {
+	return exitAuthFailure(w, r, failureReason(err), err.Error())
+}
+
+/*
+Read sample rate for the audit log of successful authentications from
+environment variable API_AUTH_AUDIT_LOG_SAMPLE_RATE: a number between 0 and 1
+(fraction of successful authentications to log). Default: 0 (disabled).
+*/
+func (a *Authenticator) readAuditLogConfigFromEnv() error {
+	a.auditLogSampleRate = 0
+
+	s := os.Getenv("API_AUTH_AUDIT_LOG_SAMPLE_RATE")
+	if s == "" {
+		return nil
+	}
+
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return fmt.Errorf("invalid API_AUTH_AUDIT_LOG_SAMPLE_RATE: %s (expected: number between 0 and 1)", s)
+	}
+
+	log.Infof("audit log sample rate: %v", rate)
+	a.auditLogSampleRate = rate
+	return nil
+}
+
+/*
+Count successful authentication, and write a (sampled) audit log entry.
+*/
+func (a *Authenticator) recordSuccess(r *http.Request, identity *TenantIdentity) {
+	authSuccessesTotal.WithLabelValues(identity.TenantName, identity.method).Inc()
+	if identity.integrationName != "" {
+		integrationSuccessesTotal.WithLabelValues(identity.TenantName, identity.integrationName).Inc()
+	}
+
+	if a.auditLogSampleRate <= 0 || rand.Float64() >= a.auditLogSampleRate {
+		return
+	}
+
+	fields := log.Fields{
+		"audit":     true,
+		"tenant":    identity.TenantName,
+		"method":    identity.method,
+		"subject":   identity.subject,
+		"path":      r.URL.Path,
+		"source_ip": a.clientIP(r),
+	}
+	if identity.keyID != "" {
+		fields["kid"] = identity.keyID
+	}
+	if identity.tokenID != "" {
+		fields["jti"] = identity.tokenID
+	}
+	if identity.integrationName != "" {
+		fields["integration"] = identity.integrationName
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		fields["forwarded_for"] = xff
+	}
+
+	log.WithFields(fields).Info("authenticated")
+}
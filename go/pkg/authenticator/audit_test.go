@@ -0,0 +1,164 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticate_FailureReasons(t *testing.T) {
+	key := genRSAKeyOrFail(t)
+	useKeySet(t, map[string]*verificationKey{
+		"rsakey": {alg: "RS256", key: &key.PublicKey},
+	})
+
+	sign := func(subject string, expiresAt time.Time) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, &jwt.StandardClaims{
+			Subject:   subject,
+			ExpiresAt: expiresAt.Unix(),
+		})
+		token.Header["kid"] = "rsakey"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("signing failed: %v", err)
+		}
+		return signed
+	}
+
+	valid := sign("tenant-default", time.Now().Add(time.Hour))
+	expired := sign("tenant-default", time.Now().Add(-time.Hour))
+	unknownKid := signOrFail(t, jwt.SigningMethodRS256, key, "otherkey", "tenant-default")
+
+	expectedTenantName := "default"
+	for _, tc := range []struct {
+		authorization string
+		reason        string
+		status        int
+	}{
+		{"", reasonMissingHeader, 401},
+		{"Token " + valid, reasonBadFormat, 400},
+		{"Bearer foobarbadtoken", reasonMalformedToken, 401},
+		{"Bearer " + expired, reasonExpired, 401},
+		{"Bearer " + unknownKid, reasonUnknownKid, 401},
+		{"Bearer " + valid[:len(valid)-4], reasonBadSignature, 401},
+	} {
+		req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+
+		before := testutil.ToFloat64(authFailuresTotal.WithLabelValues(tc.reason))
+		w := httptest.NewRecorder()
+		_, ok := defaultAuthenticator.GetTenantIdentityOr401(w, req, nil, false)
+		assert.False(t, ok)
+		assert.Equal(t, tc.status, w.Result().StatusCode, tc.reason)
+		assert.Equal(t, before+1, testutil.ToFloat64(authFailuresTotal.WithLabelValues(tc.reason)), tc.reason)
+	}
+
+	// Valid token, but for another tenant.
+	otherTenant := sign("tenant-foo", time.Now().Add(time.Hour))
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+	req.Header.Set("Authorization", "Bearer "+otherTenant)
+	before := testutil.ToFloat64(authFailuresTotal.WithLabelValues(reasonWrongTenant))
+	_, ok := defaultAuthenticator.GetTenantIdentityOr401(httptest.NewRecorder(), req, &expectedTenantName, false)
+	assert.False(t, ok)
+	assert.Equal(t, before+1, testutil.ToFloat64(authFailuresTotal.WithLabelValues(reasonWrongTenant)))
+}
+
+func TestAuthenticate_AuditLog(t *testing.T) {
+	token := signClaimsOrFail(t, &jwt.StandardClaims{
+		Id:        "token-1",
+		Subject:   "tenant-default",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	authenticate := func() {
+		req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+		req.RemoteAddr = "10.0.0.1:4711"
+		req.Header.Set("X-Forwarded-For", "192.0.2.1, 10.0.0.2")
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, ok := defaultAuthenticator.GetTenantIdentityOr401(httptest.NewRecorder(), req, nil, false)
+		assert.True(t, ok)
+	}
+
+	// Audit log disabled by default; success counted anyway.
+	successesBefore := testutil.ToFloat64(authSuccessesTotal.WithLabelValues("default", methodToken))
+	authenticate()
+	assert.Equal(t, successesBefore+1, testutil.ToFloat64(authSuccessesTotal.WithLabelValues("default", methodToken)))
+	for _, entry := range hook.AllEntries() {
+		assert.NotContains(t, entry.Data, "audit")
+	}
+
+	defaultAuthenticator.auditLogSampleRate = 1
+	defer func() { defaultAuthenticator.auditLogSampleRate = 0 }()
+
+	hook.Reset()
+	authenticate()
+
+	var audit *log.Entry
+	for _, entry := range hook.AllEntries() {
+		if _, ok := entry.Data["audit"]; ok {
+			audit = entry
+		}
+	}
+	if assert.NotNil(t, audit) {
+		assert.Equal(t, "default", audit.Data["tenant"])
+		assert.Equal(t, methodToken, audit.Data["method"])
+		assert.Equal(t, "rsakey", audit.Data["kid"])
+		assert.Equal(t, "token-1", audit.Data["jti"])
+		assert.Equal(t, "/api/v1/query", audit.Data["path"])
+		assert.Equal(t, "10.0.0.1", audit.Data["source_ip"])
+		assert.Equal(t, "192.0.2.1, 10.0.0.2", audit.Data["forwarded_for"])
+	}
+
+	// Source IP read from the configured header, as for brute-force
+	// protection.
+	defaultAuthenticator.clientIPHeader = "X-Forwarded-For"
+	defer func() { defaultAuthenticator.clientIPHeader = "" }()
+
+	hook.Reset()
+	authenticate()
+	for _, entry := range hook.AllEntries() {
+		if _, ok := entry.Data["audit"]; ok {
+			assert.Equal(t, "10.0.0.2", entry.Data["source_ip"])
+		}
+	}
+}
+
+func TestReadAuditLogConfigFromEnv(t *testing.T) {
+	a := newAuthenticator()
+	defer os.Unsetenv("API_AUTH_AUDIT_LOG_SAMPLE_RATE")
+
+	os.Setenv("API_AUTH_AUDIT_LOG_SAMPLE_RATE", "0.25")
+	assert.NoError(t, a.readAuditLogConfigFromEnv())
+	assert.Equal(t, 0.25, a.auditLogSampleRate)
+
+	for _, invalid := range []string{"1.5", "-1", "often"} {
+		os.Setenv("API_AUTH_AUDIT_LOG_SAMPLE_RATE", invalid)
+		assert.Error(t, a.readAuditLogConfigFromEnv(), invalid)
+	}
+}
@@ -17,6 +17,10 @@ package authenticator
 import (
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
+
+	"github.com/opstrace/opstrace/go/pkg/filewatch"
 )
 
 // General note: authentication failure is an expected scenario, which is why
@@ -27,6 +31,167 @@ import (
 // lines up with the tenant HTTP header used by Cortex and Loki.
 const TestTenantHeader = "X-Scope-OrgID"
 
+/*
+Authenticator verifies Opstrace tenant API authentication tokens against its
+own configuration (key set, expected claims, revocation list). Build one with
+NewAuthenticatorFromEnv(), NewAuthenticatorFromFile() or
+NewAuthenticatorFromKeys().
+
+The package-level functions (GetTenantNameOr401() and the likes) use the
+default authenticator, which is set by ReadConfigFromEnvOrCrash().
+*/
+type Authenticator struct {
+	// Map for key set (the set of public keys considered for token
+	// verification). Map key: key ID corresponding to public key. Protected
+	// by `pubKeysMu`: the key set may be swapped while requests are being
+	// verified (when read from a key set file).
+	pubKeysMu sync.RWMutex
+	pubKeys   map[string]*verificationKey
+
+	// Optional: file the key set is read from, reloaded upon change.
+	keySetFilePath         string
+	keySetFilePollInterval time.Duration
+	keySetFileDigest       filewatch.Digest
+
+	// For tokens that do not encode a key ID.
+	pubKeyFallback *verificationKey
+
+	// Optional: key set read from a JWKS document (file or URL), refreshed
+	// periodically.
+	jwks                *jwksKeySource
+	jwksRefreshInterval time.Duration
+
+	// Expected value of the `aud` claim: the Opstrace cluster name, in the
+	// form written by the token issuer (e.g. `opstrace-cluster-<name>`).
+	// Empty: do not check.
+	expectedAudience string
+	// Expected value of the `iss` claim. Empty: do not check.
+	expectedIssuer string
+	// Migration mode: when true, `aud`/`iss` mismatches are logged and
+	// counted, but the token is not rejected.
+	claimsCheckLogOnly bool
+
+	// Tolerated clock skew for the `exp`, `nbf` and `iat` claims.
+	clockSkewLeeway time.Duration
+	// Token lifetime policy: require the `exp` claim, and (if non-zero)
+	// reject tokens valid for longer than `maxTokenLifetime`.
+	requireExpiry    bool
+	maxTokenLifetime time.Duration
+
+	// Optional: denylist of revoked tokens, re-read when the underlying file
+	// changes.
+	revocationList               *revocationList
+	revocationListReloadInterval time.Duration
+
+	// Optional: cache of verified tokens. Invalidated when the key set
+	// changes.
+	tokenCache *tokenCache
+
+	// Optional: accept verified TLS client certificates as authentication
+	// proof, reading the tenant name with this function.
+	clientCertTenant clientCertTenantExtractor
+
+	// Optional: accept OIDC ID tokens of human users.
+	oidc *oidcAuthenticator
+
+	// Fraction of successful authentications to write to the audit log.
+	// Zero disables the audit log.
+	auditLogSampleRate float64
+
+	// Optional: block source IPs and token prefixes after repeated
+	// authentication failures. The source IP is read from `clientIPHeader`
+	// if set.
+	bruteForce     *failureTracker
+	clientIPHeader string
+
+	// Optional: accept keys of tenant integrations, re-read periodically.
+	integrationKeys                *integrationKeyStore
+	integrationKeysRefreshInterval time.Duration
+
+	// Optional: reject requests for tenants that do not exist (anymore).
+	tenantSet                *tenantSet
+	tenantSetRefreshInterval time.Duration
+
+	// Closed by Stop(): ends the background refresh.
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// Used by the package-level functions. Until ReadConfigFromEnvOrCrash() is
+// called, no key is configured: all tokens are rejected.
+var defaultAuthenticator = newAuthenticator()
+
+func newAuthenticator() *Authenticator {
+	return &Authenticator{
+		pubKeys:    make(map[string]*verificationKey),
+		tokenCache: newTokenCache(defaultTokenCacheSize),
+		stopCh:     make(chan struct{}),
+	}
+}
+
+// Default returns the authenticator used by the package-level functions.
+func Default() *Authenticator {
+	return defaultAuthenticator
+}
+
+// Look up key in the key set by key ID.
+func (a *Authenticator) lookupPubKey(kid string) (*verificationKey, bool) {
+	a.pubKeysMu.RLock()
+	defer a.pubKeysMu.RUnlock()
+
+	vkey, ok := a.pubKeys[kid]
+	return vkey, ok
+}
+
+// Atomically replace the key set.
+func (a *Authenticator) setPubKeys(keys map[string]*verificationKey) {
+	a.pubKeysMu.Lock()
+	a.pubKeys = keys
+	a.pubKeysMu.Unlock()
+
+	a.onKeySetChange()
+}
+
+// Tokens verified with keys that are gone must not be accepted anymore.
+func (a *Authenticator) onKeySetChange() {
+	if a.tokenCache != nil {
+		a.tokenCache.invalidate()
+	}
+}
+
+// Start periodic refresh of the key set file, of the JWKS document, of the
+// revocation list, of the integration keys and of the tenant set, if
+// configured. Also start cleaning up brute-force protection state. See Stop().
+func (a *Authenticator) startBackgroundRefresh() {
+	if a.keySetFilePath != "" {
+		go a.watchKeySetFile(a.stopCh)
+	}
+	if a.jwks != nil {
+		go a.jwks.refreshPeriodically(a.jwksRefreshInterval, a.stopCh)
+	}
+	if a.revocationList != nil {
+		go a.revocationList.reloadPeriodically(a.revocationListReloadInterval, a.stopCh)
+	}
+	if a.oidc != nil {
+		go a.oidc.jwks.refreshPeriodically(oidcJWKSRefreshInterval, a.stopCh)
+	}
+	if a.bruteForce != nil {
+		go a.bruteForce.removeExpiredPeriodically(a.stopCh)
+	}
+	if a.integrationKeys != nil {
+		go a.integrationKeys.refreshPeriodically(a.integrationKeysRefreshInterval, a.stopCh)
+	}
+	if a.tenantSet != nil {
+		go a.tenantSet.refreshPeriodically(a.tenantSetRefreshInterval, a.stopCh)
+	}
+}
+
+// Stop stops the background refresh started by NewAuthenticatorFromEnv(). The
+// authenticator keeps working with the state it has.
+func (a *Authenticator) Stop() {
+	a.stopOnce.Do(func() { close(a.stopCh) })
+}
+
 /*
 Infer tenant identity (name) from request or context.
 
@@ -70,25 +235,39 @@ expected.. |  disableAPIAuthentication | behavior
  not set   |  true (no proof req)      | testing setting:
            |                           |  tenant name read from X-Scope-OrgID header
 */
-func GetTenantNameOr401(
+func (a *Authenticator) GetTenantNameOr401(
 	w http.ResponseWriter,
 	r *http.Request,
 	expectedTenantName *string,
 	disableAPIAuthentication bool,
 ) (string, bool) {
+	identity, ok := a.GetTenantIdentityOr401(w, r, expectedTenantName, disableAPIAuthentication)
+	if !ok {
+		return "", false
+	}
+	return identity.TenantName, true
+}
+
+/*
+Like GetTenantNameOr401(), but return the tenant identity which in addition to
+the tenant name carries the scopes granted to the request.
+
+If `disableAPIAuthentication` is `true` then the scopes are not restricted.
+*/
+func (a *Authenticator) GetTenantIdentityOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName *string,
+	disableAPIAuthentication bool,
+) (*TenantIdentity, bool) {
 	if expectedTenantName != nil {
 		if !disableAPIAuthentication {
 			// Authenticate and expect specific tenant. Otherwise send 401 response.
-			if !AuthenticateSpecificTenantByHeaderOr401(w, r, *expectedTenantName) {
-				return "", false
-			}
-
-			// Request is authenticated as the expected tenant.
-			return *expectedTenantName, true
+			return a.authenticateTenantByHeaderOr401(w, r, expectedTenantName)
 		}
 
 		// ONLY FOR TESTING: do not inspect request, assume the expected tenant
-		return *expectedTenantName, true
+		return &TenantIdentity{TenantName: *expectedTenantName}, true
 	}
 
 	// Do not expect specific tenant: allow for incoming requests to be
@@ -96,22 +275,16 @@ func GetTenantNameOr401(
 
 	if !disableAPIAuthentication {
 		// Authenticate (accept any tenant name). Otherwise send 401 response.
-		tnFromReq, ok := AuthenticateAnyTenantByHeaderOr401(w, r)
-		if !ok {
-			return "", false
-		}
-
-		return tnFromReq, true
+		return a.authenticateTenantByHeaderOr401(w, r, nil)
 	}
 
 	// ONLY FOR TESTING: no single expected tenant, and authenticator
 	// is disabled: check for tenant in the X-Scope-OrgID header
 	tenantName := r.Header.Get(TestTenantHeader)
 	if tenantName == "" {
-		exit401(w, fmt.Sprintf("missing test %s header specifying tenant", TestTenantHeader))
-		return "", false
+		return nil, exitAuthFailure(w, r, reasonTenantNotSelected, fmt.Sprintf("missing test %s header specifying tenant", TestTenantHeader))
 	}
-	return tenantName, true
+	return &TenantIdentity{TenantName: tenantName}, true
 }
 
 /*
@@ -127,30 +300,69 @@ expected Opstrace tenant name.
 
 Callers can rely on a 401 response to have been emitted when `ok` is `false`.
 */
-func AuthenticateSpecificTenantByDDQueryParamOr401(
+func (a *Authenticator) AuthenticateSpecificTenantByDDQueryParamOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName string,
+) bool {
+	_, ok := a.authenticateTenantByDDQueryParamOr401(w, r, expectedTenantName)
+	return ok
+}
+
+/*
+Like AuthenticateSpecificTenantByDDQueryParamOr401(), but additionally require
+the authentication proof to grant `requiredScope`.
+
+Callers can rely on a 401 (or 403, for an insufficient scope) response to have
+been emitted when `ok` is `false`.
+*/
+func (a *Authenticator) AuthenticateSpecificTenantByDDQueryParamWithScopeOr401(
 	w http.ResponseWriter,
 	r *http.Request,
 	expectedTenantName string,
+	requiredScope string,
 ) bool {
+	identity, ok := a.authenticateTenantByDDQueryParamOr401(w, r, expectedTenantName)
+	if !ok {
+		return false
+	}
+
+	return RequireScopeOr403(w, r, identity, requiredScope)
+}
+
+// Like AuthenticateSpecificTenantByDDQueryParamOr401(). Return the identity.
+func (a *Authenticator) authenticateTenantByDDQueryParamOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName string,
+) (*TenantIdentity, bool) {
 	// Only one parameter of that name is expected.
 	apikey := r.URL.Query().Get("api_key")
 
 	if apikey == "" {
-		return exit401(w, "DD API key missing (api_key URL query parameter)")
+		return nil, exitAuthFailure(w, r, reasonMissingAPIKey, "DD API key missing (api_key URL query parameter)")
 	}
 
 	authTokenUnverified := apikey
 
-	tenantNameFromToken, veriferr := validateAuthTokenGetTenantName(authTokenUnverified)
+	if !a.rejectIfBlockedOr429(w, r, authTokenUnverified) {
+		return nil, false
+	}
+
+	identity, veriferr := a.validateTokenOrIntegrationKey(authTokenUnverified)
 	if veriferr != nil {
-		return exit401(w, veriferr.Error())
+		a.recordBruteForceFailure(r, authTokenUnverified, failureReason(veriferr))
+		return nil, exitAuthFailureForError(w, r, veriferr)
 	}
 
-	if expectedTenantName != tenantNameFromToken {
-		return exit401(w, fmt.Sprintf("bad authentication token: unexpected tenant: %s",
-			tenantNameFromToken))
+	if !selectTenantOr401(w, r, identity, &expectedTenantName) {
+		return nil, false
 	}
-	return true
+
+	if !a.acceptIdentityOr403(w, r, identity) {
+		return nil, false
+	}
+	return identity, true
 }
 
 /*
@@ -168,18 +380,13 @@ in a bad format, or invalid in any way.
 
 Callers can rely on a 401 response to have been emitted when `ok` is `false`.
 */
-func AuthenticateAnyTenantByHeaderOr401(w http.ResponseWriter, r *http.Request) (string, bool) {
-	authTokenUnverified, ok := getAuthTokenUnverifiedFromHeaderOr401(w, r)
+func (a *Authenticator) AuthenticateAnyTenantByHeaderOr401(w http.ResponseWriter, r *http.Request) (string, bool) {
+	identity, ok := a.authenticateTenantByHeaderOr401(w, r, nil)
 	if !ok {
 		return "", false
 	}
 
-	tenantNameFromToken, veriferr := validateAuthTokenGetTenantName(authTokenUnverified)
-	if veriferr != nil {
-		return "", exit401(w, veriferr.Error())
-	}
-
-	return tenantNameFromToken, true
+	return identity.TenantName, true
 }
 
 /*
@@ -196,20 +403,117 @@ bad format, or invalid in any way. Return `false`.
 
 Callers can rely on a 401 response to have been emitted when `ok` is `false`.
 */
-func AuthenticateSpecificTenantByHeaderOr401(w http.ResponseWriter, r *http.Request, expectedTenantName string) bool {
+func (a *Authenticator) AuthenticateSpecificTenantByHeaderOr401(w http.ResponseWriter, r *http.Request, expectedTenantName string) bool {
+	_, ok := a.authenticateTenantByHeaderOr401(w, r, &expectedTenantName)
+	return ok
+}
+
+// Common implementation for the two functions above. If `expectedTenantName`
+// is nil, accept any tenant. See acceptIdentityOr403() for what happens upon
+// success.
+func (a *Authenticator) authenticateTenantByHeaderOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName *string,
+) (*TenantIdentity, bool) {
+	identity, ok := a.authenticateTenantByProofOr401(w, r, expectedTenantName)
+	if !ok || !a.acceptIdentityOr403(w, r, identity) {
+		return nil, false
+	}
+	return identity, true
+}
+
+// If enabled, a verified TLS client certificate is accepted instead of an
+// authentication token, and so is an OIDC ID token.
+func (a *Authenticator) authenticateTenantByProofOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName *string,
+) (*TenantIdentity, bool) {
+	if a.hasClientCertProof(r) {
+		return a.authenticateTenantByClientCertOr401(w, r, expectedTenantName)
+	}
+
+	return a.authenticateTenantByTokenOr401(w, r, expectedTenantName)
+}
+
+// Authenticate request by the token in the Authorization header: a tenant API
+// authentication token or (if enabled) an OIDC ID token.
+func (a *Authenticator) authenticateTenantByTokenOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName *string,
+) (*TenantIdentity, bool) {
 	authTokenUnverified, ok := getAuthTokenUnverifiedFromHeaderOr401(w, r)
 	if !ok {
-		return false
+		return nil, false
+	}
+
+	// Reject clients with repeated failures before doing any cryptographic
+	// work.
+	if !a.rejectIfBlockedOr429(w, r, authTokenUnverified) {
+		return nil, false
+	}
+
+	if a.oidc != nil && a.oidc.isOIDCToken(authTokenUnverified) {
+		return a.authenticateUserByIDTokenOr401(w, r, authTokenUnverified, expectedTenantName)
 	}
 
-	tenantNameFromToken, veriferr := validateAuthTokenGetTenantName(authTokenUnverified)
+	identity, veriferr := a.validateTokenOrIntegrationKey(authTokenUnverified)
 	if veriferr != nil {
-		return exit401(w, veriferr.Error())
+		a.recordBruteForceFailure(r, authTokenUnverified, failureReason(veriferr))
+		return nil, exitAuthFailureForError(w, r, veriferr)
 	}
 
-	if expectedTenantName != tenantNameFromToken {
-		return exit401(w, fmt.Sprintf("bad authentication token: unexpected tenant: %s",
-			tenantNameFromToken))
+	if !selectTenantOr401(w, r, identity, expectedTenantName) {
+		return nil, false
 	}
-	return true
+
+	return identity, true
+}
+
+// The functions below call the method of the same name on the default
+// authenticator, see ReadConfigFromEnvOrCrash().
+
+func GetTenantNameOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName *string,
+	disableAPIAuthentication bool,
+) (string, bool) {
+	return defaultAuthenticator.GetTenantNameOr401(w, r, expectedTenantName, disableAPIAuthentication)
+}
+
+func GetTenantIdentityOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName *string,
+	disableAPIAuthentication bool,
+) (*TenantIdentity, bool) {
+	return defaultAuthenticator.GetTenantIdentityOr401(w, r, expectedTenantName, disableAPIAuthentication)
+}
+
+func AuthenticateSpecificTenantByDDQueryParamOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName string,
+) bool {
+	return defaultAuthenticator.AuthenticateSpecificTenantByDDQueryParamOr401(w, r, expectedTenantName)
+}
+
+func AuthenticateSpecificTenantByDDQueryParamWithScopeOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName string,
+	requiredScope string,
+) bool {
+	return defaultAuthenticator.AuthenticateSpecificTenantByDDQueryParamWithScopeOr401(w, r, expectedTenantName, requiredScope)
+}
+
+func AuthenticateAnyTenantByHeaderOr401(w http.ResponseWriter, r *http.Request) (string, bool) {
+	return defaultAuthenticator.AuthenticateAnyTenantByHeaderOr401(w, r)
+}
+
+func AuthenticateSpecificTenantByHeaderOr401(w http.ResponseWriter, r *http.Request, expectedTenantName string) bool {
+	return defaultAuthenticator.AuthenticateSpecificTenantByHeaderOr401(w, r, expectedTenantName)
 }
@@ -0,0 +1,338 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var bruteForceBlocksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "authenticator",
+	Name:      "bruteforce_blocks_total",
+	Help:      "Clients blocked after repeated authentication failures, by key type (ip, token).",
+}, []string{"key"})
+
+var bruteForceRejectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "authenticator",
+	Name:      "bruteforce_rejected_requests_total",
+	Help:      "Requests rejected with a 429 response because the client is blocked, by key type (ip, token).",
+}, []string{"key"})
+
+var bruteForceTrackedKeys = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "authenticator",
+	Name:      "bruteforce_tracked_keys",
+	Help:      "Number of source IPs and token prefixes with recent authentication failures.",
+})
+
+func init() {
+	prometheus.MustRegister(bruteForceBlocksTotal)
+	prometheus.MustRegister(bruteForceRejectedTotal)
+	prometheus.MustRegister(bruteForceTrackedKeys)
+}
+
+/*
+Track authentication failures per key (source IP, token prefix), and block
+keys with repeated failures.
+
+After `threshold` failures, a key is blocked for `backoff`; each further
+failure doubles the blocking time, up to `maxBackoff`. Failures are forgotten
+once there was no failure for `window`. While blocked, requests are rejected
+before any cryptographic work is done.
+*/
+type failureTracker struct {
+	threshold  int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	window     time.Duration
+	maxKeys    int
+
+	// Allows for faking time in tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*failureEntry
+}
+
+type failureEntry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+func newFailureTracker(threshold int, backoff, maxBackoff, window time.Duration) *failureTracker {
+	return &failureTracker{
+		threshold:  threshold,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		window:     window,
+		maxKeys:    100000,
+		now:        time.Now,
+		entries:    make(map[string]*failureEntry),
+	}
+}
+
+// Return how long `key` stays blocked. Zero if not blocked.
+func (ft *failureTracker) blockedFor(key string) time.Duration {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	entry, ok := ft.entries[key]
+	if !ok {
+		return 0
+	}
+
+	remaining := entry.blockedUntil.Sub(ft.now())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Record failure for `key`. Return true if this failure blocked the key.
+func (ft *failureTracker) recordFailure(key string) bool {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	now := ft.now()
+	entry, ok := ft.entries[key]
+	if ok && now.Sub(entry.lastFailure) > ft.window {
+		// Start over.
+		entry.failures = 0
+	}
+
+	if !ok {
+		if len(ft.entries) >= ft.maxKeys {
+			ft.removeExpired(now)
+		}
+		if len(ft.entries) >= ft.maxKeys {
+			// Do not grow without bounds (the keys are chosen by clients).
+			// Fail open.
+			log.Warnf("brute-force protection: tracking %d keys, do not track %s", len(ft.entries), key)
+			return false
+		}
+		entry = &failureEntry{}
+		ft.entries[key] = entry
+		bruteForceTrackedKeys.Set(float64(len(ft.entries)))
+	}
+
+	entry.failures++
+	entry.lastFailure = now
+
+	if entry.failures < ft.threshold {
+		return false
+	}
+
+	// Exponential backoff: `backoff` for the failure hitting the threshold,
+	// doubled for each one thereafter.
+	exp := entry.failures - ft.threshold
+	blockFor := ft.maxBackoff
+	if exp < 32 {
+		if d := time.Duration(float64(ft.backoff) * math.Pow(2, float64(exp))); d < ft.maxBackoff {
+			blockFor = d
+		}
+	}
+	entry.blockedUntil = now.Add(blockFor)
+	return true
+}
+
+// Remove entries that are neither blocked nor have recent failures. Expect
+// `ft.mu` to be held.
+func (ft *failureTracker) removeExpired(now time.Time) {
+	for key, entry := range ft.entries {
+		if now.After(entry.blockedUntil) && now.Sub(entry.lastFailure) > ft.window {
+			delete(ft.entries, key)
+		}
+	}
+	bruteForceTrackedKeys.Set(float64(len(ft.entries)))
+}
+
+func (ft *failureTracker) removeExpiredPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(ft.window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ft.mu.Lock()
+		ft.removeExpired(ft.now())
+		ft.mu.Unlock()
+	}
+}
+
+/*
+Read brute-force protection config from environment variables:
+
+	API_AUTH_BRUTEFORCE_THRESHOLD: failures before a client is blocked
+	  (default: 10). 0 disables brute-force protection.
+	API_AUTH_BRUTEFORCE_BACKOFF: initial blocking time (default: 1s).
+	API_AUTH_BRUTEFORCE_MAX_BACKOFF: maximum blocking time (default: 5m).
+	API_AUTH_BRUTEFORCE_WINDOW: failures are forgotten after this time
+	  without failure (default: 10m).
+	API_AUTH_BRUTEFORCE_CLIENT_IP_HEADER: request header set by the load
+	  balancer in front of the proxy to the client's IP (e.g. X-Forwarded-For
+	  or X-Real-IP). If not set, the peer address is used: behind a load
+	  balancer, that is the same for all clients. Also used for the audit
+	  log, even when brute-force protection is disabled.
+*/
+func (a *Authenticator) readBruteForceConfigFromEnv() error {
+	a.clientIPHeader = os.Getenv("API_AUTH_BRUTEFORCE_CLIENT_IP_HEADER")
+
+	threshold := 10
+	if s := os.Getenv("API_AUTH_BRUTEFORCE_THRESHOLD"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid API_AUTH_BRUTEFORCE_THRESHOLD: %s", s)
+		}
+		threshold = n
+	}
+
+	if threshold == 0 {
+		log.Infof("brute-force protection disabled")
+		a.bruteForce = nil
+		return nil
+	}
+
+	backoff, err := durationFromEnv("API_AUTH_BRUTEFORCE_BACKOFF", time.Second)
+	if err != nil {
+		return err
+	}
+	maxBackoff, err := durationFromEnv("API_AUTH_BRUTEFORCE_MAX_BACKOFF", 5*time.Minute)
+	if err != nil {
+		return err
+	}
+	if maxBackoff < backoff {
+		return fmt.Errorf("API_AUTH_BRUTEFORCE_MAX_BACKOFF (%s) must not be smaller than API_AUTH_BRUTEFORCE_BACKOFF (%s)", maxBackoff, backoff)
+	}
+	window, err := durationFromEnv("API_AUTH_BRUTEFORCE_WINDOW", 10*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("brute-force protection: block after %d failures, backoff: %s (max: %s), window: %s, client IP header: %q",
+		threshold, backoff, maxBackoff, window, a.clientIPHeader)
+	a.bruteForce = newFailureTracker(threshold, backoff, maxBackoff, window)
+	return nil
+}
+
+// Return the client's IP address as read from the configured header. For
+// X-Forwarded-For, use the last entry: the one appended by the load balancer
+// in front of this proxy. If no header is configured, or the request does not
+// carry it, return the host part of the peer address.
+func (a *Authenticator) clientIP(r *http.Request) string {
+	if a.clientIPHeader != "" {
+		if v := r.Header.Get(a.clientIPHeader); v != "" {
+			parts := strings.Split(v, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+/*
+Return the token prefix that failures are tracked by: the signed part of the
+token (header and payload segment), without the signature. Tokens with the
+same (guessed or stolen) claims and different forged signatures are tracked
+together. Hashed, so that tracked keys are of bounded size.
+*/
+func tokenPrefixKey(token string) string {
+	signed := token
+	if i := strings.LastIndex(token, "."); i >= 0 {
+		signed = token[:i]
+	}
+	sum := sha256.Sum256([]byte(signed))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Keys (by type) that failures of this request are tracked by: token prefix
+// and source IP (see clientIP()).
+func (a *Authenticator) bruteForceKeys(r *http.Request, token string) map[string]string {
+	keys := map[string]string{"token": "token:" + tokenPrefixKey(token)}
+	if ip := a.clientIP(r); ip != "" {
+		keys["ip"] = "ip:" + ip
+	}
+	return keys
+}
+
+// Failure reasons for tokens with a valid signature: the client did not guess
+// the token. Such failures (e.g. a client presenting its expired token) do not
+// count towards blocking.
+var verifiedTokenFailureReasons = map[string]bool{
+	reasonExpired:          true,
+	reasonNotYetValid:      true,
+	reasonMissingExpiry:    true,
+	reasonLifetimeExceeded: true,
+	reasonRevoked:          true,
+	reasonWrongTenant:      true,
+	reasonClaimMismatch:    true,
+	reasonInvalidSubject:   true,
+}
+
+/*
+Reject the request with a 429 response (with Retry-After header) if its source
+IP or token prefix is blocked. Return `true` if the request may proceed.
+
+Meant to be called before the token is verified.
+*/
+func (a *Authenticator) rejectIfBlockedOr429(w http.ResponseWriter, r *http.Request, token string) bool {
+	if a.bruteForce == nil {
+		return true
+	}
+
+	for keyType, key := range a.bruteForceKeys(r, token) {
+		if d := a.bruteForce.blockedFor(key); d > 0 {
+			bruteForceRejectedTotal.WithLabelValues(keyType).Inc()
+			return Exit429(w, d, "too many failed authentication attempts, retry later")
+		}
+	}
+	return true
+}
+
+// Record a failed token verification (failure reason: `reason`) for the
+// request's source IP and token prefix, unless the token's signature was
+// valid.
+func (a *Authenticator) recordBruteForceFailure(r *http.Request, token string, reason string) {
+	if a.bruteForce == nil || verifiedTokenFailureReasons[reason] {
+		return
+	}
+
+	for keyType, key := range a.bruteForceKeys(r, token) {
+		if a.bruteForce.recordFailure(key) {
+			bruteForceBlocksTotal.WithLabelValues(keyType).Inc()
+			log.Infof("brute-force protection: blocking %s after repeated authentication failures", key)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailureTracker_Backoff(t *testing.T) {
+	now := time.Now()
+	ft := newFailureTracker(3, time.Second, 10*time.Second, time.Minute)
+	ft.now = func() time.Time { return now }
+
+	assert.False(t, ft.recordFailure("ip:10.0.0.1"))
+	assert.False(t, ft.recordFailure("ip:10.0.0.1"))
+	assert.Equal(t, time.Duration(0), ft.blockedFor("ip:10.0.0.1"))
+
+	assert.True(t, ft.recordFailure("ip:10.0.0.1"))
+	assert.Equal(t, time.Second, ft.blockedFor("ip:10.0.0.1"))
+	assert.Equal(t, time.Duration(0), ft.blockedFor("ip:10.0.0.2"))
+
+	// Doubled for each further failure, up to the maximum.
+	now = now.Add(2 * time.Second)
+	assert.True(t, ft.recordFailure("ip:10.0.0.1"))
+	assert.Equal(t, 2*time.Second, ft.blockedFor("ip:10.0.0.1"))
+	for i := 0; i < 5; i++ {
+		ft.recordFailure("ip:10.0.0.1")
+	}
+	assert.Equal(t, 10*time.Second, ft.blockedFor("ip:10.0.0.1"))
+
+	// Failures are forgotten after the window.
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, time.Duration(0), ft.blockedFor("ip:10.0.0.1"))
+	assert.False(t, ft.recordFailure("ip:10.0.0.1"))
+
+	ft.removeExpired(now.Add(2 * time.Minute))
+	assert.Empty(t, ft.entries)
+}
+
+func TestFailureTracker_MaxKeys(t *testing.T) {
+	ft := newFailureTracker(1, time.Second, time.Second, time.Minute)
+	ft.maxKeys = 2
+
+	assert.True(t, ft.recordFailure("a"))
+	assert.True(t, ft.recordFailure("b"))
+	// Not tracked: fail open.
+	assert.False(t, ft.recordFailure("c"))
+	assert.Len(t, ft.entries, 2)
+}
+
+func TestAuthenticate_BruteForceProtection(t *testing.T) {
+	valid := signClaimsOrFail(t, &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "tenant-default",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+	})
+	// Same claims, forged signature.
+	forged := valid[:len(valid)-4] + "AAAA"
+
+	defaultAuthenticator.bruteForce = newFailureTracker(3, time.Minute, time.Hour, time.Hour)
+	defaultAuthenticator.clientIPHeader = "X-Forwarded-For"
+	defer func() {
+		defaultAuthenticator.bruteForce = nil
+		defaultAuthenticator.clientIPHeader = ""
+	}()
+
+	authenticate := func(token string, forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		defaultAuthenticator.GetTenantIdentityOr401(w, req, nil, false)
+		return w
+	}
+
+	blocksBefore := testutil.ToFloat64(bruteForceBlocksTotal.WithLabelValues("ip"))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 401, authenticate(forged, "192.0.2.1, 10.0.0.1").Result().StatusCode)
+	}
+	assert.Equal(t, blocksBefore+1, testutil.ToFloat64(bruteForceBlocksTotal.WithLabelValues("ip")))
+
+	// Source IP blocked: even a valid token is rejected (before verifying
+	// it).
+	w := authenticate(valid, "192.0.2.1, 10.0.0.1")
+	assert.Equal(t, 429, w.Result().StatusCode)
+	assert.Equal(t, "60", w.Result().Header.Get("Retry-After"))
+
+	// Another source IP, but the same token prefix: blocked, too.
+	assert.Equal(t, 429, authenticate(forged, "10.0.0.2").Result().StatusCode)
+
+	// Another source IP, another token: not blocked.
+	other := signClaimsOrFail(t, &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "tenant-other",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+	})
+	assert.Equal(t, 200, authenticate(other, "10.0.0.2").Result().StatusCode)
+}
+
+func TestBruteForceProtection_peerAddress(t *testing.T) {
+	key := genRSAKeyOrFail(t)
+	useKeySet(t, map[string]*verificationKey{
+		"rsakey": {alg: "RS256", key: &key.PublicKey},
+	})
+	sign := func(subject string, expiresAt time.Time) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, &tokenClaims{
+			StandardClaims: jwt.StandardClaims{Subject: subject, ExpiresAt: expiresAt.Unix()},
+		})
+		token.Header["kid"] = "rsakey"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("signing failed: %v", err)
+		}
+		return signed
+	}
+	expired := sign("tenant-default", time.Now().Add(-time.Hour))
+	valid := sign("tenant-default", time.Now().Add(time.Hour))
+
+	// No client IP header configured: failures are tracked by peer address.
+	defaultAuthenticator.bruteForce = newFailureTracker(3, time.Minute, time.Hour, time.Hour)
+	defer func() { defaultAuthenticator.bruteForce = nil }()
+
+	authenticate := func(token string, remoteAddr string) int {
+		req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		defaultAuthenticator.GetTenantIdentityOr401(w, req, nil, false)
+		return w.Result().StatusCode
+	}
+
+	// Expired tokens are not guessed: never blocked.
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, 401, authenticate(expired, "192.0.2.1:1234"))
+	}
+
+	// A client guessing tokens (a new one each time) gets its address
+	// blocked, regardless of the source port.
+	for i := 0; i < 3; i++ {
+		forged := sign(fmt.Sprintf("tenant-guess%d", i), time.Now().Add(time.Hour))
+		assert.Equal(t, 401, authenticate(forged[:len(forged)-4]+"AAAA", fmt.Sprintf("192.0.2.2:%d", 1000+i)))
+	}
+	assert.Equal(t, 429, authenticate(valid, "192.0.2.2:2000"))
+	assert.Equal(t, 200, authenticate(valid, "192.0.2.1:1234"))
+}
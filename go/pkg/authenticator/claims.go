@@ -0,0 +1,200 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var claimChecksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "authenticator",
+	Name:      "claim_checks_total",
+	Help:      "Outcomes of the aud and iss claim checks (match, mismatch, mismatch_logged).",
+}, []string{"claim", "outcome"})
+
+func init() {
+	prometheus.MustRegister(claimChecksTotal)
+}
+
+/*
+Read expected `aud` and `iss` claim values from the environment variables
+API_AUTHTOKEN_EXPECTED_AUDIENCE and API_AUTHTOKEN_EXPECTED_ISSUER.
+
+API_AUTHTOKEN_AUD_ISS_CHECK_MODE controls what happens upon mismatch:
+`enforce` (default) rejects the token, `log` only logs the mismatch (meant for
+migrating a deployment to tokens with the expected claims).
+
+Return an error upon an invalid mode.
+*/
+func (a *Authenticator) readClaimsConfigFromEnv() error {
+	a.expectedAudience = os.Getenv("API_AUTHTOKEN_EXPECTED_AUDIENCE")
+	a.expectedIssuer = os.Getenv("API_AUTHTOKEN_EXPECTED_ISSUER")
+
+	switch mode := os.Getenv("API_AUTHTOKEN_AUD_ISS_CHECK_MODE"); mode {
+	case "", "enforce":
+		a.claimsCheckLogOnly = false
+	case "log":
+		a.claimsCheckLogOnly = true
+	default:
+		return fmt.Errorf("invalid API_AUTHTOKEN_AUD_ISS_CHECK_MODE: %s (expected: enforce, log)", mode)
+	}
+
+	if a.expectedAudience != "" {
+		log.Infof("expected aud claim: %s (log only: %v)", a.expectedAudience, a.claimsCheckLogOnly)
+	}
+	if a.expectedIssuer != "" {
+		log.Infof("expected iss claim: %s (log only: %v)", a.expectedIssuer, a.claimsCheckLogOnly)
+	}
+	return nil
+}
+
+/*
+Check `aud` and `iss` claims against the configured expected values. Return
+`false` if the token must be rejected.
+
+A token issued for one Opstrace cluster must not be accepted by another one,
+even if both clusters happen to share verification keys.
+*/
+func (a *Authenticator) checkAudienceAndIssuer(claims *jwt.StandardClaims) bool {
+	ok := true
+
+	if a.expectedAudience != "" {
+		// Note: this also requires the claim to be present.
+		if !a.checkClaim("aud", claims.VerifyAudience(a.expectedAudience, true), claims.Audience, claims.Subject) {
+			ok = false
+		}
+	}
+
+	if a.expectedIssuer != "" {
+		if !a.checkClaim("iss", claims.VerifyIssuer(a.expectedIssuer, true), claims.Issuer, claims.Subject) {
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// Count and log outcome of an individual claim check. Return `false` if the
+// token must be rejected.
+func (a *Authenticator) checkClaim(claim string, match bool, value string, subject string) bool {
+	if match {
+		claimChecksTotal.WithLabelValues(claim, "match").Inc()
+		return true
+	}
+
+	if a.claimsCheckLogOnly {
+		claimChecksTotal.WithLabelValues(claim, "mismatch_logged").Inc()
+		log.Warnf("unexpected %s claim: %s (sub: %s), accept token (log-only mode)", claim, value, subject)
+		return true
+	}
+
+	claimChecksTotal.WithLabelValues(claim, "mismatch").Inc()
+	log.Infof("unexpected %s claim: %s (sub: %s)", claim, value, subject)
+	return false
+}
+
+/*
+Read time claim policy from environment variables:
+
+	API_AUTHTOKEN_CLOCK_SKEW_LEEWAY: tolerated clock skew for the `exp`, `nbf`
+	  and `iat` claims (Go duration string, default: 0s).
+	API_AUTHTOKEN_REQUIRE_EXP: if `true`, reject tokens without `exp` claim.
+	API_AUTHTOKEN_MAX_LIFETIME: if set, reject tokens valid for longer than
+	  that (Go duration string). Implies API_AUTHTOKEN_REQUIRE_EXP.
+*/
+func (a *Authenticator) readTimeClaimsConfigFromEnv() error {
+	a.clockSkewLeeway = 0
+	if s := os.Getenv("API_AUTHTOKEN_CLOCK_SKEW_LEEWAY"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid API_AUTHTOKEN_CLOCK_SKEW_LEEWAY: %s", s)
+		}
+		a.clockSkewLeeway = d
+	}
+
+	a.requireExpiry = false
+	if s := os.Getenv("API_AUTHTOKEN_REQUIRE_EXP"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid API_AUTHTOKEN_REQUIRE_EXP: %s", s)
+		}
+		a.requireExpiry = b
+	}
+
+	a.maxTokenLifetime = 0
+	if os.Getenv("API_AUTHTOKEN_MAX_LIFETIME") != "" {
+		d, err := durationFromEnv("API_AUTHTOKEN_MAX_LIFETIME", 0)
+		if err != nil {
+			return err
+		}
+		a.maxTokenLifetime = d
+		a.requireExpiry = true
+	}
+
+	log.Infof("clock skew leeway: %s, require exp claim: %v, max token lifetime: %s",
+		a.clockSkewLeeway, a.requireExpiry, a.maxTokenLifetime)
+	return nil
+}
+
+/*
+Check the `exp`, `nbf` and `iat` claims (tolerating the configured clock skew),
+and the token lifetime policy. Return the failure reason, or an empty string if
+the token is acceptable.
+
+This replaces the checks done by jwt-go (see jwt.StandardClaims.Valid()), which
+has no notion of leeway.
+*/
+func (a *Authenticator) checkTimeClaims(claims *jwt.StandardClaims, now time.Time) string {
+	leeway := int64(a.clockSkewLeeway / time.Second)
+	nowUnix := now.Unix()
+
+	if claims.ExpiresAt != 0 && nowUnix > claims.ExpiresAt+leeway {
+		return reasonExpired
+	}
+	if claims.NotBefore != 0 && nowUnix+leeway < claims.NotBefore {
+		return reasonNotYetValid
+	}
+	if claims.IssuedAt != 0 && nowUnix+leeway < claims.IssuedAt {
+		return reasonNotYetValid
+	}
+
+	if claims.ExpiresAt == 0 {
+		if a.requireExpiry {
+			return reasonMissingExpiry
+		}
+		return ""
+	}
+
+	if a.maxTokenLifetime > 0 {
+		maxLifetime := int64(a.maxTokenLifetime / time.Second)
+		// Lifetime as issued, and the remaining lifetime: `iat` may be
+		// missing or backdated.
+		if claims.IssuedAt != 0 && claims.ExpiresAt-claims.IssuedAt > maxLifetime {
+			return reasonLifetimeExceeded
+		}
+		if claims.ExpiresAt-nowUnix > maxLifetime+leeway {
+			return reasonLifetimeExceeded
+		}
+	}
+
+	return ""
+}
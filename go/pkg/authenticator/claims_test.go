@@ -0,0 +1,174 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func signClaimsOrFail(t *testing.T, claims jwt.Claims) string {
+	key := genRSAKeyOrFail(t)
+	useKeySet(t, map[string]*verificationKey{
+		"rsakey": {alg: "RS256", key: &key.PublicKey},
+	})
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "rsakey"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("signing failed: %v", err)
+	}
+	return signed
+}
+
+// Configure expected aud and iss claims for the duration of the test.
+func expectAudienceAndIssuer(t *testing.T, aud string, iss string, logOnly bool) {
+	a := defaultAuthenticator
+	a.expectedAudience, a.expectedIssuer, a.claimsCheckLogOnly = aud, iss, logOnly
+	t.Cleanup(func() {
+		a.expectedAudience, a.expectedIssuer, a.claimsCheckLogOnly = "", "", false
+	})
+}
+
+func TestValidateAuthToken_AudienceAndIssuer(t *testing.T) {
+	expectAudienceAndIssuer(t, "opstrace-cluster-foo", "opstrace-cli", false)
+
+	token := signClaimsOrFail(t, &jwt.StandardClaims{
+		Subject:   "tenant-default",
+		Audience:  "opstrace-cluster-foo",
+		Issuer:    "opstrace-cli",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	tenantName, err := defaultAuthenticator.validateAuthTokenGetTenantName(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "default", tenantName)
+
+	// Token issued for another cluster.
+	mismatchesBefore := testutil.ToFloat64(claimChecksTotal.WithLabelValues("aud", "mismatch"))
+	token = signClaimsOrFail(t, &jwt.StandardClaims{
+		Subject:   "tenant-default",
+		Audience:  "opstrace-cluster-bar",
+		Issuer:    "opstrace-cli",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	_, err = defaultAuthenticator.validateAuthTokenGetTenantName(token)
+	assert.Error(t, err)
+	assert.Equal(t, mismatchesBefore+1, testutil.ToFloat64(claimChecksTotal.WithLabelValues("aud", "mismatch")))
+
+	// Missing issuer.
+	token = signClaimsOrFail(t, &jwt.StandardClaims{
+		Subject:   "tenant-default",
+		Audience:  "opstrace-cluster-foo",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	_, err = defaultAuthenticator.validateAuthTokenGetTenantName(token)
+	assert.Error(t, err)
+}
+
+func TestValidateAuthToken_AudienceLogOnly(t *testing.T) {
+	expectAudienceAndIssuer(t, "opstrace-cluster-foo", "", true)
+
+	loggedBefore := testutil.ToFloat64(claimChecksTotal.WithLabelValues("aud", "mismatch_logged"))
+	token := signClaimsOrFail(t, &jwt.StandardClaims{
+		Subject:   "tenant-default",
+		Audience:  "opstrace-cluster-bar",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	tenantName, err := defaultAuthenticator.validateAuthTokenGetTenantName(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "default", tenantName)
+	assert.Equal(t, loggedBefore+1, testutil.ToFloat64(claimChecksTotal.WithLabelValues("aud", "mismatch_logged")))
+}
+
+func TestCheckTimeClaims(t *testing.T) {
+	a := newAuthenticator()
+	now := time.Now()
+	at := func(d time.Duration) int64 { return now.Add(d).Unix() }
+
+	// No leeway.
+	assert.Equal(t, reasonExpired, a.checkTimeClaims(&jwt.StandardClaims{ExpiresAt: at(-time.Second)}, now))
+	assert.Equal(t, reasonNotYetValid, a.checkTimeClaims(&jwt.StandardClaims{NotBefore: at(5 * time.Second)}, now))
+	assert.Equal(t, reasonNotYetValid, a.checkTimeClaims(&jwt.StandardClaims{IssuedAt: at(5 * time.Second)}, now))
+	// No exp claim: accepted unless required.
+	assert.Equal(t, "", a.checkTimeClaims(&jwt.StandardClaims{}, now))
+
+	a.clockSkewLeeway = 10 * time.Second
+	assert.Equal(t, "", a.checkTimeClaims(&jwt.StandardClaims{ExpiresAt: at(-time.Second)}, now))
+	assert.Equal(t, "", a.checkTimeClaims(&jwt.StandardClaims{NotBefore: at(5 * time.Second), IssuedAt: at(5 * time.Second)}, now))
+	assert.Equal(t, reasonExpired, a.checkTimeClaims(&jwt.StandardClaims{ExpiresAt: at(-time.Minute)}, now))
+	assert.Equal(t, reasonNotYetValid, a.checkTimeClaims(&jwt.StandardClaims{NotBefore: at(time.Minute)}, now))
+
+	a.requireExpiry = true
+	assert.Equal(t, reasonMissingExpiry, a.checkTimeClaims(&jwt.StandardClaims{IssuedAt: at(-time.Hour)}, now))
+
+	a.maxTokenLifetime = 24 * time.Hour
+	assert.Equal(t, "", a.checkTimeClaims(&jwt.StandardClaims{IssuedAt: at(-time.Hour), ExpiresAt: at(time.Hour)}, now))
+	assert.Equal(t, reasonLifetimeExceeded,
+		a.checkTimeClaims(&jwt.StandardClaims{IssuedAt: at(-time.Hour), ExpiresAt: at(30 * time.Hour)}, now))
+	// Backdated or missing iat: the remaining lifetime counts, too.
+	assert.Equal(t, reasonLifetimeExceeded, a.checkTimeClaims(&jwt.StandardClaims{ExpiresAt: at(48 * time.Hour)}, now))
+}
+
+func TestValidateAuthToken_TimeClaimPolicy(t *testing.T) {
+	defaultAuthenticator.maxTokenLifetime = time.Hour
+	defaultAuthenticator.requireExpiry = true
+	defer func() {
+		defaultAuthenticator.maxTokenLifetime = 0
+		defaultAuthenticator.requireExpiry = false
+	}()
+
+	token := signClaimsOrFail(t, &jwt.StandardClaims{Subject: "tenant-default"})
+	_, err := defaultAuthenticator.validateAuthToken(token)
+	assert.Error(t, err)
+	assert.Equal(t, reasonMissingExpiry, failureReason(err))
+
+	token = signClaimsOrFail(t, &jwt.StandardClaims{
+		Subject:   "tenant-default",
+		ExpiresAt: time.Now().Add(365 * 24 * time.Hour).Unix(),
+	})
+	_, err = defaultAuthenticator.validateAuthToken(token)
+	assert.Equal(t, reasonLifetimeExceeded, failureReason(err))
+
+	token = signClaimsOrFail(t, &jwt.StandardClaims{
+		Subject:   "tenant-default",
+		ExpiresAt: time.Now().Add(30 * time.Minute).Unix(),
+	})
+	_, err = defaultAuthenticator.validateAuthToken(token)
+	assert.NoError(t, err)
+}
+
+func TestReadTimeClaimsConfigFromEnv(t *testing.T) {
+	a := newAuthenticator()
+	defer func() {
+		os.Unsetenv("API_AUTHTOKEN_CLOCK_SKEW_LEEWAY")
+		os.Unsetenv("API_AUTHTOKEN_MAX_LIFETIME")
+	}()
+
+	os.Setenv("API_AUTHTOKEN_CLOCK_SKEW_LEEWAY", "30s")
+	os.Setenv("API_AUTHTOKEN_MAX_LIFETIME", "2160h")
+	assert.NoError(t, a.readTimeClaimsConfigFromEnv())
+	assert.Equal(t, 30*time.Second, a.clockSkewLeeway)
+	assert.Equal(t, 2160*time.Hour, a.maxTokenLifetime)
+	assert.True(t, a.requireExpiry)
+
+	os.Setenv("API_AUTHTOKEN_CLOCK_SKEW_LEEWAY", "-1s")
+	assert.Error(t, a.readTimeClaimsConfigFromEnv())
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Extract tenant name from a (verified) client certificate. Return `false` if
+// the certificate does not carry a tenant name in the configured field.
+type clientCertTenantExtractor func(cert *x509.Certificate) (string, bool)
+
+/*
+Build TLS server config requiring client certificates, if presented, to be
+signed by a CA in the PEM file `clientCAFile`. Clients without certificate are
+still accepted (they are expected to present an authentication token).
+*/
+func NewClientCertTLSConfig(clientCAFile string) (*tls.Config, error) {
+	data, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA file failed: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in client CA file %s", clientCAFile)
+	}
+
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+/*
+Accept verified TLS client certificates as authentication proof, as an
+alternative to authentication tokens. `tenantField` specifies where the tenant
+name is read from:
+
+	cn            the subject common name
+	san-uri:<re>  the first URI subject alternative name matching the regular
+	              expression <re>
+	ou:<re>       the first subject organizational unit matching <re>
+
+For the regular expressions, the first capture group (or, if there is none,
+the whole match) is the tenant name. Example: `san-uri:^opstrace://tenant/(.+)$`.
+
+Certificates are verified by the TLS server (see NewClientCertTLSConfig()), not
+here: only the verified chains of a request are considered.
+*/
+func (a *Authenticator) EnableClientCertAuthentication(tenantField string) error {
+	extractor, err := parseClientCertTenantField(tenantField)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("client certificate authentication enabled, tenant name from: %s", tenantField)
+	a.clientCertTenant = extractor
+	return nil
+}
+
+func parseClientCertTenantField(tenantField string) (clientCertTenantExtractor, error) {
+	if tenantField == "cn" {
+		return func(cert *x509.Certificate) (string, bool) {
+			return cert.Subject.CommonName, cert.Subject.CommonName != ""
+		}, nil
+	}
+
+	parts := strings.SplitN(tenantField, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid client certificate tenant field: %s (expected: cn, san-uri:<regex>, ou:<regex>)", tenantField)
+	}
+
+	re, err := regexp.Compile(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate tenant field regex: %s", err)
+	}
+
+	switch parts[0] {
+	case "san-uri":
+		return func(cert *x509.Certificate) (string, bool) {
+			for _, u := range cert.URIs {
+				if tenantName, ok := matchTenantName(re, u.String()); ok {
+					return tenantName, true
+				}
+			}
+			return "", false
+		}, nil
+	case "ou":
+		return func(cert *x509.Certificate) (string, bool) {
+			for _, ou := range cert.Subject.OrganizationalUnit {
+				if tenantName, ok := matchTenantName(re, ou); ok {
+					return tenantName, true
+				}
+			}
+			return "", false
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid client certificate tenant field: %s (expected: cn, san-uri:<regex>, ou:<regex>)", tenantField)
+	}
+}
+
+func matchTenantName(re *regexp.Regexp, s string) (string, bool) {
+	m := re.FindStringSubmatch(s)
+	if m == nil {
+		return "", false
+	}
+	if len(m) > 1 {
+		return m[1], m[1] != ""
+	}
+	return m[0], m[0] != ""
+}
+
+// Return `true` if client certificate authentication is enabled and the TLS
+// server verified a client certificate.
+func (a *Authenticator) hasVerifiedClientCert(r *http.Request) bool {
+	return a.clientCertTenant != nil &&
+		r.TLS != nil &&
+		len(r.TLS.VerifiedChains) > 0
+}
+
+// Return `true` if the request is to be authenticated by its client
+// certificate: it has a verified client certificate, and no authentication
+// token is presented (which takes precedence).
+func (a *Authenticator) hasClientCertProof(r *http.Request) bool {
+	return a.hasVerifiedClientCert(r) && r.Header.Get("Authorization") == ""
+}
+
+/*
+Read tenant name from the verified client certificate. Client certificates
+do not carry scopes: the identity is not restricted.
+*/
+func (a *Authenticator) authenticateTenantByClientCertOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName *string,
+) (*TenantIdentity, bool) {
+	// The leaf certificate of the first verified chain is the client's.
+	cert := r.TLS.VerifiedChains[0][0]
+
+	tenantName, ok := a.clientCertTenant(cert)
+	if !ok {
+		log.Infof("client certificate without tenant name (subject: %s)", cert.Subject)
+		return nil, exitAuthFailure(w, r, reasonClientCertNoTenant, "bad client certificate: no tenant name")
+	}
+
+	if expectedTenantName != nil && *expectedTenantName != tenantName {
+		return nil, exitAuthFailure(w, r, reasonWrongTenant, fmt.Sprintf("bad client certificate: unexpected tenant: %s", tenantName))
+	}
+
+	return &TenantIdentity{
+		TenantName: tenantName,
+		method:     methodClientCert,
+		subject:    cert.Subject.String(),
+	}, true
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func selfSignedCertOrFail(t *testing.T, template *x509.Certificate) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("key generation failed: %v", err)
+	}
+
+	template.SerialNumber = big.NewInt(1)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("certificate creation failed: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("certificate parsing failed: %v", err)
+	}
+	return cert
+}
+
+func TestClientCertTenantField(t *testing.T) {
+	u, _ := url.Parse("opstrace://tenant/foo")
+	cert := selfSignedCertOrFail(t, &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "bar",
+			OrganizationalUnit: []string{"ops", "tenant-baz"},
+		},
+		URIs: []*url.URL{u},
+	})
+
+	for field, expected := range map[string]string{
+		"cn":                                  "bar",
+		"san-uri:^opstrace://tenant/([^/]+)$": "foo",
+		"ou:^tenant-(.+)$":                    "baz",
+		"ou:^ops$":                            "ops",
+	} {
+		extractor, err := parseClientCertTenantField(field)
+		assert.NoError(t, err)
+		tenantName, ok := extractor(cert)
+		assert.True(t, ok, field)
+		assert.Equal(t, expected, tenantName, field)
+	}
+
+	extractor, err := parseClientCertTenantField("ou:^team-(.+)$")
+	assert.NoError(t, err)
+	_, ok := extractor(cert)
+	assert.False(t, ok)
+
+	for _, field := range []string{"", "dn", "ou:", "ou:(", "email:.*"} {
+		_, err := parseClientCertTenantField(field)
+		assert.Error(t, err, field)
+	}
+}
+
+func TestAuthenticateByClientCert(t *testing.T) {
+	cert := selfSignedCertOrFail(t, &x509.Certificate{Subject: pkix.Name{CommonName: "foo"}})
+
+	a := newAuthenticator()
+	assert.NoError(t, a.EnableClientCertAuthentication("cn"))
+
+	req := httptest.NewRequest("GET", "https://localhost/api/v1/push", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	expectedTenantName := "foo"
+	identity, ok := a.GetTenantIdentityOr401(httptest.NewRecorder(), req, &expectedTenantName, false)
+	assert.True(t, ok)
+	assert.Equal(t, "foo", identity.TenantName)
+
+	// Same tenant matching rules as for tokens.
+	otherTenantName := "bar"
+	w := httptest.NewRecorder()
+	_, ok = a.GetTenantIdentityOr401(w, req, &otherTenantName, false)
+	assert.False(t, ok)
+	assert.Equal(t, 403, w.Result().StatusCode)
+
+	// Not enabled: certificate is ignored, token required.
+	w = httptest.NewRecorder()
+	_, ok = newAuthenticator().GetTenantIdentityOr401(w, req, &expectedTenantName, false)
+	assert.False(t, ok)
+	assert.Equal(t, "Authorization header missing", w.Body.String())
+}
+
+func TestNewClientCertTLSConfig(t *testing.T) {
+	ca := selfSignedCertOrFail(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	})
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600))
+
+	cfg, err := NewClientCertTLSConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, cfg.ClientAuth)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("foo"), 0600))
+	_, err = NewClientCertTLSConfig(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+/*
+The jwt-go library (v3) does not implement the EdDSA signing method (RFC 8037).
+Implement it here (for Ed25519 keys only), and register it with the library so
+that `jwt.Parse*()` can verify EdDSA-signed tokens.
+*/
+type signingMethodEdDSA struct{}
+
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+// Expect `key` to be of type `ed25519.PublicKey`.
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pubkey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(pubkey, []byte(signingString), sig) {
+		return fmt.Errorf("ed25519: verification error")
+	}
+	return nil
+}
+
+// Expect `key` to be of type `ed25519.PrivateKey`.
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privkey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privkey, []byte(signingString))), nil
+}
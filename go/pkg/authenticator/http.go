@@ -15,9 +15,14 @@
 package authenticator
 
 import (
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	json "github.com/json-iterator/go"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -46,36 +51,166 @@ func getAuthTokenUnverifiedFromHeaderOr401(w http.ResponseWriter, r *http.Reques
 	// of these headers yet, maybe never.)
 	av := r.Header.Get("Authorization")
 	if av == "" {
-		return "", exit401(w, "Authorization header missing")
+		return "", exitAuthFailure(w, r, reasonMissingHeader, "Authorization header missing")
 	}
 	asplits := strings.Split(av, "Bearer ")
 
 	if len(asplits) != 2 {
-		return "", exit401(w, "Authorization header format invalid. Expecting `Authorization: Bearer <AUTHTOKEN>`")
+		return "", exitAuthFailure(w, r, reasonBadFormat, "Authorization header format invalid. Expecting `Authorization: Bearer <AUTHTOKEN>`")
 	}
 
 	authTokenUnverified := asplits[1]
 	return authTokenUnverified, true
 }
 
-/* Write 401 response and return false.
+// Realm in WWW-Authenticate response headers.
+const authRealm = "opstrace"
 
-The return value is just for convenience: write `return exit401()` in the
-caller instead of `exit401(); return false`.
+// Error codes in WWW-Authenticate response headers and JSON response bodies,
+// see RFC 6750 section 3.1.
+const (
+	bearerErrorInvalidRequest    = "invalid_request"
+	bearerErrorInvalidToken      = "invalid_token"
+	bearerErrorInsufficientScope = "insufficient_scope"
+)
+
+/*
+Error response for a rejected request: HTTP status code and RFC 6750 error
+code. `code` is empty when the request did not present any authentication
+proof (RFC 6750 section 3.1: no error information in that case).
+*/
+type authErrorResponse struct {
+	status      int
+	code        string
+	description string
+	// For insufficient_scope: the scope required by the route.
+	scope string
+}
+
+// JSON response body, for clients that accept JSON.
+type authErrorBody struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+/*
+Map failure reason (see audit.go) to error response.
+
+A token valid for another tenant is a valid token which does not grant access
+to the requested tenant: 403 (insufficient_scope), not 401. A malformed
+Authorization header or a missing tenant selection is a bad request: 400
+(invalid_request).
+
+Clients need to tell an expired token apart from a misconfigured one; the
+error description says so where that does not expose sensitive details.
+*/
+func responseForFailure(reason string, errmsg string) authErrorResponse {
+	switch reason {
+	case reasonMissingHeader, reasonMissingAPIKey:
+		return authErrorResponse{status: http.StatusUnauthorized, description: errmsg}
+	case reasonBadFormat, reasonTenantNotSelected:
+		return authErrorResponse{status: http.StatusBadRequest, code: bearerErrorInvalidRequest, description: errmsg}
+	case reasonWrongTenant, reasonUnknownTenant, reasonOIDCTenantForbidden:
+		return authErrorResponse{status: http.StatusForbidden, code: bearerErrorInsufficientScope, description: errmsg}
+	case reasonExpired:
+		return authErrorResponse{status: http.StatusUnauthorized, code: bearerErrorInvalidToken, description: "token expired"}
+	case reasonNotYetValid:
+		return authErrorResponse{status: http.StatusUnauthorized, code: bearerErrorInvalidToken, description: "token not yet valid"}
+	case reasonMissingExpiry:
+		return authErrorResponse{status: http.StatusUnauthorized, code: bearerErrorInvalidToken, description: "token without expiry"}
+	case reasonLifetimeExceeded:
+		return authErrorResponse{status: http.StatusUnauthorized, code: bearerErrorInvalidToken, description: "token lifetime exceeds maximum"}
+	case reasonRevoked:
+		return authErrorResponse{status: http.StatusUnauthorized, code: bearerErrorInvalidToken, description: "token revoked"}
+	}
+	return authErrorResponse{status: http.StatusUnauthorized, code: bearerErrorInvalidToken, description: errmsg}
+}
+
+// Build value of the WWW-Authenticate response header.
+func (er authErrorResponse) challenge() string {
+	params := []string{fmt.Sprintf("realm=%q", authRealm)}
+	if er.code != "" {
+		params = append(params, fmt.Sprintf("error=%q", er.code))
+		if er.description != "" {
+			params = append(params, fmt.Sprintf("error_description=%q", sanitizeChallengeParam(er.description)))
+		}
+	}
+	if er.scope != "" {
+		params = append(params, fmt.Sprintf("scope=%q", sanitizeChallengeParam(er.scope)))
+	}
+	return "Bearer " + strings.Join(params, ", ")
+}
+
+// RFC 6750 restricts the characters in error_description and scope values
+// (printable ASCII, except for double quote and backslash). Values may contain
+// client input, such as a tenant name.
+func sanitizeChallengeParam(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+func acceptsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+/* Write error response and return false.
 
-`errmsg` is written to response body and should therefore be short and not
+The return value is just for convenience: write `return writeAuthError()` in
+the caller instead of `writeAuthError(); return false`.
+
+`errmsg` is written to the response body (as plain text, or as JSON error
+description if the client accepts JSON) and should therefore be short and not
 undermine security. Useful hints: yes (such as "authentication token missing"
 or "unexpected Authorization header format"). No security hints such as
 "signature verification failed".
 
 Note that HTTP status code 401 is canonical for "not authenticated" although
-the corresponding name is 'Unauthorized'.
+the corresponding name is 'Unauthorized'. 403 is for requests that are
+authenticated, yet not allowed to do what they attempt to do (e.g. because of
+an insufficient token scope).
+*/
+func writeAuthError(w http.ResponseWriter, r *http.Request, er authErrorResponse, errmsg string) bool {
+	w.Header().Set("WWW-Authenticate", er.challenge())
+	log.Infof("emit %d. Err: %s", er.status, errmsg)
+
+	var body []byte
+	if acceptsJSON(r) {
+		code := er.code
+		if code == "" {
+			// Do not leave clients parsing the JSON body without
+			// error code.
+			code = bearerErrorInvalidRequest
+		}
+		body, _ = json.Marshal(authErrorBody{Error: code, ErrorDescription: er.description})
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		body = []byte(errmsg)
+	}
+
+	w.WriteHeader(er.status)
+	_, werr := w.Write(body)
+	if werr != nil {
+		log.Errorf("writing response failed: %v", werr)
+	}
+	return false
+}
+
+/* Exit429 writes a 429 response with Retry-After header (in seconds, rounded
+up) and returns false.
+
+For clients that are blocked after repeated authentication failures, and for
+rate limited requests (see pkg/middleware).
 */
-func exit401(resp http.ResponseWriter, errmsg string) bool {
-	resp.WriteHeader(http.StatusUnauthorized)
-	log.Infof("emit 401. Err: %s", errmsg)
+func Exit429(w http.ResponseWriter, retryAfter time.Duration, errmsg string) bool {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	log.Infof("emit 429. Err: %s", errmsg)
 
-	_, werr := resp.Write([]byte(errmsg))
+	_, werr := w.Write([]byte(errmsg))
 	if werr != nil {
 		log.Errorf("writing response failed: %v", werr)
 	}
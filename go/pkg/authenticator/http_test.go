@@ -0,0 +1,95 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthErrorResponse_WWWAuthenticate(t *testing.T) {
+	expired := signClaimsOrFail(t, &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "tenant-default",
+			ExpiresAt: time.Now().Add(-time.Hour).Unix(),
+		},
+	})
+
+	// No authentication proof: no error code.
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+	w := httptest.NewRecorder()
+	_, ok := GetTenantIdentityOr401(w, req, nil, false)
+	assert.False(t, ok)
+	assert.Equal(t, 401, w.Result().StatusCode)
+	assert.Equal(t, `Bearer realm="opstrace"`, w.Result().Header.Get("WWW-Authenticate"))
+	assert.Equal(t, "Authorization header missing", w.Body.String())
+
+	req.Header.Set("Authorization", "Bearer "+expired)
+	w = httptest.NewRecorder()
+	_, ok = GetTenantIdentityOr401(w, req, nil, false)
+	assert.False(t, ok)
+	assert.Equal(t, 401, w.Result().StatusCode)
+	assert.Equal(t, `Bearer realm="opstrace", error="invalid_token", error_description="token expired"`,
+		w.Result().Header.Get("WWW-Authenticate"))
+	assert.Equal(t, "bad authentication token", w.Body.String())
+
+	// JSON body for clients that accept JSON.
+	req.Header.Set("Accept", "application/json, text/plain")
+	w = httptest.NewRecorder()
+	_, ok = GetTenantIdentityOr401(w, req, nil, false)
+	assert.False(t, ok)
+	assert.Equal(t, "application/json", w.Result().Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"error": "invalid_token", "error_description": "token expired"}`, w.Body.String())
+}
+
+func TestAuthErrorResponse_Forbidden(t *testing.T) {
+	token := signClaimsOrFail(t, &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "tenant-default",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		Scope: "metrics:read",
+	})
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/push", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	// Valid token for another tenant.
+	otherTenantName := "other"
+	w := httptest.NewRecorder()
+	_, ok := GetTenantIdentityOr401(w, req, &otherTenantName, false)
+	assert.False(t, ok)
+	assert.Equal(t, 403, w.Result().StatusCode)
+	assert.Contains(t, w.Result().Header.Get("WWW-Authenticate"), `error="insufficient_scope"`)
+
+	expectedTenantName := "default"
+	identity, ok := GetTenantIdentityOr401(httptest.NewRecorder(), req, &expectedTenantName, false)
+	assert.True(t, ok)
+
+	w = httptest.NewRecorder()
+	assert.False(t, RequireScopeOr403(w, req, identity, ScopeMetricsWrite))
+	assert.Equal(t, 403, w.Result().StatusCode)
+	assert.Equal(t,
+		`Bearer realm="opstrace", error="insufficient_scope", error_description="insufficient scope: metrics:write required", scope="metrics:write"`,
+		w.Result().Header.Get("WWW-Authenticate"))
+}
+
+func TestSanitizeChallengeParam(t *testing.T) {
+	assert.Equal(t, `unexpected tenant: ?a?b?`, sanitizeChallengeParam("unexpected tenant: \"a\\b\n"))
+}
@@ -0,0 +1,292 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opstrace/opstrace/go/pkg/graphql"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Minimum time between two key set refreshes triggered by unknown integration
+// keys (which anyone can send).
+const integrationKeysMinRefreshInterval = 30 * time.Second
+
+// Scopes granted to requests authenticated with an integration key:
+// integrations send data, they do not read it.
+var integrationKeyScopes = []string{ScopeMetricsWrite, ScopeLogsWrite}
+
+var integrationKeysLoaded = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "authenticator",
+	Name:      "integration_keys",
+	Help:      "Number of integration keys accepted for authentication.",
+})
+
+func init() {
+	prometheus.MustRegister(integrationKeysLoaded)
+}
+
+// A tenant integration, as stored in the Hasura `integration` table.
+type integrationKey struct {
+	id     string
+	name   string
+	kind   string
+	tenant string
+}
+
+// Source of integration keys. Map key: SHA256 digest of the integration key.
+type integrationDirectory interface {
+	listIntegrationKeys() (map[[sha256.Size]byte]*integrationKey, error)
+}
+
+/*
+Integration keys (of all tenants), read from the integration directory.
+
+Re-read periodically, so that deleted integrations stop being accepted, and on
+demand when an unknown key is presented (rate-limited), so that new
+integrations can be used right away. If reading fails, the last known good set
+stays in use.
+*/
+type integrationKeyStore struct {
+	directory integrationDirectory
+	// For refreshes triggered by unknown keys.
+	refreshLimit refreshLimiter
+
+	// Protects the fields below.
+	mu   sync.RWMutex
+	keys map[[sha256.Size]byte]*integrationKey
+}
+
+func newIntegrationKeyStore(directory integrationDirectory) *integrationKeyStore {
+	return &integrationKeyStore{
+		directory:    directory,
+		refreshLimit: refreshLimiter{minInterval: integrationKeysMinRefreshInterval},
+		keys:         make(map[[sha256.Size]byte]*integrationKey),
+	}
+}
+
+// Look up integration by key. If the key is not known, refresh (rate-limited)
+// and try again.
+func (s *integrationKeyStore) lookup(key string) (*integrationKey, bool) {
+	digest := sha256.Sum256([]byte(key))
+
+	s.mu.RLock()
+	ik, ok := s.keys[digest]
+	s.mu.RUnlock()
+
+	if ok || !s.refreshLimit.reserve() {
+		return ik, ok
+	}
+
+	log.Infof("integration keys: unknown key, refresh")
+	if err := s.update(); err != nil {
+		log.Errorf("integration keys: refresh failed, keep using last known keys: %s", err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ik, ok = s.keys[digest]
+	return ik, ok
+}
+
+// Re-read integration keys. Replace the current set only if that succeeded.
+func (s *integrationKeyStore) refresh() error {
+	s.refreshLimit.start()
+	return s.update()
+}
+
+// Like refresh(), for callers that reserved the refresh, see lookup().
+func (s *integrationKeyStore) update() error {
+	keys, err := s.directory.listIntegrationKeys()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+
+	integrationKeysLoaded.Set(float64(len(keys)))
+	log.Debugf("integration keys: read %d key(s)", len(keys))
+	return nil
+}
+
+func (s *integrationKeyStore) refreshPeriodically(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.refresh(); err != nil {
+			log.Errorf("integration keys: periodic refresh failed, keep using last known keys: %s", err)
+		}
+	}
+}
+
+// Integration directory backed by Hasura.
+type hasuraIntegrationDirectory struct {
+	access *graphql.GraphqlAccess
+}
+
+/*
+Read the integrations of all tenants via GetIntegrationsDump, and their
+tenants' names via GetTenants: two queries, regardless of the number of
+tenants. Integrations without key, and integrations of tenants that are not
+known (e.g. deleted in the meantime), are skipped.
+*/
+func (h *hasuraIntegrationDirectory) listIntegrationKeys() (map[[sha256.Size]byte]*integrationKey, error) {
+	treq, err := graphql.NewGetTenantsRequest(h.access.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	var tenantsResult graphql.GetTenantsResponse
+	if err := h.access.Execute(treq.Request, &tenantsResult); err != nil {
+		return nil, err
+	}
+
+	tenantNames := make(map[string]string, len(tenantsResult.Tenant))
+	for _, t := range tenantsResult.Tenant {
+		tenantNames[t.ID] = t.Name
+	}
+
+	ireq, err := graphql.NewGetIntegrationsDumpRequest(h.access.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Do not use GetIntegrationsDumpResponse: `data` is a JSON object, not a
+	// string.
+	var integrationsResult struct {
+		Integration []struct {
+			ID       string `json:"id"`
+			TenantID string `json:"tenant_id"`
+			Name     string `json:"name"`
+			Key      string `json:"key"`
+			Kind     string `json:"kind"`
+		} `json:"integration"`
+	}
+	if err := h.access.Execute(ireq.Request, &integrationsResult); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[[sha256.Size]byte]*integrationKey)
+	for _, i := range integrationsResult.Integration {
+		if i.Key == "" {
+			continue
+		}
+		tenantName, ok := tenantNames[i.TenantID]
+		if !ok {
+			log.Debugf("integration keys: integration %s of unknown tenant %s, skip", i.ID, i.TenantID)
+			continue
+		}
+		keys[sha256.Sum256([]byte(i.Key))] = &integrationKey{
+			id:     i.ID,
+			name:   i.Name,
+			kind:   i.Kind,
+			tenant: tenantName,
+		}
+	}
+	return keys, nil
+}
+
+/*
+Read integration key config from environment:
+
+	API_AUTH_INTEGRATION_KEYS: if true, accept the keys of tenant integrations
+	  (instead of a tenant API authentication token). Default: false.
+	API_AUTH_INTEGRATION_KEYS_REFRESH_INTERVAL: how often integrations are
+	  re-read (default: 1m). Bounds the time a deleted integration's key is
+	  still accepted.
+	GRAPHQL_ENDPOINT, HASURA_GRAPHQL_ADMIN_SECRET: Hasura access.
+*/
+func (a *Authenticator) readIntegrationKeysConfigFromEnv() error {
+	a.integrationKeys = nil
+
+	enabled := false
+	if s := os.Getenv("API_AUTH_INTEGRATION_KEYS"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid API_AUTH_INTEGRATION_KEYS: %s", s)
+		}
+		enabled = b
+	}
+	if !enabled {
+		return nil
+	}
+
+	interval, err := durationFromEnv("API_AUTH_INTEGRATION_KEYS_REFRESH_INTERVAL", time.Minute)
+	if err != nil {
+		return err
+	}
+
+	access, err := graphqlAccessFromEnv("API_AUTH_INTEGRATION_KEYS")
+	if err != nil {
+		return err
+	}
+
+	store := newIntegrationKeyStore(&hasuraIntegrationDirectory{access})
+	if err := store.refresh(); err != nil {
+		return fmt.Errorf("reading integration keys failed: %s", err)
+	}
+
+	log.Infof("accept integration keys (refresh interval: %s)", interval)
+	a.integrationKeys = store
+	a.integrationKeysRefreshInterval = interval
+	return nil
+}
+
+// Tenant API authentication tokens are JWTs: three dot-separated segments.
+// Integration keys are not.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+/*
+Verify `token`: an integration key (if enabled, and if the token is not a JWT)
+or a tenant API authentication token. Return the identity, or an authFailure
+error.
+*/
+func (a *Authenticator) validateTokenOrIntegrationKey(token string) (*TenantIdentity, error) {
+	if a.integrationKeys == nil || looksLikeJWT(token) {
+		return a.validateAuthToken(token)
+	}
+
+	ik, ok := a.integrationKeys.lookup(token)
+	if !ok {
+		return nil, &authFailure{reasonUnknownIntegrationKey, "bad authentication token"}
+	}
+
+	return &TenantIdentity{
+		TenantName:      ik.tenant,
+		Scopes:          integrationKeyScopes,
+		method:          methodIntegrationKey,
+		subject:         "integration-" + ik.id,
+		integrationName: ik.name,
+	}, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opstrace/opstrace/go/pkg/graphql"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeIntegrationDirectory struct {
+	keys    map[string]*integrationKey
+	fetches int32
+	// Simulated query latency.
+	delay time.Duration
+}
+
+func (d *fakeIntegrationDirectory) listIntegrationKeys() (map[[sha256.Size]byte]*integrationKey, error) {
+	atomic.AddInt32(&d.fetches, 1)
+	time.Sleep(d.delay)
+	keys := make(map[[sha256.Size]byte]*integrationKey)
+	for k, ik := range d.keys {
+		keys[sha256.Sum256([]byte(k))] = ik
+	}
+	return keys, nil
+}
+
+func TestAuthenticate_IntegrationKey(t *testing.T) {
+	directory := &fakeIntegrationDirectory{keys: map[string]*integrationKey{
+		"key-foo": {id: "1", name: "dd-agent", kind: "datadog", tenant: "foo"},
+	}}
+	store := newIntegrationKeyStore(directory)
+	assert.NoError(t, store.refresh())
+
+	defaultAuthenticator.integrationKeys = store
+	defer func() { defaultAuthenticator.integrationKeys = nil }()
+
+	successesBefore := testutil.ToFloat64(integrationSuccessesTotal.WithLabelValues("foo", "dd-agent"))
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/push", nil)
+	req.Header.Set("Authorization", "Bearer key-foo")
+	identity, ok := GetTenantIdentityOr401(httptest.NewRecorder(), req, nil, false)
+	assert.True(t, ok)
+	assert.Equal(t, "foo", identity.TenantName)
+	assert.Equal(t, methodIntegrationKey, identity.method)
+	assert.Equal(t, "dd-agent", identity.integrationName)
+	assert.True(t, identity.HasScope(ScopeMetricsWrite))
+	assert.False(t, identity.HasScope(ScopeMetricsRead))
+	assert.Equal(t, successesBefore+1, testutil.ToFloat64(integrationSuccessesTotal.WithLabelValues("foo", "dd-agent")))
+
+	// DD API key.
+	req = httptest.NewRequest("POST", "http://localhost/api/v1/series?api_key=key-foo", nil)
+	assert.True(t, AuthenticateSpecificTenantByDDQueryParamWithScopeOr401(httptest.NewRecorder(), req, "foo", ScopeMetricsWrite))
+	w := httptest.NewRecorder()
+	assert.False(t, AuthenticateSpecificTenantByDDQueryParamWithScopeOr401(w, req, "bar", ScopeMetricsWrite))
+	assert.Equal(t, 403, w.Result().StatusCode)
+
+	// Unknown key: refreshed once (rate-limited), then rejected.
+	store.refreshLimit.lastStart = time.Time{}
+	fetches := directory.fetches
+	for i := 0; i < 2; i++ {
+		req = httptest.NewRequest("POST", "http://localhost/api/v1/push", nil)
+		req.Header.Set("Authorization", "Bearer key-bar")
+		w = httptest.NewRecorder()
+		_, ok = GetTenantIdentityOr401(w, req, nil, false)
+		assert.False(t, ok)
+		assert.Equal(t, 401, w.Result().StatusCode)
+	}
+	assert.Equal(t, fetches+1, atomic.LoadInt32(&directory.fetches))
+
+	// Integration deleted: its key is rejected after the next refresh.
+	delete(directory.keys, "key-foo")
+	assert.NoError(t, store.refresh())
+	req = httptest.NewRequest("POST", "http://localhost/api/v1/push", nil)
+	req.Header.Set("Authorization", "Bearer key-foo")
+	_, ok = GetTenantIdentityOr401(httptest.NewRecorder(), req, nil, false)
+	assert.False(t, ok)
+}
+
+func TestIntegrationKeyStore_ConcurrentUnknownKey(t *testing.T) {
+	directory := &fakeIntegrationDirectory{delay: 50 * time.Millisecond}
+	store := newIntegrationKeyStore(directory)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store.lookup(fmt.Sprintf("key-%d", i))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&directory.fetches))
+}
+
+func TestHasuraIntegrationDirectory(t *testing.T) {
+	queries := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case strings.Contains(string(body), "GetTenants"):
+			fmt.Fprint(w, `{"data": {"tenant": [{"id": "t1", "name": "default"}, {"id": "t2", "name": "prod"}]}}`)
+		case strings.Contains(string(body), "GetIntegrationsDump"):
+			fmt.Fprint(w, `{"data": {"integration": [
+				{"id": "i1", "tenant_id": "t1", "name": "dd", "key": "key-1", "kind": "datadog", "data": {"foo": "bar"}},
+				{"id": "i2", "tenant_id": "t1", "name": "nokey", "key": "", "kind": "k8s-metrics", "data": {}},
+				{"id": "i3", "tenant_id": "t2", "name": "logs", "key": "key-3", "kind": "k8s-logs", "data": {}},
+				{"id": "i4", "tenant_id": "t3", "name": "orphan", "key": "key-4", "kind": "k8s-logs", "data": {}}
+			]}}`)
+		default:
+			t.Errorf("unexpected query: %s", body)
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	directory := &hasuraIntegrationDirectory{graphql.NewGraphqlAccess(u, "")}
+
+	keys, err := directory.listIntegrationKeys()
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+	assert.Equal(t, &integrationKey{id: "i1", name: "dd", kind: "datadog", tenant: "default"}, keys[sha256.Sum256([]byte("key-1"))])
+	assert.Equal(t, "prod", keys[sha256.Sum256([]byte("key-3"))].tenant)
+	// One query for the tenants, one for all integrations.
+	assert.Equal(t, 2, queries)
+}
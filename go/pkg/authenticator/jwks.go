@@ -0,0 +1,352 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	json "github.com/json-iterator/go"
+	"github.com/opstrace/opstrace/go/pkg/filewatch"
+	log "github.com/sirupsen/logrus"
+)
+
+// Do not re-fetch the JWKS document more often than this when tokens with
+// unknown key IDs come in. Unknown key IDs are expected after a key rotation,
+// but can also be sent by anyone (the token has not been verified yet at this
+// point).
+const jwksMinRefreshInterval = 30 * time.Second
+
+// JWKS document, see https://tools.ietf.org/html/rfc7517#section-5
+type jwksDocument struct {
+	Keys []jwk `json:"keys"`
+}
+
+// A JSON Web Key, see https://tools.ietf.org/html/rfc7517#section-4. See
+// https://tools.ietf.org/html/rfc7518#section-6 for the RSA- and EC-specific
+// parameters, and https://tools.ietf.org/html/rfc8037#section-2 for OKP
+// (Ed25519).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+/*
+A set of public keys read from a JWKS document, which is either a local file or
+served via HTTP(S).
+
+The document is re-read periodically, and on demand when a token with an unknown
+key ID is presented (rate-limited). If fetching or parsing the document fails,
+the last known good key set stays in use.
+*/
+type jwksKeySource struct {
+	location   string
+	httpClient *http.Client
+	// Optional: called after the key set has been replaced.
+	onChange func()
+	// For refreshes triggered by unknown key IDs.
+	refreshLimit refreshLimiter
+	// Of the document the key set was read from.
+	digest filewatch.Digest
+
+	// Protects the fields below.
+	mu   sync.RWMutex
+	keys map[string]*verificationKey
+}
+
+func newJWKSKeySource(location string) *jwksKeySource {
+	return &jwksKeySource{
+		location: location,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		refreshLimit: refreshLimiter{minInterval: jwksMinRefreshInterval},
+		keys:         make(map[string]*verificationKey),
+	}
+}
+
+// Look up key by key ID. If the key ID is not known, refresh the key set
+// (rate-limited) and try again.
+func (js *jwksKeySource) lookup(kid string) (*verificationKey, bool) {
+	js.mu.RLock()
+	pkey, ok := js.keys[kid]
+	js.mu.RUnlock()
+
+	if ok {
+		return pkey, true
+	}
+
+	if !js.refreshLimit.reserve() {
+		return nil, false
+	}
+
+	log.Infof("JWKS: unknown kid %s, refresh key set", kid)
+	if err := js.update(); err != nil {
+		log.Errorf("JWKS: refresh failed, keep using last known key set: %s", err)
+	}
+
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	pkey, ok = js.keys[kid]
+	return pkey, ok
+}
+
+// Fetch and parse the JWKS document. Replace the key set only if that
+// succeeded, and the document changed (so that `onChange` is not called
+// needlessly).
+func (js *jwksKeySource) refresh() error {
+	js.refreshLimit.start()
+	return js.update()
+}
+
+// Like refresh(), for callers that reserved the refresh, see lookup().
+func (js *jwksKeySource) update() error {
+	data, err := js.fetch()
+	if err != nil {
+		return err
+	}
+
+	changed, err := js.digest.Apply(data, func(data []byte) error {
+		keys, err := parseJWKS(data)
+		if err != nil {
+			return err
+		}
+
+		js.mu.Lock()
+		js.keys = keys
+		js.mu.Unlock()
+
+		if js.onChange != nil {
+			js.onChange()
+		}
+
+		log.Infof("JWKS: read %d key(s) from %s", len(keys), js.location)
+		return nil
+	})
+	if err == nil && !changed {
+		log.Debugf("JWKS: document at %s unchanged", js.location)
+	}
+	return err
+}
+
+func (js *jwksKeySource) refreshPeriodically(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := js.refresh(); err != nil {
+			log.Errorf("JWKS: periodic refresh failed, keep using last known key set: %s", err)
+		}
+	}
+}
+
+func (js *jwksKeySource) fetch() ([]byte, error) {
+	if !strings.HasPrefix(js.location, "http://") && !strings.HasPrefix(js.location, "https://") {
+		return ioutil.ReadFile(js.location)
+	}
+
+	resp, err := js.httpClient.Get(js.location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP response status code: %d", resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+/*
+Parse JWKS document. Return map of key ID to public key.
+
+Skip keys that are not meant for signature verification. Fail if any of the
+signature keys cannot be used, or if there is no usable key at all: a partially
+applied key set is more confusing than keeping the last known good one.
+*/
+func parseJWKS(data []byte) (map[string]*verificationKey, error) {
+	var doc jwksDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JWKS document: %s", err)
+	}
+
+	keys := make(map[string]*verificationKey)
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			log.Debugf("JWKS: skip key %s with use %s", k.Kid, k.Use)
+			continue
+		}
+
+		if k.Kid == "" {
+			return nil, fmt.Errorf("JWKS: key without kid")
+		}
+
+		vkey, err := verificationKeyFromJWK(k)
+		if err != nil {
+			return nil, fmt.Errorf("JWKS: key %s: %s", k.Kid, err)
+		}
+
+		keys[k.Kid] = vkey
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS: no signature verification key found")
+	}
+
+	return keys, nil
+}
+
+// Build verification key from JWK. If the JWK specifies an algorithm, require
+// it to match the algorithm derived from the key type.
+func verificationKeyFromJWK(k jwk) (*verificationKey, error) {
+	var pubkey interface{}
+	var err error
+
+	switch k.Kty {
+	case "RSA":
+		pubkey, err = rsaPubKeyFromJWK(k)
+	case "EC":
+		pubkey, err = ecdsaPubKeyFromJWK(k)
+	case "OKP":
+		pubkey, err = ed25519PubKeyFromJWK(k)
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	vkey, err := newVerificationKey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.Alg != "" && k.Alg != vkey.alg {
+		return nil, fmt.Errorf("alg %s does not match key type (expected %s)", k.Alg, vkey.alg)
+	}
+
+	return vkey, nil
+}
+
+func rsaPubKeyFromJWK(k jwk) (*rsa.PublicKey, error) {
+	nbytes, err := decodeBase64URLUint(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %s", err)
+	}
+
+	ebytes, err := decodeBase64URLUint(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %s", err)
+	}
+
+	e := new(big.Int).SetBytes(ebytes)
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("exponent too large")
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nbytes),
+		E: int(e.Int64()),
+	}, nil
+}
+
+func ecdsaPubKeyFromJWK(k jwk) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	default:
+		return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+	}
+
+	xbytes, err := decodeBase64URLUint(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x coordinate: %s", err)
+	}
+
+	ybytes, err := decodeBase64URLUint(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid y coordinate: %s", err)
+	}
+
+	pubkey := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(xbytes),
+		Y:     new(big.Int).SetBytes(ybytes),
+	}
+
+	if !curve.IsOnCurve(pubkey.X, pubkey.Y) {
+		return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+	}
+
+	return pubkey, nil
+}
+
+func ed25519PubKeyFromJWK(k jwk) (ed25519.PublicKey, error) {
+	if k.Crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+	}
+
+	xbytes, err := decodeBase64URLUint(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %s", err)
+	}
+
+	if len(xbytes) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key size: %d", len(xbytes))
+	}
+
+	return ed25519.PublicKey(xbytes), nil
+}
+
+// JWK integers are base64url-encoded big-endian byte sequences, without
+// padding. Tolerate padding anyway.
+func decodeBase64URLUint(s string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return b, nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func genRSAKeyOrFail(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("key generation failed: %v", err)
+	}
+	return key
+}
+
+func signRS256OrFail(t *testing.T, key *rsa.PrivateKey, kid string, subject string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &jwt.StandardClaims{
+		Subject:   subject,
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("signing failed: %v", err)
+	}
+	return signed
+}
+
+func jwksDocForRSAKey(kid string, pubkey *rsa.PublicKey) string {
+	n := base64.RawURLEncoding.EncodeToString(pubkey.N.Bytes())
+	e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pubkey.E)).Bytes())
+	return fmt.Sprintf(`{"keys": [{"kty": "RSA", "use": "sig", "kid": "%s", "n": "%s", "e": "%s"}]}`, kid, n, e)
+}
+
+func TestJWKS_VerifyAndRotate(t *testing.T) {
+	key1 := genRSAKeyOrFail(t)
+	key2 := genRSAKeyOrFail(t)
+
+	// Serve key 1 first; later, after a "rotation", key 2.
+	jwksDoc := jwksDocForRSAKey("key1", &key1.PublicKey)
+	fetchCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetchCount++
+		fmt.Fprint(w, jwksDoc)
+	}))
+	defer server.Close()
+
+	js := newJWKSKeySource(server.URL)
+	assert.NoError(t, js.refresh())
+
+	defaultAuthenticator.jwks = js
+	defer func() { defaultAuthenticator.jwks = nil }()
+
+	tenantName, err := defaultAuthenticator.validateAuthTokenGetTenantName(signRS256OrFail(t, key1, "key1", "tenant-foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", tenantName)
+
+	// Rotate key on the server side. A token with the new kid comes in before
+	// the minimum refresh interval has passed: expect rejection, and no
+	// additional fetch.
+	jwksDoc = jwksDocForRSAKey("key2", &key2.PublicKey)
+	token2 := signRS256OrFail(t, key2, "key2", "tenant-foo")
+	_, err = defaultAuthenticator.validateAuthTokenGetTenantName(token2)
+	assert.Error(t, err)
+	assert.Equal(t, 1, fetchCount)
+
+	// Pretend that the last fetch happened a while ago. Now, the unknown kid
+	// is expected to trigger a refresh.
+	js.refreshLimit.lastStart = time.Now().Add(-2 * jwksMinRefreshInterval)
+	tenantName, err = defaultAuthenticator.validateAuthTokenGetTenantName(token2)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", tenantName)
+	assert.Equal(t, 2, fetchCount)
+}
+
+func TestJWKS_ConcurrentUnknownKid(t *testing.T) {
+	key := genRSAKeyOrFail(t)
+
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, jwksDocForRSAKey("key1", &key.PublicKey))
+	}))
+	defer server.Close()
+
+	js := newJWKSKeySource(server.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			js.lookup("unknown")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+}
+
+func TestJWKS_KeepLastKnownGood(t *testing.T) {
+	key := genRSAKeyOrFail(t)
+
+	healthy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, jwksDocForRSAKey("key1", &key.PublicKey))
+	}))
+	defer server.Close()
+
+	js := newJWKSKeySource(server.URL)
+	assert.NoError(t, js.refresh())
+
+	healthy = false
+	assert.Error(t, js.refresh())
+
+	_, ok := js.lookup("key1")
+	assert.True(t, ok)
+}
+
+func TestJWKS_Parse(t *testing.T) {
+	_, err := parseJWKS([]byte(`{"keys": []}`))
+	assert.Error(t, err)
+
+	_, err = parseJWKS([]byte(`{"keys": [{"kty": "RSA", "n": "AQAB", "e": "AQAB"}]}`))
+	assert.Error(t, err, "expected error for key without kid")
+
+	// Encryption keys are skipped.
+	_, err = parseJWKS([]byte(`{"keys": [{"kty": "RSA", "use": "enc", "kid": "x", "n": "AQAB", "e": "AQAB"}]}`))
+	assert.Error(t, err)
+
+	keys, err := parseJWKS([]byte(`{"keys": [{"kty": "RSA", "kid": "x", "n": "AQAB", "e": "AQAB"}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "RS256", keys["x"].alg)
+	assert.Equal(t, 65537, keys["x"].key.(*rsa.PublicKey).E)
+}
+
+func TestJWKS_OnChangeOnlyWhenChanged(t *testing.T) {
+	key1 := genRSAKeyOrFail(t)
+	key2 := genRSAKeyOrFail(t)
+
+	jwksDoc := jwksDocForRSAKey("key1", &key1.PublicKey)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, jwksDoc)
+	}))
+	defer server.Close()
+
+	changes := 0
+	js := newJWKSKeySource(server.URL)
+	js.onChange = func() { changes++ }
+
+	assert.NoError(t, js.refresh())
+	assert.Equal(t, 1, changes)
+
+	// Same document: the key set (and e.g. the token cache) is left alone.
+	assert.NoError(t, js.refresh())
+	assert.Equal(t, 1, changes)
+
+	jwksDoc = jwksDocForRSAKey("key2", &key2.PublicKey)
+	assert.NoError(t, js.refresh())
+	assert.Equal(t, 2, changes)
+	_, ok := js.lookup("key2")
+	assert.True(t, ok)
+}
@@ -17,6 +17,7 @@ package authenticator
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	log "github.com/sirupsen/logrus"
@@ -27,19 +28,110 @@ The error message corresponding to the error returned in the 2-tuple is meant
 to be exposed in an HTTP response. That is, it must not expose too much detail
 (trade-off between debuggability / devX and security).
 */
-func validateAuthTokenGetTenantName(authTokenUnverified string) (string, error) {
-	// Perform RFC 7519-compliant JWT verification (standard claims, such as
-	// exp and nbf, but also cryptographic signature verification). Expect a
-	// set of standard claims to be present (`sub`, `iss` and the likes), and
-	// custom claims to not be present.
-	tokenstruct, veriferr := jwt.ParseWithClaims(
-		authTokenUnverified, &jwt.StandardClaims{}, keyLookupCallback)
+func (a *Authenticator) validateAuthTokenGetTenantName(authTokenUnverified string) (string, error) {
+	identity, err := a.validateAuthToken(authTokenUnverified)
+	if err != nil {
+		return "", err
+	}
+	return identity.TenantName, nil
+}
+
+/*
+ValidateAuthToken verifies a tenant API authentication token (as presented in
+an HTTP request), and returns the tenant identity encoded in it. The reason for
+a verification failure is logged, not returned.
+*/
+func (a *Authenticator) ValidateAuthToken(authToken string) (*TenantIdentity, error) {
+	return a.validateAuthToken(authToken)
+}
+
+/*
+Verify authentication token, and return the tenant identity (tenant name and
+granted scopes) encoded in it.
+
+The error message corresponding to the error returned in the 2-tuple is meant
+to be exposed in an HTTP response, see above.
+*/
+func (a *Authenticator) validateAuthToken(authTokenUnverified string) (*TenantIdentity, error) {
+	// Signature verification is expensive. Tokens that have been verified
+	// before (with the current key set) are served from the cache.
+	var claims *tokenClaims
+	cached := false
+	if a.tokenCache != nil {
+		claims, cached = a.tokenCache.get(authTokenUnverified)
+	}
+
+	if !cached {
+		var generation uint64
+		if a.tokenCache != nil {
+			generation = a.tokenCache.currentGeneration()
+		}
+
+		var err error
+		claims, err = a.verifyAuthToken(authTokenUnverified)
+		if err != nil {
+			return nil, err
+		}
+
+		if a.tokenCache != nil {
+			a.tokenCache.add(authTokenUnverified, claims, generation)
+		}
+	}
+
+	// Reject tokens that have been revoked (by `jti`, or by subject and
+	// issuing time). Done for cached tokens, too: the revocation list may
+	// have changed since the token was verified.
+	if a.revocationList != nil && a.revocationList.isRevoked(claims) {
+		return nil, &authFailure{reason: reasonRevoked, msg: "bad authentication token"}
+	}
+
+	// Multi-tenant tokens: the tenant is selected per request. A tenant
+	// named in `sub` is one of the allowed tenants, too.
+	var tenantNameFromToken string
+	var tenants []string
+	if len(claims.Tenants) > 0 {
+		tenants = append([]string{}, claims.Tenants...)
+		if strings.HasPrefix(claims.Subject, "tenant-") {
+			tenants = append(tenants, strings.TrimPrefix(claims.Subject, "tenant-"))
+		}
+	} else {
+		tenantNameFromToken = strings.TrimPrefix(claims.Subject, "tenant-")
+	}
+	// log.Debugf("authenticated for tenant: %s", tenantNameFromToken)
+
+	return &TenantIdentity{
+		TenantName: tenantNameFromToken,
+		Scopes:     parseScopeClaim(claims.Scope),
+		tenants:    tenants,
+		method:     methodToken,
+		subject:    claims.Subject,
+		keyID:      claims.keyID,
+		tokenID:    claims.Id,
+		expiresAt:  claims.ExpiresAt,
+	}, nil
+}
+
+/*
+Cryptographically verify authentication token, and check its claims. Return
+the claims.
+
+The error message corresponding to the error returned in the 2-tuple is meant
+to be exposed in an HTTP response, see above.
+*/
+func (a *Authenticator) verifyAuthToken(authTokenUnverified string) (*tokenClaims, error) {
+	// Perform RFC 7519-compliant JWT verification (cryptographic signature
+	// verification here, standard claims such as exp and nbf below). Expect
+	// a set of standard claims to be present (`sub`, `iss` and the likes).
+	// The custom claims considered are `scope` and `tenants`.
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	tokenstruct, veriferr := parser.ParseWithClaims(
+		authTokenUnverified, &tokenClaims{}, a.keyLookupCallback)
 
 	if veriferr != nil {
 		log.Infof("jwt verification failed: %s", veriferr)
 		// See below: must exit here, because `tokenstruct.Valid` may not
 		// be accessible. See #282.
-		return "", fmt.Errorf("bad authentication token")
+		return nil, &authFailure{reason: jwtFailureReason(veriferr), msg: "bad authentication token"}
 	}
 
 	// The `err` check above should be enough, but the documentation for
@@ -49,75 +141,106 @@ func validateAuthTokenGetTenantName(authTokenUnverified string) (string, error)
 	// why there are two checks and exit routes now.
 	if !(tokenstruct.Valid) {
 		log.Infof("jwt verification failed: %s", veriferr)
-		return "", fmt.Errorf("bad authentication token")
+		return nil, &authFailure{reason: reasonInvalidToken, msg: "bad authentication token"}
 	}
 
 	// https://godoc.org/github.com/dgrijalva/jwt-go#StandardClaims
-	claims := tokenstruct.Claims.(*jwt.StandardClaims)
+	claims := tokenstruct.Claims.(*tokenClaims)
 	// log.Infof("claims: %+v", claims)
 
+	// Time claims, with clock skew leeway, and token lifetime policy.
+	if reason := a.checkTimeClaims(&claims.StandardClaims, time.Now()); reason != "" {
+		log.Infof("jwt verification failed: %s (sub: %s, exp: %d, nbf: %d, iat: %d)",
+			reason, claims.Subject, claims.ExpiresAt, claims.NotBefore, claims.IssuedAt)
+		return nil, &authFailure{reason: reason, msg: "bad authentication token"}
+	}
+
 	// Custom convention: encode Opstrace tenant name in subject, expect
-	// a specific prefix.
-	if !strings.HasPrefix(claims.Subject, "tenant-") {
+	// a specific prefix. Multi-tenant tokens list the tenants in the
+	// `tenants` claim instead.
+	if len(claims.Tenants) > 0 {
+		if !validTenantsClaim(claims.Tenants) {
+			log.Infof("invalid tenants claim: %v (sub: %s)", claims.Tenants, claims.Subject)
+			return nil, &authFailure{reason: reasonInvalidSubject, msg: "bad authentication token"}
+		}
+	} else if !strings.HasPrefix(claims.Subject, "tenant-") {
 		log.Infof("invalid subject (tenant- prefix missing): %s", claims.Subject)
-		return "", fmt.Errorf("bad authentication token")
+		return nil, &authFailure{reason: reasonInvalidSubject, msg: "bad authentication token"}
 	}
 
-	// Another part of custom spec/convection: we should also inspect the `aud`
-	// claim: should be an Opstrace cluster name, and match the cluster name of
-	// the Opstrace cluster that this authenticator runs in. Let's do this in
-	// the future. For now, technically, the cryptographic verification already
-	// confirms that (if key pairs are not shared between Opstrace clusters).
+	// Another part of custom spec/convention: the `aud` claim is expected to
+	// be the name of the Opstrace cluster that this authenticator runs in,
+	// and the `iss` claim is expected to identify the token issuer. Check
+	// these if configured.
+	if !a.checkAudienceAndIssuer(&claims.StandardClaims) {
+		return nil, &authFailure{reason: reasonClaimMismatch, msg: "bad authentication token"}
+	}
 
-	tenantNameFromToken := strings.TrimPrefix(claims.Subject, "tenant-")
-	// log.Debugf("authenticated for tenant: %s", tenantNameFromToken)
+	if kid, ok := tokenstruct.Header["kid"].(string); ok {
+		claims.keyID = kid
+	}
 
-	return tenantNameFromToken, nil
+	return claims, nil
 }
 
 /*
-First return value is of type `*rsa.PublicKey`. However, need to specify as
-type `interface{}` for compat with jwt lib.
+First return value is of type `*rsa.PublicKey`, `*ecdsa.PublicKey` or
+`ed25519.PublicKey`. However, need to specify as type `interface{}` for compat
+with jwt lib.
 */
-func keyLookupCallback(unveriftoken *jwt.Token) (interface{}, error) {
+func (a *Authenticator) keyLookupCallback(unveriftoken *jwt.Token) (interface{}, error) {
 	// Receives the parsed, but unverified JWT payload. Can inspect claims to
-	// decide which public key for verification to use. Use this to enforce the
-	// RS256 signing method for now.
+	// decide which public key for verification to use.
 
 	unverfClaimsStr := fmt.Sprintf("%v", unveriftoken.Claims)
 	kid, kidset := unveriftoken.Header["kid"]
 
-	if unveriftoken.Header["alg"] != "RS256" {
-		return nil, fmt.Errorf(
-			"jwt verif: invalid alg: %s (unverif. claims: %v)",
-			unveriftoken.Header["alg"],
-			unverfClaimsStr,
-		)
-	}
+	var vkey *verificationKey
 
 	if kidset {
 		kidStr := fmt.Sprintf("%s", kid)
-		pkey, keyknown := authtokenVerificationPubKeys[kidStr]
-
-		if keyknown {
-			// A public key with the key ID as referred to by this unverified
-			// authentication token is configured for the authenticator. That's
-			// the happy path. Use that key to cryptographically verify the
-			// token.
-			return pkey, nil
-		} else {
+		pkey, keyknown := a.lookupPubKey(kidStr)
+
+		// Key IDs not in the static key set may be found in the JWKS
+		// document (which may trigger a refresh of that document).
+		if !keyknown && a.jwks != nil {
+			pkey, keyknown = a.jwks.lookup(kidStr)
+		}
+
+		if !keyknown {
 			// This could be an accident or a malicious token.
-			return nil, fmt.Errorf("jwt verif: unknown kid: %s", kidStr)
+			return nil, &authFailure{reason: reasonUnknownKid, msg: fmt.Sprintf("jwt verif: unknown kid: %s", kidStr)}
 		}
+
+		// A public key with the key ID as referred to by this unverified
+		// authentication token is configured for the authenticator. That's
+		// the happy path. Use that key to cryptographically verify the token
+		// (see below).
+		vkey = pkey
 	} else {
-		if authtokenVerificationPubKeyFallback == nil {
-			return nil, fmt.Errorf(
+		if a.pubKeyFallback == nil {
+			return nil, &authFailure{reason: reasonNoKid, msg: fmt.Sprintf(
 				"kid not set in auth token, fallback key not set, consider token invalid (unverif. claims: %v)",
 				unverfClaimsStr,
-			)
+			)}
 		}
 
 		log.Debug("kid not set in auth token, use fallback key (is configured)")
-		return authtokenVerificationPubKeyFallback, nil
+		vkey = a.pubKeyFallback
+	}
+
+	// Each key is bound to one signing algorithm. Require the token to have
+	// been signed with precisely that algorithm: do not let the (unverified)
+	// token decide which algorithm to use for a given key. Check both the
+	// header value and the signing method that jwt-go derived from it.
+	if unveriftoken.Header["alg"] != vkey.alg || unveriftoken.Method.Alg() != vkey.alg {
+		return nil, &authFailure{reason: reasonBadAlg, msg: fmt.Sprintf(
+			"jwt verif: invalid alg: %s, expected: %s (unverif. claims: %v)",
+			unveriftoken.Header["alg"],
+			vkey.alg,
+			unverfClaimsStr,
+		)}
 	}
+
+	return vkey.key, nil
 }
@@ -0,0 +1,140 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func signOrFail(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, subject string) string {
+	token := jwt.NewWithClaims(method, &jwt.StandardClaims{
+		Subject:   subject,
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("signing failed: %v", err)
+	}
+	return signed
+}
+
+// Serialize public key into PEM text and deserialize it again, as done when
+// reading the key set from the environment.
+func verificationKeyFromPubKeyOrFail(t *testing.T, pubkey interface{}) *verificationKey {
+	der, err := x509.MarshalPKIXPublicKey(pubkey)
+	if err != nil {
+		t.Fatalf("marshalling public key failed: %v", err)
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	vkey, err := deserializePubKeyFromPEMBytes(pemBytes)
+	if err != nil {
+		t.Fatalf("deserializing public key failed: %v", err)
+	}
+	return vkey
+}
+
+// Install `keys` as the key set for the duration of the test.
+func useKeySet(t *testing.T, keys map[string]*verificationKey) {
+	prev := defaultAuthenticator.pubKeys
+	defaultAuthenticator.setPubKeys(keys)
+	t.Cleanup(func() { defaultAuthenticator.setPubKeys(prev) })
+}
+
+func TestValidateAuthToken_ES256(t *testing.T) {
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	vkey := verificationKeyFromPubKeyOrFail(t, &privkey.PublicKey)
+	assert.Equal(t, "ES256", vkey.alg)
+	useKeySet(t, map[string]*verificationKey{"eckey": vkey})
+
+	tenantName, err := defaultAuthenticator.validateAuthTokenGetTenantName(
+		signOrFail(t, jwt.SigningMethodES256, privkey, "eckey", "tenant-foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", tenantName)
+}
+
+func TestValidateAuthToken_ES384(t *testing.T) {
+	privkey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+
+	vkey := verificationKeyFromPubKeyOrFail(t, &privkey.PublicKey)
+	assert.Equal(t, "ES384", vkey.alg)
+	useKeySet(t, map[string]*verificationKey{"eckey": vkey})
+
+	tenantName, err := defaultAuthenticator.validateAuthTokenGetTenantName(
+		signOrFail(t, jwt.SigningMethodES384, privkey, "eckey", "tenant-foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", tenantName)
+}
+
+func TestValidateAuthToken_EdDSA(t *testing.T) {
+	pubkey, privkey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	vkey := verificationKeyFromPubKeyOrFail(t, pubkey)
+	assert.Equal(t, "EdDSA", vkey.alg)
+	useKeySet(t, map[string]*verificationKey{"edkey": vkey})
+
+	tenantName, err := defaultAuthenticator.validateAuthTokenGetTenantName(
+		signOrFail(t, SigningMethodEdDSA, privkey, "edkey", "tenant-foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", tenantName)
+
+	// Signed with a different key.
+	_, otherPrivkey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	_, err = defaultAuthenticator.validateAuthTokenGetTenantName(
+		signOrFail(t, SigningMethodEdDSA, otherPrivkey, "edkey", "tenant-foo"))
+	assert.Error(t, err)
+}
+
+func TestValidateAuthToken_AlgSwitch(t *testing.T) {
+	rsakey := genRSAKeyOrFail(t)
+	vkey := verificationKeyFromPubKeyOrFail(t, &rsakey.PublicKey)
+	useKeySet(t, map[string]*verificationKey{"rsakey": vkey})
+
+	// Classic algorithm confusion attack: use the RSA public key (PEM bytes,
+	// known to everyone) as HMAC secret.
+	der, err := x509.MarshalPKIXPublicKey(&rsakey.PublicKey)
+	assert.NoError(t, err)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	_, err = defaultAuthenticator.validateAuthTokenGetTenantName(
+		signOrFail(t, jwt.SigningMethodHS256, pemBytes, "rsakey", "tenant-foo"))
+	assert.Error(t, err)
+
+	// RS512 with the right key: still rejected, the key is bound to RS256.
+	_, err = defaultAuthenticator.validateAuthTokenGetTenantName(
+		signOrFail(t, jwt.SigningMethodRS512, rsakey, "rsakey", "tenant-foo"))
+	assert.Error(t, err)
+
+	tenantName, err := defaultAuthenticator.validateAuthTokenGetTenantName(
+		signOrFail(t, jwt.SigningMethodRS256, rsakey, "rsakey", "tenant-foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", tenantName)
+}
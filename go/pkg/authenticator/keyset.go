@@ -15,27 +15,25 @@
 package authenticator
 
 import (
-	"crypto/rsa"
 	// Disable warning for using sha1: a cryptographically secure hash is not
 	// needed here: an cluster admin generates and manages key pairs, and only
 	// trusted admin is supposed to add or remove keys from the key set.
 	//nolint: gosec
 	"crypto/sha1"
 	"encoding/hex"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	json "github.com/json-iterator/go"
 	log "github.com/sirupsen/logrus"
 )
 
-// Map for key set (the set of public keys considered for token verification).
-// Map key: key ID corresponding to public key.
-var authtokenVerificationPubKeys map[string]*rsa.PublicKey
-
-var authtokenVerificationPubKeyFallback *rsa.PublicKey
-
-func keyIDfromPEM(pemstring string) string {
+// KeyIDFromPEM calculates the key ID for a PEM-encoded public key, as expected
+// as map key in the key set JSON document (see README).
+func KeyIDFromPEM(pemstring string) string {
 	//nolint: gosec // a strong hash is not needed here, md5 would also do it.
 	h := sha1.New()
 	// Trim leading and trailing whitespace from PEM string, take underlying
@@ -46,86 +44,217 @@ func keyIDfromPEM(pemstring string) string {
 }
 
 /*
-Read set of public keys for authentication token verification from environment.
-If key deserialization fails or if no key is configured, log an error and exit
-the process with a non-zero exit code.
+Read authenticator configuration (most importantly, the set of public keys for
+authentication token verification) from environment, and use it for the
+package-level functions such as GetTenantNameOr401(). If reading the config
+fails, log an error and exit the process with a non-zero exit code.
+
+See NewAuthenticatorFromEnv() for a variant that does not crash.
 */
 func ReadConfigFromEnvOrCrash() {
-	legacyReadAuthTokenVerificationKeyFromEnvOrCrash()
-	readKeySetJSONFromEnvOrCrash()
-
-	// No verification key configured? Bad configuration state. Exit process
-	// non-zero.
-	if len(authtokenVerificationPubKeys) == 0 {
-		if authtokenVerificationPubKeyFallback == nil {
-			log.Error("authenticator: bad config: key set not configured and no fallback key set.")
-			os.Exit(1)
-		}
+	a, err := NewAuthenticatorFromEnv()
+	if err != nil {
+		log.Errorf("authenticator: bad config: %s", err)
+		os.Exit(1)
 	}
+	defaultAuthenticator = a
 }
 
 /*
-Read set of public keys from environment variable
-API_AUTHTOKEN_VERIFICATION_PUBKEY_SET.
+Build authenticator from environment variables:
 
-If key deserialization fails, log an error and exit the process with a non-zero
-exit code.
+	API_AUTHTOKEN_VERIFICATION_PUBKEY_SET (key set JSON document)
+	API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE, API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE_POLL_INTERVAL
+	API_AUTHTOKEN_VERIFICATION_PUBKEY (legacy: fallback key)
+	API_AUTHTOKEN_VERIFICATION_JWKS, API_AUTHTOKEN_VERIFICATION_JWKS_REFRESH_INTERVAL
+	API_AUTHTOKEN_EXPECTED_AUDIENCE, API_AUTHTOKEN_EXPECTED_ISSUER, API_AUTHTOKEN_AUD_ISS_CHECK_MODE
+	API_AUTHTOKEN_CLOCK_SKEW_LEEWAY, API_AUTHTOKEN_REQUIRE_EXP, API_AUTHTOKEN_MAX_LIFETIME
+	API_AUTHTOKEN_REVOCATION_LIST, API_AUTHTOKEN_REVOCATION_LIST_RELOAD_INTERVAL
+	API_AUTHTOKEN_CACHE_SIZE
+	API_OIDC_ISSUER, API_OIDC_CLIENT_ID, API_OIDC_USER_CACHE_TTL, API_OIDC_USER_TENANTS (see readOIDCConfigFromEnv())
+	API_AUTH_AUDIT_LOG_SAMPLE_RATE
+	API_AUTH_BRUTEFORCE_* (see readBruteForceConfigFromEnv())
+	API_AUTH_INTEGRATION_KEYS, API_AUTH_INTEGRATION_KEYS_REFRESH_INTERVAL
+	API_AUTH_TENANT_CHECK, API_AUTH_TENANT_CHECK_REFRESH_INTERVAL
 
-If the environment variable is empty or not set, use an empty key set.
+Return an error if any of the values is invalid, or if no verification key is
+configured at all. Upon success, background refresh of the key set file, of
+the JWKS document, of the revocation list, of the integration keys and of the
+tenant set (if configured) is started.
 */
-func readKeySetJSONFromEnvOrCrash() {
-	// Initialize map (make it empty!)
-	authtokenVerificationPubKeys = make(map[string]*rsa.PublicKey)
+func NewAuthenticatorFromEnv() (*Authenticator, error) {
+	a := newAuthenticator()
 
-	data, present := os.LookupEnv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET")
+	if err := a.legacyReadAuthTokenVerificationKeyFromEnv(); err != nil {
+		return nil, err
+	}
+	if err := a.readKeySetFileConfigFromEnv(); err != nil {
+		return nil, err
+	}
+	if a.keySetFilePath == "" {
+		if err := a.readKeySetJSONFromEnv(); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.readJWKSConfigFromEnv(); err != nil {
+		return nil, err
+	}
+	if err := a.readClaimsConfigFromEnv(); err != nil {
+		return nil, err
+	}
+	if err := a.readTimeClaimsConfigFromEnv(); err != nil {
+		return nil, err
+	}
+	if err := a.readRevocationListConfigFromEnv(); err != nil {
+		return nil, err
+	}
+	if err := a.readTokenCacheConfigFromEnv(); err != nil {
+		return nil, err
+	}
+	if err := a.readOIDCConfigFromEnv(); err != nil {
+		return nil, err
+	}
+	if err := a.readAuditLogConfigFromEnv(); err != nil {
+		return nil, err
+	}
+	if err := a.readBruteForceConfigFromEnv(); err != nil {
+		return nil, err
+	}
+	if err := a.readIntegrationKeysConfigFromEnv(); err != nil {
+		return nil, err
+	}
+	if err := a.readTenantCheckConfigFromEnv(); err != nil {
+		return nil, err
+	}
 
-	if !present {
-		log.Errorf("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET is not set.")
-		return
+	// No verification key configured? Bad configuration state. (OIDC ID
+	// tokens alone do not do: they are meant for humans querying data.)
+	if len(a.pubKeys) == 0 && a.jwks == nil && a.pubKeyFallback == nil {
+		return nil, fmt.Errorf("key set not configured and no fallback key set")
 	}
 
-	if data == "" {
-		log.Errorf("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET is empty.")
-		return
+	a.startBackgroundRefresh()
+	return a, nil
+}
+
+/*
+Build authenticator using the key set read from the file at `path`. The file
+is expected to contain a key set JSON document, in the same format as the
+value of API_AUTHTOKEN_VERIFICATION_PUBKEY_SET.
+
+The file is read once: the key set is static, later changes to the file are
+not picked up (unlike with API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE, see
+NewAuthenticatorFromEnv()). Meant for one-shot use, e.g. by command line tools.
+*/
+func NewAuthenticatorFromFile(path string) (*Authenticator, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key set file failed: %s", err)
 	}
 
-	log.Infof("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET value: %s", data)
+	keys, err := parseKeySetJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAuthenticatorFromVerificationKeys(keys)
+}
+
+/*
+Build authenticator from a map of key ID to PEM-encoded public key. The key IDs
+must match the IDs calculated from the keys (see README).
+*/
+func NewAuthenticatorFromKeys(keys map[string]string) (*Authenticator, error) {
+	vkeys, err := verificationKeysFromPEMs(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAuthenticatorFromVerificationKeys(vkeys)
+}
+
+func newAuthenticatorFromVerificationKeys(keys map[string]*verificationKey) (*Authenticator, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("key set is empty")
+	}
+
+	a := newAuthenticator()
+	a.pubKeys = keys
+	return a, nil
+}
 
+// Parse key set JSON document: a map of key ID to PEM-encoded public key.
+func parseKeySetJSON(data []byte) (map[string]*verificationKey, error) {
 	var keys map[string]string
-	jerr := json.Unmarshal([]byte(data), &keys)
-	if jerr != nil {
-		log.Errorf("error while JSON-parsing API_AUTHTOKEN_VERIFICATION_PUBKEY_SET: %s", jerr)
-		os.Exit(1)
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("error while JSON-parsing key set: %s", err)
 	}
 
+	return verificationKeysFromPEMs(keys)
+}
+
+func verificationKeysFromPEMs(keys map[string]string) (map[string]*verificationKey, error) {
+	vkeys := make(map[string]*verificationKey)
+
 	for kidFromConfig, pemstring := range keys {
 		log.Infof("parse PEM bytes for key with ID %s", kidFromConfig)
 		// We're interested in processing the (PEM) bytes underneath the string
 		// value.
-		pubkey, err := deserializeRSAPubKeyFromPEMBytes([]byte(pemstring))
+		pubkey, err := deserializePubKeyFromPEMBytes([]byte(pemstring))
 		if err != nil {
-			log.Errorf("%s", err)
-			os.Exit(1)
+			return nil, err
 		}
 
-		kidFromKey := keyIDfromPEM(pemstring)
+		kidFromKey := KeyIDFromPEM(pemstring)
 		log.Infof("calculated key ID from PEM data: %s", kidFromKey)
 		if kidFromKey != kidFromConfig {
-			log.Errorf("key ID from config (%s) does not match key ID calculated from key (%s)", kidFromConfig, kidFromKey)
-			os.Exit(1)
+			return nil, fmt.Errorf("key ID from config (%s) does not match key ID calculated from key (%s)", kidFromConfig, kidFromKey)
 		}
 		log.Infof("key ID confirmed")
 
-		log.Infof(
-			"Parsed RSA public key. Modulus size: %d bits",
-			pubkey.Size()*8)
+		log.Infof("Parsed public key, bound to signing algorithm %s", pubkey.alg)
+		vkeys[kidFromConfig] = pubkey
+	}
+
+	return vkeys, nil
+}
+
+/*
+Read set of public keys from environment variable
+API_AUTHTOKEN_VERIFICATION_PUBKEY_SET.
+
+Return an error if key deserialization fails.
+
+If the environment variable is empty or not set, use an empty key set.
+*/
+func (a *Authenticator) readKeySetJSONFromEnv() error {
+	// Initialize map (make it empty!)
+	a.pubKeys = make(map[string]*verificationKey)
 
-		// Store in global authenticator key set.
-		authtokenVerificationPubKeys[kidFromConfig] = pubkey
+	data, present := os.LookupEnv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET")
+
+	if !present {
+		log.Errorf("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET is not set.")
+		return nil
 	}
+
+	if data == "" {
+		log.Errorf("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET is empty.")
+		return nil
+	}
+
+	log.Infof("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET value: %s", data)
+
+	keys, err := parseKeySetJSON([]byte(data))
+	if err != nil {
+		return fmt.Errorf("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET: %s", err)
+	}
+
+	a.pubKeys = keys
+	return nil
 }
 
-func legacyReadAuthTokenVerificationKeyFromEnvOrCrash() {
+func (a *Authenticator) legacyReadAuthTokenVerificationKeyFromEnv() error {
 	// Upgrade consideration: support for one pubkey -> support for multiple
 	// pubkeys: legacy auth tokens don't encode a key id. Read legacy env var,
 	// do not fail if not set. If set: store key as fallback, for tokens that
@@ -135,26 +264,78 @@ func legacyReadAuthTokenVerificationKeyFromEnvOrCrash() {
 
 	if !present {
 		log.Infof("API_AUTHTOKEN_VERIFICATION_PUBKEY is not set, don't use fallback key")
-		return
+		return nil
 	}
 
 	if data == "" {
 		log.Infof("API_AUTHTOKEN_VERIFICATION_PUBKEY is empty, don't use fallback key")
-		return
+		return nil
 	}
 
 	log.Infof("API_AUTHTOKEN_VERIFICATION_PUBKEY value: %s", data)
 
 	// `os.LookupEnv` returns a string. We're interested in processing the
 	// bytes underneath it.
-	pubkey, err := deserializeRSAPubKeyFromPEMBytes([]byte(data))
+	pubkey, err := deserializePubKeyFromPEMBytes([]byte(data))
 	if err != nil {
-		// This is a permanent configuration error, crash the process.
-		log.Errorf("%s", err)
-		os.Exit(1)
+		// This is a permanent configuration error.
+		return fmt.Errorf("API_AUTHTOKEN_VERIFICATION_PUBKEY: %s", err)
 	}
 
-	// Set module global for subsequent consumption by authenticator logic.
-	authtokenVerificationPubKeyFallback = pubkey
-	log.Infof("read RSA public key from legacy env var API_AUTHTOKEN_VERIFICATION_PUBKEY, using as fallback key")
+	a.pubKeyFallback = pubkey
+	log.Infof("read public key from legacy env var API_AUTHTOKEN_VERIFICATION_PUBKEY, using as fallback key")
+	return nil
+}
+
+/*
+Read location of a JWKS document from environment variable
+API_AUTHTOKEN_VERIFICATION_JWKS. This is either a path to a local file or an
+HTTP(S) URL. Do not use a JWKS document if the variable is not set or empty.
+
+The document is re-read every API_AUTHTOKEN_VERIFICATION_JWKS_REFRESH_INTERVAL
+(Go duration string, default: 5m).
+
+Return an error if the document cannot be read or parsed now. Later refresh
+errors are not fatal: the last known good key set stays in use.
+*/
+func (a *Authenticator) readJWKSConfigFromEnv() error {
+	a.jwks = nil
+
+	location := os.Getenv("API_AUTHTOKEN_VERIFICATION_JWKS")
+	if location == "" {
+		log.Infof("API_AUTHTOKEN_VERIFICATION_JWKS is not set, don't use JWKS")
+		return nil
+	}
+
+	interval, err := durationFromEnv("API_AUTHTOKEN_VERIFICATION_JWKS_REFRESH_INTERVAL", 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("API_AUTHTOKEN_VERIFICATION_JWKS value: %s (refresh interval: %s)", location, interval)
+
+	js := newJWKSKeySource(location)
+	js.onChange = a.onKeySetChange
+	if err := js.refresh(); err != nil {
+		return fmt.Errorf("reading JWKS document failed: %s", err)
+	}
+
+	a.jwks = js
+	a.jwksRefreshInterval = interval
+	return nil
+}
+
+// Read positive Go duration string from environment variable `name`. Return
+// `defaultValue` if the variable is not set or empty.
+func durationFromEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return defaultValue, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, s)
+	}
+	return d, nil
 }
@@ -15,7 +15,9 @@
 package authenticator
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	log "github.com/sirupsen/logrus"
@@ -25,23 +27,21 @@ import (
 func TestKeysetFromEnv_TwoKeys(t *testing.T) {
 	os.Setenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET", TestKeysetEnvValTwoPubkeys)
 
-	log.Infof("keyset map:\n%v", authtokenVerificationPubKeys)
-	log.Infof("fallback key:\n%v", authtokenVerificationPubKeyFallback)
-
+	a := &Authenticator{}
 	assert.Empty(
 		t,
-		authtokenVerificationPubKeys,
-		"map authtokenVerificationPubKeys expected to be empty",
+		a.pubKeys,
+		"map pubKeys expected to be empty",
 	)
-	readKeySetJSONFromEnvOrCrash()
+	assert.NoError(t, a.readKeySetJSONFromEnv())
 
-	log.Infof("keyset map:\n%v", authtokenVerificationPubKeys)
-	log.Infof("fallback key:\n%v", authtokenVerificationPubKeyFallback)
+	log.Infof("keyset map:\n%v", a.pubKeys)
+	log.Infof("fallback key:\n%v", a.pubKeyFallback)
 
 	assert.NotEmpty(
 		t,
-		authtokenVerificationPubKeys,
-		"map authtokenVerificationPubKeys expected to not be empty",
+		a.pubKeys,
+		"map pubKeys expected to not be empty",
 	)
 }
 
@@ -52,6 +52,65 @@ func TestKeysetFromEnv_EmtpySetButFallback(t *testing.T) {
 	// This is now expected to _not_ crash, becuse a fallback key is
 	// configured.
 	ReadConfigFromEnvOrCrash()
-	log.Infof("keyset map:\n%v", authtokenVerificationPubKeys)
-	log.Infof("fallback key:\n%v", authtokenVerificationPubKeyFallback)
+	log.Infof("keyset map:\n%v", defaultAuthenticator.pubKeys)
+	log.Infof("fallback key:\n%v", defaultAuthenticator.pubKeyFallback)
+}
+
+func TestNewAuthenticatorFromEnv_Errors(t *testing.T) {
+	defer os.Unsetenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET")
+	defer os.Unsetenv("API_AUTHTOKEN_VERIFICATION_PUBKEY")
+
+	// No key at all.
+	os.Setenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET", "")
+	os.Setenv("API_AUTHTOKEN_VERIFICATION_PUBKEY", "")
+	_, err := NewAuthenticatorFromEnv()
+	assert.Error(t, err)
+
+	// Key set is not valid JSON: expect an error instead of a crash.
+	os.Setenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET", "{")
+	_, err = NewAuthenticatorFromEnv()
+	assert.Error(t, err)
+}
+
+func TestNewAuthenticatorFromKeys(t *testing.T) {
+	kid := KeyIDFromPEM(TestPubKey)
+	a, err := NewAuthenticatorFromKeys(map[string]string{kid: TestPubKey})
+	assert.NoError(t, err)
+	assert.Equal(t, "RS256", a.pubKeys[kid].alg)
+
+	// Key ID does not match key.
+	_, err = NewAuthenticatorFromKeys(map[string]string{"foo": TestPubKey})
+	assert.Error(t, err)
+
+	_, err = NewAuthenticatorFromKeys(map[string]string{})
+	assert.Error(t, err)
+}
+
+func TestNewAuthenticatorFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyset.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(TestKeysetEnvValTwoPubkeys), 0600))
+
+	a, err := NewAuthenticatorFromFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, a.pubKeys, 2)
+
+	_, err = NewAuthenticatorFromFile(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+// Two differently configured authenticators in one process.
+func TestAuthenticator_Independent(t *testing.T) {
+	key := genRSAKeyOrFail(t)
+	a1 := newAuthenticator()
+	a1.pubKeys["key1"] = &verificationKey{alg: "RS256", key: &key.PublicKey}
+	a2 := newAuthenticator()
+
+	token := signRS256OrFail(t, key, "key1", "tenant-foo")
+
+	tenantName, err := a1.validateAuthTokenGetTenantName(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", tenantName)
+
+	_, err = a2.validateAuthTokenGetTenantName(token)
+	assert.Error(t, err)
 }
@@ -0,0 +1,136 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var keySetReloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "authenticator",
+	Name:      "keyset_reloads_total",
+	Help:      "Attempts to reload the key set from the key set file (outcome: success, failure).",
+}, []string{"outcome"})
+
+var keySetKeys = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "authenticator",
+	Name:      "keyset_keys",
+	Help:      "Number of keys in the key set most recently read from the key set file.",
+})
+
+func init() {
+	prometheus.MustRegister(keySetReloadsTotal)
+	prometheus.MustRegister(keySetKeys)
+}
+
+/*
+Read path to a key set file from environment variable
+API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE. The file is expected to contain a
+key set JSON document (same format as API_AUTHTOKEN_VERIFICATION_PUBKEY_SET),
+and is meant to be mounted from a Kubernetes Secret.
+
+The file is checked for changes every
+API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE_POLL_INTERVAL (Go duration string,
+default: 30s), and upon SIGHUP.
+
+Return an error if the file cannot be read or validated now, or if
+API_AUTHTOKEN_VERIFICATION_PUBKEY_SET is set as well.
+*/
+func (a *Authenticator) readKeySetFileConfigFromEnv() error {
+	a.keySetFilePath = os.Getenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE")
+	if a.keySetFilePath == "" {
+		return nil
+	}
+
+	if os.Getenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET") != "" {
+		return fmt.Errorf("set either API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE or API_AUTHTOKEN_VERIFICATION_PUBKEY_SET, not both")
+	}
+
+	interval, err := durationFromEnv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE_POLL_INTERVAL", 30*time.Second)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE value: %s (poll interval: %s)", a.keySetFilePath, interval)
+
+	if err := a.reloadKeySetFile(); err != nil {
+		return fmt.Errorf("reading key set file failed: %s", err)
+	}
+
+	a.keySetFilePollInterval = interval
+	return nil
+}
+
+/*
+Re-read the key set file. If its contents changed (see filewatch.Digest),
+validate them and atomically replace the key set. Upon error, the current key
+set stays in place.
+*/
+func (a *Authenticator) reloadKeySetFile() error {
+	changed, err := a.keySetFileDigest.ApplyFile(a.keySetFilePath, func(data []byte) error {
+		keys, err := parseKeySetJSON(data)
+		if err != nil {
+			return err
+		}
+
+		if len(keys) == 0 {
+			return fmt.Errorf("key set is empty")
+		}
+
+		a.setPubKeys(keys)
+		keySetKeys.Set(float64(len(keys)))
+
+		log.Infof("read key set with %d key(s) from %s", len(keys), a.keySetFilePath)
+		return nil
+	})
+	if err == nil && !changed {
+		log.Debugf("key set file %s unchanged", a.keySetFilePath)
+	}
+	return err
+}
+
+// Reload the key set file periodically, and upon SIGHUP.
+func (a *Authenticator) watchKeySetFile(stop <-chan struct{}) {
+	ticker := time.NewTicker(a.keySetFilePollInterval)
+	defer ticker.Stop()
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-sighup:
+			log.Infof("SIGHUP: reload key set file %s", a.keySetFilePath)
+		}
+
+		if err := a.reloadKeySetFile(); err != nil {
+			keySetReloadsTotal.WithLabelValues("failure").Inc()
+			log.Errorf("key set file reload failed, keep using current key set: %s", err)
+			continue
+		}
+		keySetReloadsTotal.WithLabelValues("success").Inc()
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Write key set JSON document with the given key to `path`. Return key ID.
+func writeKeySetFileOrFail(t *testing.T, path string, pubkey *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pubkey)
+	if err != nil {
+		t.Fatalf("marshalling public key failed: %v", err)
+	}
+	pemstring := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	kid := KeyIDFromPEM(pemstring)
+
+	data, err := json.Marshal(map[string]string{kid: pemstring})
+	if err != nil {
+		t.Fatalf("marshalling key set failed: %v", err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("writing key set file failed: %v", err)
+	}
+	return kid
+}
+
+func TestKeySetFile_Reload(t *testing.T) {
+	key1 := genRSAKeyOrFail(t)
+	key2 := genRSAKeyOrFail(t)
+
+	path := filepath.Join(t.TempDir(), "keyset.json")
+	kid1 := writeKeySetFileOrFail(t, path, &key1.PublicKey)
+
+	os.Setenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE", path)
+	defer os.Unsetenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE")
+
+	a := newAuthenticator()
+	assert.NoError(t, a.readKeySetFileConfigFromEnv())
+
+	token1 := signRS256OrFail(t, key1, kid1, "tenant-foo")
+	_, err := a.validateAuthTokenGetTenantName(token1)
+	assert.NoError(t, err)
+
+	// Verify tokens while the key set is being swapped.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			_, _ = a.validateAuthTokenGetTenantName(token1)
+		}
+	}()
+
+	kid2 := writeKeySetFileOrFail(t, path, &key2.PublicKey)
+	assert.NoError(t, a.reloadKeySetFile())
+	wg.Wait()
+
+	_, err = a.validateAuthTokenGetTenantName(token1)
+	assert.Error(t, err, "key 1 expected to be gone after reload")
+
+	token2 := signRS256OrFail(t, key2, kid2, "tenant-foo")
+	_, err = a.validateAuthTokenGetTenantName(token2)
+	assert.NoError(t, err)
+
+	// Invalid key set: keep the current one in place.
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"foo": "bar"}`), 0600))
+	assert.Error(t, a.reloadKeySetFile())
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{}`), 0600))
+	assert.Error(t, a.reloadKeySetFile())
+
+	_, err = a.validateAuthTokenGetTenantName(token2)
+	assert.NoError(t, err)
+}
+
+func TestKeySetFile_Stop(t *testing.T) {
+	key1 := genRSAKeyOrFail(t)
+	key2 := genRSAKeyOrFail(t)
+
+	path := filepath.Join(t.TempDir(), "keyset.json")
+	writeKeySetFileOrFail(t, path, &key1.PublicKey)
+
+	os.Setenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE", path)
+	os.Setenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE_POLL_INTERVAL", "10ms")
+	defer os.Unsetenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE")
+	defer os.Unsetenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE_POLL_INTERVAL")
+
+	a, err := NewAuthenticatorFromEnv()
+	assert.NoError(t, err)
+
+	// Picked up by the watcher.
+	kid2 := writeKeySetFileOrFail(t, path, &key2.PublicKey)
+	token2 := signRS256OrFail(t, key2, kid2, "tenant-foo")
+	assert.Eventually(t, func() bool {
+		_, err := a.validateAuthTokenGetTenantName(token2)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	// Not anymore after Stop() (which may be called more than once).
+	a.Stop()
+	a.Stop()
+	time.Sleep(50 * time.Millisecond)
+	writeKeySetFileOrFail(t, path, &key1.PublicKey)
+	time.Sleep(50 * time.Millisecond)
+	_, err = a.validateAuthTokenGetTenantName(token2)
+	assert.NoError(t, err)
+}
+
+func TestKeySetFile_ConflictingConfig(t *testing.T) {
+	os.Setenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE", filepath.Join(t.TempDir(), "keyset.json"))
+	os.Setenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET", TestKeysetEnvValTwoPubkeys)
+	defer os.Unsetenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET_FILE")
+	defer os.Unsetenv("API_AUTHTOKEN_VERIFICATION_PUBKEY_SET")
+
+	_, err := NewAuthenticatorFromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+Multi-tenant tokens (e.g. for service accounts pushing data for several
+tenants) list the tenants they are valid for in the custom `tenants` claim:
+
+	{"sub": "service-foo", "tenants": ["default", "system"], ...}
+
+For such tokens the tenant is selected per request: it is the tenant expected
+by the proxy (if it serves a specific tenant), or the one requested via the
+X-Scope-OrgID header or the `{tenant}` URL path variable of the route. Tokens
+without `tenants` claim name their one tenant in `sub` (`tenant-<name>`).
+*/
+
+// Name of the mux route variable that can select the tenant for multi-tenant
+// tokens, as in `/tenants/{tenant}/...`.
+const TenantPathVariable = "tenant"
+
+// Require all entries of the `tenants` claim to be non-empty.
+func validTenantsClaim(tenants []string) bool {
+	for _, t := range tenants {
+		if t == "" {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Return the tenant requested by the client: the value of the X-Scope-OrgID
+header, or of the `{tenant}` URL path variable. Return an error if both are set
+and do not agree. Return an empty string if neither is set.
+*/
+func requestedTenantName(r *http.Request) (string, error) {
+	fromHeader := r.Header.Get(TestTenantHeader)
+	fromPath := mux.Vars(r)[TenantPathVariable]
+
+	if fromHeader != "" && fromPath != "" && fromHeader != fromPath {
+		return "", fmt.Errorf("conflicting tenant selection: %s header: %s, URL path: %s",
+			TestTenantHeader, fromHeader, fromPath)
+	}
+
+	if fromHeader != "" {
+		return fromHeader, nil
+	}
+	return fromPath, nil
+}
+
+// Tenants returns the tenants a multi-tenant token is valid for, and nil for
+// single-tenant identities.
+func (ti *TenantIdentity) Tenants() []string {
+	return ti.tenants
+}
+
+// Return true if the (multi-tenant) identity is valid for tenant `name`.
+func (ti *TenantIdentity) allowsTenant(name string) bool {
+	for _, t := range ti.tenants {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Set `identity.TenantName`, or write a 401 response and return `false`.
+
+For single-tenant identities, require the tenant to match `expectedTenantName`
+(if non-nil). For multi-tenant identities, select the expected or the requested
+tenant and require it to be one of the allowed tenants.
+*/
+func selectTenantOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	identity *TenantIdentity,
+	expectedTenantName *string,
+) bool {
+	if len(identity.tenants) == 0 {
+		if expectedTenantName != nil && *expectedTenantName != identity.TenantName {
+			return exitAuthFailure(w, r, reasonWrongTenant, fmt.Sprintf("bad authentication token: unexpected tenant: %s",
+				identity.TenantName))
+		}
+		return true
+	}
+
+	var tenantName string
+	if expectedTenantName != nil {
+		tenantName = *expectedTenantName
+	} else {
+		var err error
+		tenantName, err = requestedTenantName(r)
+		if err != nil {
+			return exitAuthFailure(w, r, reasonTenantNotSelected, err.Error())
+		}
+		if tenantName == "" {
+			return exitAuthFailure(w, r, reasonTenantNotSelected, fmt.Sprintf(
+				"multi-tenant token: select tenant via %s header or URL path", TestTenantHeader))
+		}
+	}
+
+	if !identity.allowsTenant(tenantName) {
+		return exitAuthFailure(w, r, reasonWrongTenant, fmt.Sprintf("bad authentication token: unexpected tenant: %s",
+			tenantName))
+	}
+
+	identity.TenantName = tenantName
+	return true
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetTenantNameOr401_MultiTenantToken(t *testing.T) {
+	token := signClaimsOrFail(t, &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "service-ingest",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		Tenants: []string{"default", "system"},
+	})
+
+	request := func(orgID string) *http.Request {
+		req := httptest.NewRequest("POST", "http://localhost/api/v1/push", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if orgID != "" {
+			req.Header.Set(TestTenantHeader, orgID)
+		}
+		return req
+	}
+
+	// Tenant selected via header.
+	w := httptest.NewRecorder()
+	tenantName, ok := GetTenantNameOr401(w, request("system"), nil, false)
+	assert.True(t, ok)
+	assert.Equal(t, "system", tenantName)
+
+	// Tenant not in the list.
+	w = httptest.NewRecorder()
+	_, ok = GetTenantNameOr401(w, request("other"), nil, false)
+	assert.False(t, ok)
+	assert.Equal(t, 403, w.Result().StatusCode)
+	assert.Equal(t, "bad authentication token: unexpected tenant: other", w.Body.String())
+
+	// No tenant selected.
+	w = httptest.NewRecorder()
+	_, ok = GetTenantNameOr401(w, request(""), nil, false)
+	assert.False(t, ok)
+	assert.Equal(t, 400, w.Result().StatusCode)
+
+	// Proxy for a specific tenant: the header is not needed.
+	expectedTenantName := "default"
+	w = httptest.NewRecorder()
+	tenantName, ok = GetTenantNameOr401(w, request(""), &expectedTenantName, false)
+	assert.True(t, ok)
+	assert.Equal(t, "default", tenantName)
+
+	expectedTenantName = "other"
+	w = httptest.NewRecorder()
+	_, ok = GetTenantNameOr401(w, request(""), &expectedTenantName, false)
+	assert.False(t, ok)
+}
+
+func TestGetTenantNameOr401_MultiTenantTokenPathVariable(t *testing.T) {
+	token := signClaimsOrFail(t, &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "tenant-default",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		Tenants: []string{"system"},
+	})
+
+	var tenantName string
+	router := mux.NewRouter()
+	router.HandleFunc("/tenants/{tenant}/rules", func(w http.ResponseWriter, r *http.Request) {
+		var ok bool
+		if tenantName, ok = GetTenantNameOr401(w, r, nil, false); ok {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	serve := func(path string, orgID string) int {
+		req := httptest.NewRequest("GET", "http://localhost"+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if orgID != "" {
+			req.Header.Set(TestTenantHeader, orgID)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve("/tenants/system/rules", ""))
+	assert.Equal(t, "system", tenantName)
+
+	// The tenant named in `sub` is allowed, too.
+	assert.Equal(t, http.StatusNoContent, serve("/tenants/default/rules", ""))
+	assert.Equal(t, "default", tenantName)
+
+	assert.Equal(t, http.StatusForbidden, serve("/tenants/other/rules", ""))
+
+	// Header and path disagree.
+	assert.Equal(t, http.StatusBadRequest, serve("/tenants/system/rules", "default"))
+}
+
+func TestValidateAuthToken_TenantsClaim(t *testing.T) {
+	// Neither tenant-prefixed subject nor tenants claim.
+	token := signClaimsOrFail(t, &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "service-ingest",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+	})
+	_, err := defaultAuthenticator.ValidateAuthToken(token)
+	assert.Error(t, err)
+
+	token = signClaimsOrFail(t, &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "service-ingest",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		Tenants: []string{"default", ""},
+	})
+	_, err = defaultAuthenticator.ValidateAuthToken(token)
+	assert.Error(t, err)
+}
@@ -0,0 +1,466 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	json "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/opstrace/opstrace/go/pkg/graphql"
+)
+
+const oidcJWKSRefreshInterval = 5 * time.Minute
+
+// Humans logging in via OIDC are meant to query data, not to push it.
+var oidcUserScopes = []string{ScopeMetricsRead, ScopeLogsRead}
+
+var oidcUserLookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "authenticator",
+	Name:      "oidc_user_lookups_total",
+	Help:      "User lookups for OIDC ID tokens (result: cache_hit, active, unknown_or_inactive, error).",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(oidcUserLookupsTotal)
+}
+
+// Claims expected in an OIDC ID token. `Audience` shadows the `aud` claim of
+// jwt.StandardClaims, which only accepts a single string.
+type oidcClaims struct {
+	jwt.StandardClaims
+	Audience      audience `json:"aud,omitempty"`
+	Email         string   `json:"email"`
+	EmailVerified *bool    `json:"email_verified,omitempty"`
+}
+
+// The `aud` claim: either a single string or an array of strings (see OpenID
+// Connect Core 1.0, section 2).
+type audience []string
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*aud = audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return fmt.Errorf("aud claim: expected string or array of strings")
+	}
+	*aud = multiple
+	return nil
+}
+
+func (aud audience) contains(clientID string) bool {
+	for _, a := range aud {
+		if a == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// A user allowed to log in, as found in the user directory.
+type oidcUser struct {
+	email          string
+	allowedTenants []string
+}
+
+// Look up users by email. Return `nil` (and no error) if there is no active
+// user with that email.
+type oidcUserDirectory interface {
+	lookupActiveUser(email string) (*oidcUser, error)
+}
+
+/*
+Authenticate humans by OIDC ID token: verify the token against the issuer's
+JWKS, then look up the user (by email) in the user directory. Users that are
+not known or not active are rejected.
+*/
+type oidcAuthenticator struct {
+	issuer   string
+	clientID string
+	jwks     *jwksKeySource
+
+	directory oidcUserDirectory
+	cacheTTL  time.Duration
+
+	// Cache of user lookups, including negative results. Map key: email.
+	mu    sync.Mutex
+	users map[string]oidcUserCacheEntry
+}
+
+type oidcUserCacheEntry struct {
+	user      *oidcUser
+	fetchedAt time.Time
+}
+
+func newOIDCAuthenticator(issuer string, clientID string, jwks *jwksKeySource, directory oidcUserDirectory, cacheTTL time.Duration) *oidcAuthenticator {
+	return &oidcAuthenticator{
+		issuer:    issuer,
+		clientID:  clientID,
+		jwks:      jwks,
+		directory: directory,
+		cacheTTL:  cacheTTL,
+		users:     make(map[string]oidcUserCacheEntry),
+	}
+}
+
+/*
+Read OIDC configuration from environment:
+
+	API_OIDC_ISSUER: issuer URL. OIDC login is disabled if not set.
+	API_OIDC_CLIENT_ID: expected `aud` claim of ID tokens (required).
+	API_OIDC_USER_CACHE_TTL: how long user lookups are cached (default: 1m).
+	API_OIDC_USER_TENANTS: JSON document, map of user email to the names of
+	  the tenants that user may access. Users without entry may not access
+	  any tenant.
+	GRAPHQL_ENDPOINT, HASURA_GRAPHQL_ADMIN_SECRET: Hasura access for user lookups.
+
+The issuer's JWKS URL is read from its discovery document.
+*/
+func (a *Authenticator) readOIDCConfigFromEnv() error {
+	a.oidc = nil
+
+	issuer := os.Getenv("API_OIDC_ISSUER")
+	if issuer == "" {
+		log.Infof("API_OIDC_ISSUER is not set, don't accept OIDC ID tokens")
+		return nil
+	}
+
+	clientID := os.Getenv("API_OIDC_CLIENT_ID")
+	if clientID == "" {
+		return fmt.Errorf("API_OIDC_CLIENT_ID is required when API_OIDC_ISSUER is set")
+	}
+
+	cacheTTL, err := durationFromEnv("API_OIDC_USER_CACHE_TTL", time.Minute)
+	if err != nil {
+		return err
+	}
+
+	access, err := graphqlAccessFromEnv("API_OIDC_ISSUER")
+	if err != nil {
+		return err
+	}
+
+	tenantsByEmail, err := oidcUserTenantsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	jwksURL, err := discoverJWKSURL(issuer)
+	if err != nil {
+		return fmt.Errorf("OIDC discovery failed: %s", err)
+	}
+
+	log.Infof("OIDC issuer: %s (JWKS: %s, client ID: %s, user cache TTL: %s)", issuer, jwksURL, clientID, cacheTTL)
+
+	js := newJWKSKeySource(jwksURL)
+	if err := js.refresh(); err != nil {
+		return fmt.Errorf("reading OIDC JWKS document failed: %s", err)
+	}
+
+	a.oidc = newOIDCAuthenticator(issuer, clientID, js, &hasuraUserDirectory{access, tenantsByEmail}, cacheTTL)
+	return nil
+}
+
+// Read tenant membership of OIDC users from API_OIDC_USER_TENANTS.
+func oidcUserTenantsFromEnv() (map[string][]string, error) {
+	tenantsByEmail := make(map[string][]string)
+
+	value := os.Getenv("API_OIDC_USER_TENANTS")
+	if value == "" {
+		log.Warnf("API_OIDC_USER_TENANTS is not set: OIDC users may not access any tenant")
+		return tenantsByEmail, nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &tenantsByEmail); err != nil {
+		return nil, fmt.Errorf("invalid API_OIDC_USER_TENANTS: %s", err)
+	}
+
+	log.Infof("API_OIDC_USER_TENANTS: tenant membership of %d user(s)", len(tenantsByEmail))
+	return tenantsByEmail, nil
+}
+
+// Build Hasura access from GRAPHQL_ENDPOINT and HASURA_GRAPHQL_ADMIN_SECRET.
+// `requiredBy`: the env var enabling the feature that needs it.
+func graphqlAccessFromEnv(requiredBy string) (*graphql.GraphqlAccess, error) {
+	graphqlURL, err := url.Parse(os.Getenv("GRAPHQL_ENDPOINT"))
+	if err != nil || graphqlURL.Host == "" {
+		return nil, fmt.Errorf("invalid GRAPHQL_ENDPOINT (required when %s is set): %s", requiredBy, os.Getenv("GRAPHQL_ENDPOINT"))
+	}
+	return graphql.NewGraphqlAccess(graphqlURL, os.Getenv("HASURA_GRAPHQL_ADMIN_SECRET")), nil
+}
+
+// Read `jwks_uri` from the issuer's OpenID Connect discovery document.
+func discoverJWKSURL(issuer string) (string, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected HTTP response status code: %d", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return "", fmt.Errorf("invalid discovery document: %s", err)
+	}
+
+	if doc.Issuer != issuer {
+		return "", fmt.Errorf("issuer in discovery document (%s) does not match %s", doc.Issuer, issuer)
+	}
+	if doc.JWKSURI == "" {
+		return "", fmt.Errorf("jwks_uri missing in discovery document")
+	}
+
+	return doc.JWKSURI, nil
+}
+
+// Return `true` if the (unverified) token claims to be issued by the OIDC
+// issuer. Tenant API authentication tokens are handled as before.
+func (o *oidcAuthenticator) isOIDCToken(authTokenUnverified string) bool {
+	var claims oidcClaims
+	if _, _, err := new(jwt.Parser).ParseUnverified(authTokenUnverified, &claims); err != nil {
+		return false
+	}
+	return claims.Issuer == o.issuer
+}
+
+/*
+Verify ID token and look up the user. Return the user, or an error meant to be
+exposed in an HTTP response.
+*/
+func (o *oidcAuthenticator) authenticate(idTokenUnverified string) (*oidcUser, error) {
+	tokenstruct, err := jwt.ParseWithClaims(idTokenUnverified, &oidcClaims{}, o.keyLookupCallback)
+	if err != nil || !tokenstruct.Valid {
+		log.Infof("OIDC ID token verification failed: %v", err)
+		return nil, &authFailure{reason: reasonOIDCBadToken, msg: "bad ID token"}
+	}
+
+	claims := tokenstruct.Claims.(*oidcClaims)
+
+	if !claims.VerifyIssuer(o.issuer, true) || !claims.Audience.contains(o.clientID) {
+		log.Infof("OIDC ID token: unexpected iss (%s) or aud (%s)", claims.Issuer, claims.Audience)
+		return nil, &authFailure{reason: reasonOIDCBadToken, msg: "bad ID token"}
+	}
+
+	if claims.Email == "" || (claims.EmailVerified != nil && !*claims.EmailVerified) {
+		log.Infof("OIDC ID token without verified email (sub: %s)", claims.Subject)
+		return nil, &authFailure{reason: reasonOIDCBadToken, msg: "bad ID token: verified email required"}
+	}
+
+	user, err := o.lookupUser(claims.Email)
+	if err != nil {
+		log.Errorf("OIDC user lookup failed: %s", err)
+		return nil, &authFailure{reason: reasonOIDCLookupFailed, msg: "user lookup failed"}
+	}
+
+	if user == nil {
+		log.Infof("OIDC login by unknown or inactive user: %s", claims.Email)
+		return nil, &authFailure{reason: reasonOIDCUnknownUser, msg: "unknown or inactive user"}
+	}
+
+	return user, nil
+}
+
+func (o *oidcAuthenticator) keyLookupCallback(unveriftoken *jwt.Token) (interface{}, error) {
+	kid, ok := unveriftoken.Header["kid"].(string)
+	if !ok {
+		return nil, fmt.Errorf("kid not set in ID token")
+	}
+
+	vkey, ok := o.jwks.lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown kid: %s", kid)
+	}
+
+	// See Authenticator.keyLookupCallback(): do not let the token choose the
+	// algorithm.
+	if unveriftoken.Header["alg"] != vkey.alg || unveriftoken.Method.Alg() != vkey.alg {
+		return nil, fmt.Errorf("invalid alg: %s, expected: %s", unveriftoken.Header["alg"], vkey.alg)
+	}
+
+	return vkey.key, nil
+}
+
+// Look up user by email, using the cache. Errors are not cached.
+func (o *oidcAuthenticator) lookupUser(email string) (*oidcUser, error) {
+	o.mu.Lock()
+	entry, ok := o.users[email]
+	o.mu.Unlock()
+
+	if ok && time.Since(entry.fetchedAt) < o.cacheTTL {
+		oidcUserLookupsTotal.WithLabelValues("cache_hit").Inc()
+		return entry.user, nil
+	}
+
+	user, err := o.directory.lookupActiveUser(email)
+	if err != nil {
+		oidcUserLookupsTotal.WithLabelValues("error").Inc()
+		return nil, err
+	}
+
+	if user == nil {
+		oidcUserLookupsTotal.WithLabelValues("unknown_or_inactive").Inc()
+	} else {
+		oidcUserLookupsTotal.WithLabelValues("active").Inc()
+	}
+
+	o.mu.Lock()
+	o.users[email] = oidcUserCacheEntry{user: user, fetchedAt: time.Now()}
+	o.mu.Unlock()
+
+	return user, nil
+}
+
+/*
+Authenticate request by OIDC ID token. The tenant is the expected tenant or,
+if there is none, the one requested via the X-Scope-OrgID header or URL path
+(see requestedTenantName()). Either way, it must be one of the user's allowed
+tenants.
+*/
+func (a *Authenticator) authenticateUserByIDTokenOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	idTokenUnverified string,
+	expectedTenantName *string,
+) (*TenantIdentity, bool) {
+	user, err := a.oidc.authenticate(idTokenUnverified)
+	if err != nil {
+		if failureReason(err) == reasonOIDCBadToken {
+			a.recordBruteForceFailure(r, idTokenUnverified, reasonOIDCBadToken)
+		}
+		return nil, exitAuthFailureForError(w, r, err)
+	}
+
+	var tenantName string
+	if expectedTenantName != nil {
+		tenantName = *expectedTenantName
+	} else {
+		tenantName, err = requestedTenantName(r)
+		if err != nil {
+			return nil, exitAuthFailure(w, r, reasonTenantNotSelected, err.Error())
+		}
+		if tenantName == "" {
+			return nil, exitAuthFailure(w, r, reasonTenantNotSelected, fmt.Sprintf("%s header or URL path required to select tenant", TestTenantHeader))
+		}
+	}
+
+	for _, allowed := range user.allowedTenants {
+		if allowed == tenantName {
+			return &TenantIdentity{
+				TenantName: tenantName,
+				Scopes:     oidcUserScopes,
+				method:     methodOIDC,
+				subject:    user.email,
+			}, true
+		}
+	}
+
+	log.Infof("OIDC user %s: tenant %s not allowed", user.email, tenantName)
+	return nil, exitAuthFailure(w, r, reasonOIDCTenantForbidden, fmt.Sprintf("user not allowed to access tenant: %s", tenantName))
+}
+
+/*
+User directory backed by Hasura, for the users' active state.
+
+The Hasura schema does not assign tenants to users, so tenant membership is
+configured separately (`tenantsByEmail`, see API_OIDC_USER_TENANTS). Tenants
+that do not exist (anymore) are dropped.
+*/
+type hasuraUserDirectory struct {
+	access         *graphql.GraphqlAccess
+	tenantsByEmail map[string][]string
+}
+
+/*
+Look up active user via the GetActiveUserForAuth query, and the existing
+tenants via GetTenants.
+*/
+func (h *hasuraUserDirectory) lookupActiveUser(email string) (*oidcUser, error) {
+	req, err := graphql.NewGetActiveUserForAuthRequest(h.access.URL, &graphql.GetActiveUserForAuthVariables{
+		Email: graphql.String(email),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Do not use GetActiveUserForAuthResponse: its field types do not match
+	// the response (e.g. `active` is a boolean).
+	var userResult struct {
+		User []struct {
+			Email  string `json:"email"`
+			Active bool   `json:"active"`
+		} `json:"user"`
+	}
+	if err := h.access.Execute(req.Request, &userResult); err != nil {
+		return nil, err
+	}
+
+	if len(userResult.User) == 0 || !userResult.User[0].Active {
+		return nil, nil
+	}
+
+	user := &oidcUser{email: email}
+	members := h.tenantsByEmail[email]
+	if len(members) == 0 {
+		return user, nil
+	}
+
+	treq, err := graphql.NewGetTenantsRequest(h.access.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	var tenantsResult graphql.GetTenantsResponse
+	if err := h.access.Execute(treq.Request, &tenantsResult); err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]bool)
+	for _, t := range tenantsResult.Tenant {
+		existing[t.Name] = true
+	}
+	for _, name := range members {
+		if existing[name] {
+			user.allowedTenants = append(user.allowedTenants, name)
+		}
+	}
+	return user, nil
+}
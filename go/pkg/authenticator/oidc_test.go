@@ -0,0 +1,187 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/graphql"
+)
+
+type fakeUserDirectory struct {
+	users   map[string]*oidcUser
+	lookups int
+}
+
+func (d *fakeUserDirectory) lookupActiveUser(email string) (*oidcUser, error) {
+	d.lookups++
+	return d.users[email], nil
+}
+
+func signIDTokenOrFail(t *testing.T, key *rsa.PrivateKey, claims *oidcClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "idp-key"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("signing failed: %v", err)
+	}
+	return signed
+}
+
+func TestOIDC_Login(t *testing.T) {
+	key := genRSAKeyOrFail(t)
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer": "%s", "jwks_uri": "%s/jwks.json"}`, server.URL, server.URL)
+		case "/jwks.json":
+			fmt.Fprint(w, jwksDocForRSAKey("idp-key", &key.PublicKey))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	jwksURL, err := discoverJWKSURL(server.URL)
+	assert.NoError(t, err)
+	js := newJWKSKeySource(jwksURL)
+	assert.NoError(t, js.refresh())
+
+	directory := &fakeUserDirectory{users: map[string]*oidcUser{
+		"alice@example.com": {email: "alice@example.com", allowedTenants: []string{"default", "prod"}},
+	}}
+
+	a := newAuthenticator()
+	a.oidc = newOIDCAuthenticator(server.URL, "opstrace-ui", js, directory, time.Minute)
+
+	idTokenFor := func(email string, aud ...string) string {
+		return signIDTokenOrFail(t, key, &oidcClaims{
+			StandardClaims: jwt.StandardClaims{
+				Issuer:    server.URL,
+				Subject:   "auth0|123",
+				ExpiresAt: time.Now().Add(time.Hour).Unix(),
+			},
+			Audience: aud,
+			Email:    email,
+		})
+	}
+
+	authenticate := func(token string, expectedTenantName string) (*TenantIdentity, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		identity, _ := a.GetTenantIdentityOr401(w, req, &expectedTenantName, false)
+		return identity, w
+	}
+
+	token := idTokenFor("alice@example.com", "opstrace-ui")
+	identity, _ := authenticate(token, "prod")
+	assert.NotNil(t, identity)
+	assert.Equal(t, "prod", identity.TenantName)
+	assert.True(t, identity.HasScope(ScopeMetricsRead))
+	assert.False(t, identity.HasScope(ScopeMetricsWrite))
+
+	// Second request: user lookup served from cache.
+	identity, _ = authenticate(token, "default")
+	assert.NotNil(t, identity)
+	assert.Equal(t, 1, directory.lookups)
+
+	// Tenant not allowed.
+	identity, w := authenticate(token, "other")
+	assert.Nil(t, identity)
+	assert.Equal(t, 403, w.Result().StatusCode)
+
+	// Unknown or inactive user.
+	identity, w = authenticate(idTokenFor("mallory@example.com", "opstrace-ui"), "default")
+	assert.Nil(t, identity)
+	assert.Equal(t, "unknown or inactive user", w.Body.String())
+
+	// ID token for another client.
+	identity, _ = authenticate(idTokenFor("alice@example.com", "other-app"), "default")
+	assert.Nil(t, identity)
+
+	// `aud` as array.
+	identity, _ = authenticate(idTokenFor("alice@example.com", "other-app", "opstrace-ui"), "default")
+	assert.NotNil(t, identity)
+	identity, _ = authenticate(idTokenFor("alice@example.com", "other-app", "another-app"), "default")
+	assert.Nil(t, identity)
+}
+
+func TestOIDC_AudienceClaim(t *testing.T) {
+	for data, expected := range map[string]audience{
+		`{"aud": "opstrace-ui"}`:         {"opstrace-ui"},
+		`{"aud": ["a", "opstrace-ui"]}`:  {"a", "opstrace-ui"},
+		`{"aud": []}`:                    {},
+		`{"iss": "https://example.com"}`: nil,
+	} {
+		var claims oidcClaims
+		assert.NoError(t, json.Unmarshal([]byte(data), &claims), data)
+		assert.Equal(t, expected, claims.Audience, data)
+	}
+
+	var claims oidcClaims
+	assert.Error(t, json.Unmarshal([]byte(`{"aud": 1}`), &claims))
+}
+
+func TestHasuraUserDirectory(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("x-hasura-admin-secret"))
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case strings.Contains(string(body), "GetActiveUserForAuth") && strings.Contains(string(body), "alice@example.com"):
+			fmt.Fprint(w, `{"data": {"user": [{"id": "1", "email": "alice@example.com", "active": true}]}}`)
+		case strings.Contains(string(body), "GetActiveUserForAuth"):
+			fmt.Fprint(w, `{"data": {"user": []}}`)
+		case strings.Contains(string(body), "GetTenants"):
+			fmt.Fprint(w, `{"data": {"tenant": [{"name": "default"}, {"name": "prod"}]}}`)
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	directory := &hasuraUserDirectory{graphql.NewGraphqlAccess(u, "secret"), map[string][]string{
+		"alice@example.com": {"prod", "deleted"},
+	}}
+
+	// Tenants that do not exist are dropped.
+	user, err := directory.lookupActiveUser("alice@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"prod"}, user.allowedTenants)
+
+	// Active user without tenant membership: no tenants.
+	directory.tenantsByEmail = nil
+	user, err = directory.lookupActiveUser("alice@example.com")
+	assert.NoError(t, err)
+	assert.NotNil(t, user)
+	assert.Empty(t, user.allowedTenants)
+
+	user, err = directory.lookupActiveUser("bob@example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, user)
+}
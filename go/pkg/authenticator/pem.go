@@ -15,6 +15,8 @@
 package authenticator
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
@@ -24,7 +26,20 @@ import (
 )
 
 /*
-Decode RSA public key from PEM data, expecting the X.509 SubjectPublicKeyInfo
+Public key for authentication token verification, bound to the JWT signing
+algorithm (`alg` header value) that it is to be used with. Binding the algorithm
+to the key (instead of trusting the `alg` header of the unverified token) makes
+sure that a token cannot switch the algorithm for a given key ID.
+
+`key` is of type `*rsa.PublicKey`, `*ecdsa.PublicKey` or `ed25519.PublicKey`.
+*/
+type verificationKey struct {
+	alg string
+	key interface{}
+}
+
+/*
+Decode public key from PEM data, expecting the X.509 SubjectPublicKeyInfo
 format (which is what OpenSSL uses when writing a public key to a "PEM file").
 
 Assume byte sequence `data` to be ascii-encoded PEM text.
@@ -44,8 +59,15 @@ See https://stackoverflow.com/a/29707204/145400 for a lovely discussion about
 the X.509 SubjectPublicKeyInfo PEM serialization format, and how the difference
 between `BEGIN PUBLIC KEY` (supported here) and `BEGIN RSA PUBLIC KEY` (not
 supported here) matters a lot.
+
+Supported key types, and the signing algorithm each key type is bound to:
+
+    RSA              RS256
+    ECDSA, P-256     ES256
+    ECDSA, P-384     ES384
+    Ed25519          EdDSA
 */
-func deserializeRSAPubKeyFromPEMBytes(data []byte) (*rsa.PublicKey, error) {
+func deserializePubKeyFromPEMBytes(data []byte) (*verificationKey, error) {
 	pubPem, _ := pem.Decode(data)
 
 	badFormatMsg := "Unexpected key format. Expected: PEM-encoded X.509 SubjectPublicKeyInfo"
@@ -60,17 +82,33 @@ func deserializeRSAPubKeyFromPEMBytes(data []byte) (*rsa.PublicKey, error) {
 	}
 
 	// ParsePKIXPublicKey() above can deserialize various key types (RSA,
-	// ECDSA, DSA). Use type assertion to see of which type the key is, and
-	// support RSA only here for now.
-	var pubkey *rsa.PublicKey
-	var ok bool
-	if pubkey, ok = parsedkey.(*rsa.PublicKey); !ok {
-		return nil, fmt.Errorf("pubkey is not of type RSA")
-	}
+	// ECDSA, Ed25519, DSA). Use type assertion to see of which type the key
+	// is.
+	return newVerificationKey(parsedkey)
+}
 
-	log.Infof(
-		"Deserialized RSA public key with modulus size: %d bits",
-		pubkey.Size()*8)
+// Bind public key to the signing algorithm corresponding to its type (and
+// curve). Reject unsupported key types.
+func newVerificationKey(pubkey interface{}) (*verificationKey, error) {
+	switch k := pubkey.(type) {
+	case *rsa.PublicKey:
+		log.Infof("Deserialized RSA public key with modulus size: %d bits", k.Size()*8)
+		return &verificationKey{alg: "RS256", key: k}, nil
 
-	return pubkey, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve.Params().Name {
+		case "P-256":
+			return &verificationKey{alg: "ES256", key: k}, nil
+		case "P-384":
+			return &verificationKey{alg: "ES384", key: k}, nil
+		default:
+			return nil, fmt.Errorf("unsupported ECDSA curve: %s", k.Curve.Params().Name)
+		}
+
+	case ed25519.PublicKey:
+		return &verificationKey{alg: "EdDSA", key: k}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported pubkey type (supported: RSA, ECDSA P-256/P-384, Ed25519)")
+	}
 }
@@ -0,0 +1,54 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Rate limit for refreshes triggered by requests (e.g. tokens with an unknown key
+ID), which anyone can send: at most one refresh per `minInterval`, including
+periodic ones.
+*/
+type refreshLimiter struct {
+	minInterval time.Duration
+
+	mu        sync.Mutex
+	lastStart time.Time
+}
+
+// Record that a (periodic) refresh starts now.
+func (rl *refreshLimiter) start() {
+	rl.mu.Lock()
+	rl.lastStart = time.Now()
+	rl.mu.Unlock()
+}
+
+// Return true if a refresh may start now, and record that it does. Checking
+// and recording happen atomically: of concurrent callers, only one gets to
+// refresh.
+func (rl *refreshLimiter) reserve() bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.lastStart) < rl.minInterval {
+		return false
+	}
+	rl.lastStart = now
+	return true
+}
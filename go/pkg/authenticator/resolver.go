@@ -0,0 +1,239 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+)
+
+// Resolution is the outcome of a TenantResolver looking at a request.
+type Resolution int
+
+const (
+	// ResolvePass: the request does not carry the kind of authentication
+	// proof handled by the resolver. Ask the next resolver.
+	ResolvePass Resolution = iota
+	// ResolveAccept: the request is authenticated. The identity is set.
+	ResolveAccept
+	// ResolveReject: the request carries invalid authentication proof. An
+	// error response has been written.
+	ResolveReject
+)
+
+/*
+TenantResolver infers the tenant identity from a request, based on one kind of
+authentication proof (such as a token, or a TLS client certificate).
+
+If `expectedTenantName` is non-nil, an accepted identity must be for that
+tenant. Resolvers write the error response themselves when rejecting a
+request, and must not write anything when passing.
+*/
+type TenantResolver interface {
+	ResolveTenant(w http.ResponseWriter, r *http.Request, expectedTenantName *string) (*TenantIdentity, Resolution)
+}
+
+/*
+ResolverChain asks its resolvers in order. The first resolver that accepts or
+rejects the request decides. If all resolvers pass, the request is rejected
+with a 401 response.
+*/
+type ResolverChain []TenantResolver
+
+// ResolveTenantOr401 returns the identity accepted by the chain. Callers can
+// rely on an error response to have been emitted when `ok` is `false`.
+func (c ResolverChain) ResolveTenantOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName *string,
+) (*TenantIdentity, bool) {
+	for _, resolver := range c {
+		identity, resolution := resolver.ResolveTenant(w, r, expectedTenantName)
+		switch resolution {
+		case ResolveAccept:
+			return identity, true
+		case ResolveReject:
+			return nil, false
+		}
+	}
+
+	return nil, exitAuthFailure(w, r, reasonMissingHeader, "authentication proof missing")
+}
+
+// DefaultResolvers returns the chain equivalent to GetTenantIdentityOr401():
+// tokens and (if enabled) TLS client certificates, verified by `a`. If
+// `disableAPIAuthentication` is true, the (insecure) test header resolver.
+func DefaultResolvers(a *Authenticator, disableAPIAuthentication bool) ResolverChain {
+	if disableAPIAuthentication {
+		return ResolverChain{TestHeaderResolver{}}
+	}
+	return ResolverChain{NewTokenResolver(a), NewClientCertResolver(a)}
+}
+
+// Adapter for resolvers backed by an Authenticator method.
+type authenticatorResolver struct {
+	a *Authenticator
+	// Return `true` if the request carries proof handled by this resolver.
+	applies      func(a *Authenticator, r *http.Request) bool
+	authenticate func(a *Authenticator, w http.ResponseWriter, r *http.Request, expectedTenantName *string) (*TenantIdentity, bool)
+}
+
+func (ar *authenticatorResolver) ResolveTenant(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName *string,
+) (*TenantIdentity, Resolution) {
+	if !ar.applies(ar.a, r) {
+		return nil, ResolvePass
+	}
+
+	identity, ok := ar.authenticate(ar.a, w, r, expectedTenantName)
+	if !ok {
+		return nil, ResolveReject
+	}
+
+	if !ar.a.acceptIdentityOr403(w, r, identity) {
+		return nil, ResolveReject
+	}
+	return identity, ResolveAccept
+}
+
+/*
+NewTokenResolver returns a resolver for requests with an Authorization header
+(Bearer or Basic scheme): tenant API authentication tokens and (if enabled)
+OIDC ID tokens, verified by `a`. Passes requests without Authorization header.
+*/
+func NewTokenResolver(a *Authenticator) TenantResolver {
+	return &authenticatorResolver{
+		a: a,
+		applies: func(a *Authenticator, r *http.Request) bool {
+			return r.Header.Get("Authorization") != ""
+		},
+		authenticate: (*Authenticator).authenticateTenantByTokenOr401,
+	}
+}
+
+/*
+NewClientCertResolver returns a resolver for requests with a verified TLS
+client certificate, see EnableClientCertAuthentication(). Passes all requests
+if client certificate authentication is not enabled for `a`.
+*/
+func NewClientCertResolver(a *Authenticator) TenantResolver {
+	return &authenticatorResolver{
+		a:            a,
+		applies:      (*Authenticator).hasVerifiedClientCert,
+		authenticate: (*Authenticator).authenticateTenantByClientCertOr401,
+	}
+}
+
+/*
+StaticAPIKeyResolver authenticates requests by a static API key presented in a
+request header. Each key is valid for one tenant. Keys are compared by their
+SHA-256 hashes. Static API keys do not carry scopes: the identity is not
+restricted.
+
+Like other authentication proof, API keys are subject to the authenticator's
+brute-force protection, tenant existence check and audit log (see
+WithAuthenticator()).
+*/
+type StaticAPIKeyResolver struct {
+	header string
+	// SHA-256 hash of key -> tenant name.
+	tenants map[[sha256.Size]byte]string
+	// `nil`: use the default authenticator.
+	a *Authenticator
+}
+
+// NewStaticAPIKeyResolver builds a resolver reading the API key from request
+// header `header`, with `keys` mapping API keys to tenant names.
+func NewStaticAPIKeyResolver(header string, keys map[string]string) *StaticAPIKeyResolver {
+	tenants := make(map[[sha256.Size]byte]string, len(keys))
+	for key, tenantName := range keys {
+		tenants[sha256.Sum256([]byte(key))] = tenantName
+	}
+	return &StaticAPIKeyResolver{header: header, tenants: tenants}
+}
+
+// WithAuthenticator makes the resolver use `a` (instead of the default
+// authenticator) for brute-force protection, the tenant existence check and
+// the audit log.
+func (sr *StaticAPIKeyResolver) WithAuthenticator(a *Authenticator) *StaticAPIKeyResolver {
+	sr.a = a
+	return sr
+}
+
+func (sr *StaticAPIKeyResolver) ResolveTenant(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName *string,
+) (*TenantIdentity, Resolution) {
+	key := r.Header.Get(sr.header)
+	if key == "" {
+		return nil, ResolvePass
+	}
+
+	a := sr.a
+	if a == nil {
+		a = Default()
+	}
+
+	if !a.rejectIfBlockedOr429(w, r, key) {
+		return nil, ResolveReject
+	}
+
+	tenantName, ok := sr.tenants[sha256.Sum256([]byte(key))]
+	if !ok {
+		a.recordBruteForceFailure(r, key, reasonInvalidToken)
+		exitAuthFailure(w, r, reasonInvalidToken, "bad API key")
+		return nil, ResolveReject
+	}
+
+	if expectedTenantName != nil && *expectedTenantName != tenantName {
+		exitAuthFailure(w, r, reasonWrongTenant, fmt.Sprintf("bad API key: unexpected tenant: %s", tenantName))
+		return nil, ResolveReject
+	}
+
+	identity := &TenantIdentity{TenantName: tenantName, method: methodAPIKey}
+	if !a.acceptIdentityOr403(w, r, identity) {
+		return nil, ResolveReject
+	}
+	return identity, ResolveAccept
+}
+
+/*
+TestHeaderResolver does not verify anything. ONLY FOR TESTING: the tenant is
+the expected tenant or, if there is none, the one named in the X-Scope-OrgID
+header (as in GetTenantIdentityOr401() with disableAPIAuthentication). Rejects
+requests without that header: meant to be the last resolver of a chain.
+*/
+type TestHeaderResolver struct{}
+
+func (TestHeaderResolver) ResolveTenant(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName *string,
+) (*TenantIdentity, Resolution) {
+	if expectedTenantName != nil {
+		return &TenantIdentity{TenantName: *expectedTenantName}, ResolveAccept
+	}
+
+	tenantName := r.Header.Get(TestTenantHeader)
+	if tenantName == "" {
+		exitAuthFailure(w, r, reasonTenantNotSelected, fmt.Sprintf("missing test %s header specifying tenant", TestTenantHeader))
+		return nil, ResolveReject
+	}
+	return &TenantIdentity{TenantName: tenantName}, ResolveAccept
+}
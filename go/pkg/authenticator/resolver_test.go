@@ -0,0 +1,122 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticAPIKeyResolver(t *testing.T) {
+	sr := NewStaticAPIKeyResolver("X-Api-Key", map[string]string{"secret-foo": "foo"})
+
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+	_, resolution := sr.ResolveTenant(httptest.NewRecorder(), req, nil)
+	assert.Equal(t, ResolvePass, resolution)
+
+	req.Header.Set("X-Api-Key", "secret-foo")
+	identity, resolution := sr.ResolveTenant(httptest.NewRecorder(), req, nil)
+	assert.Equal(t, ResolveAccept, resolution)
+	assert.Equal(t, "foo", identity.TenantName)
+	assert.True(t, identity.HasScope(ScopeMetricsWrite))
+
+	expectedTenantName := "bar"
+	w := httptest.NewRecorder()
+	_, resolution = sr.ResolveTenant(w, req, &expectedTenantName)
+	assert.Equal(t, ResolveReject, resolution)
+	assert.Equal(t, 403, w.Result().StatusCode)
+
+	req.Header.Set("X-Api-Key", "secret-bar")
+	w = httptest.NewRecorder()
+	_, resolution = sr.ResolveTenant(w, req, nil)
+	assert.Equal(t, ResolveReject, resolution)
+	assert.Equal(t, 401, w.Result().StatusCode)
+}
+
+func TestStaticAPIKeyResolver_Authenticator(t *testing.T) {
+	a := &Authenticator{
+		tenantSet:  newTenantSet(&fakeTenantDirectory{tenants: map[string]bool{"foo": true}}),
+		bruteForce: newFailureTracker(2, time.Minute, time.Hour, time.Hour),
+	}
+	assert.NoError(t, a.tenantSet.refresh())
+
+	sr := NewStaticAPIKeyResolver("X-Api-Key", map[string]string{
+		"secret-foo":     "foo",
+		"secret-deleted": "deleted",
+	}).WithAuthenticator(a)
+
+	resolveFrom := func(remoteAddr string, key string) int {
+		req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Api-Key", key)
+		w := httptest.NewRecorder()
+		if _, resolution := sr.ResolveTenant(w, req, nil); resolution == ResolveAccept {
+			return 200
+		}
+		return w.Result().StatusCode
+	}
+	resolve := func(key string) int { return resolveFrom("192.0.2.1:1234", key) }
+
+	assert.Equal(t, 200, resolve("secret-foo"))
+
+	// Keys of tenants that do not exist (anymore) are subject to the tenant
+	// existence check.
+	assert.Equal(t, 403, resolve("secret-deleted"))
+
+	// Guessed keys are subject to brute-force protection.
+	assert.Equal(t, 401, resolve("guess"))
+	assert.Equal(t, 401, resolve("guess"))
+	assert.Equal(t, 429, resolve("guess"))
+	assert.Equal(t, 429, resolve("secret-foo"))
+	assert.Equal(t, 200, resolveFrom("192.0.2.2:1234", "secret-foo"))
+}
+
+func TestDefaultResolvers(t *testing.T) {
+	token := signClaimsOrFail(t, &jwt.StandardClaims{
+		Subject:   "tenant-default",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+
+	chain := DefaultResolvers(defaultAuthenticator, false)
+
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	identity, ok := chain.ResolveTenantOr401(httptest.NewRecorder(), req, nil)
+	assert.True(t, ok)
+	assert.Equal(t, "default", identity.TenantName)
+
+	// Client certificates are not enabled: all resolvers pass.
+	w := httptest.NewRecorder()
+	_, ok = chain.ResolveTenantOr401(w, httptest.NewRequest("GET", "http://localhost/api/v1/query", nil), nil)
+	assert.False(t, ok)
+	assert.Equal(t, 401, w.Result().StatusCode)
+
+	// Authentication disabled: tenant from the test header.
+	chain = DefaultResolvers(defaultAuthenticator, true)
+	req = httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+	req.Header.Set(TestTenantHeader, "foo")
+	identity, ok = chain.ResolveTenantOr401(httptest.NewRecorder(), req, nil)
+	assert.True(t, ok)
+	assert.Equal(t, "foo", identity.TenantName)
+
+	w = httptest.NewRecorder()
+	_, ok = chain.ResolveTenantOr401(w, httptest.NewRequest("GET", "http://localhost/api/v1/query", nil), nil)
+	assert.False(t, ok)
+	assert.Equal(t, 400, w.Result().StatusCode)
+}
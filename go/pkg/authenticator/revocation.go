@@ -0,0 +1,216 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	json "github.com/json-iterator/go"
+	"github.com/opstrace/opstrace/go/pkg/filewatch"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var revokedTokensRejectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "authenticator",
+	Name:      "revoked_tokens_rejected_total",
+	Help:      "Number of otherwise valid tokens rejected because they were revoked (reason: jti, issued_before).",
+}, []string{"reason"})
+
+var revocationListReloadFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "authenticator",
+	Name:      "revocation_list_reload_failures_total",
+	Help:      "Number of failed attempts to re-read the token revocation list.",
+})
+
+func init() {
+	prometheus.MustRegister(revokedTokensRejectedTotal)
+	prometheus.MustRegister(revocationListReloadFailuresTotal)
+}
+
+/*
+Revocation list document. Example:
+
+	{
+	  "jti": ["8f0c5a4e-...", "..."],
+	  "issued_before": {
+	    "tenant-foo": "2021-05-01T12:00:00Z"
+	  }
+	}
+
+`jti`: revoke individual tokens by their `jti` claim.
+
+`issued_before`: revoke all tokens for a subject that were issued before the
+given point in time (RFC 3339). Tokens for that subject without `iat` claim are
+considered revoked, too.
+*/
+type revocationListDocument struct {
+	JTI          []string          `json:"jti"`
+	IssuedBefore map[string]string `json:"issued_before"`
+}
+
+type revocationList struct {
+	path string
+	// Of the file contents the list was read from.
+	digest filewatch.Digest
+
+	// Protects the fields below.
+	mu           sync.RWMutex
+	jtis         map[string]struct{}
+	issuedBefore map[string]time.Time
+}
+
+func newRevocationList(path string) *revocationList {
+	return &revocationList{
+		path:         path,
+		jtis:         make(map[string]struct{}),
+		issuedBefore: make(map[string]time.Time),
+	}
+}
+
+/*
+Return `true` if the token with the given claims has been revoked. Count the
+rejection.
+*/
+func (rl *revocationList) isRevoked(claims *tokenClaims) bool {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+
+	if claims.Id != "" {
+		if _, revoked := rl.jtis[claims.Id]; revoked {
+			revokedTokensRejectedTotal.WithLabelValues("jti").Inc()
+			log.Infof("token revoked (jti: %s, sub: %s)", claims.Id, claims.Subject)
+			return true
+		}
+	}
+
+	if cutoff, ok := rl.issuedBefore[claims.Subject]; ok {
+		if claims.IssuedAt == 0 || time.Unix(claims.IssuedAt, 0).Before(cutoff) {
+			revokedTokensRejectedTotal.WithLabelValues("issued_before").Inc()
+			log.Infof("token revoked (sub: %s, iat: %d, revoked if issued before: %s)",
+				claims.Subject, claims.IssuedAt, cutoff.Format(time.RFC3339))
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Re-read the revocation list file and replace the list if the contents changed
+since it was last read (see filewatch.Digest). Replace the list only if reading
+and parsing succeeded: upon error, the last known good list stays in use.
+*/
+func (rl *revocationList) reloadIfChanged() error {
+	changed, err := rl.digest.ApplyFile(rl.path, func(data []byte) error {
+		jtis, issuedBefore, err := parseRevocationList(data)
+		if err != nil {
+			return err
+		}
+
+		rl.mu.Lock()
+		rl.jtis = jtis
+		rl.issuedBefore = issuedBefore
+		rl.mu.Unlock()
+
+		log.Infof("revocation list: read %d jti(s) and %d subject cutoff(s) from %s", len(jtis), len(issuedBefore), rl.path)
+		return nil
+	})
+	if err == nil && !changed {
+		log.Debugf("revocation list %s unchanged", rl.path)
+	}
+	return err
+}
+
+func (rl *revocationList) reloadPeriodically(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := rl.reloadIfChanged(); err != nil {
+			revocationListReloadFailuresTotal.Inc()
+			log.Errorf("revocation list: reload failed, keep using last known list: %s", err)
+		}
+	}
+}
+
+func parseRevocationList(data []byte) (map[string]struct{}, map[string]time.Time, error) {
+	var doc revocationListDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("invalid revocation list document: %s", err)
+	}
+
+	jtis := make(map[string]struct{})
+	for _, jti := range doc.JTI {
+		jtis[jti] = struct{}{}
+	}
+
+	issuedBefore := make(map[string]time.Time)
+	for subject, ts := range doc.IssuedBefore {
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid timestamp for subject %s: %s", subject, err)
+		}
+		issuedBefore[subject] = t
+	}
+
+	return jtis, issuedBefore, nil
+}
+
+/*
+Read path to token revocation list file from environment variable
+API_AUTHTOKEN_REVOCATION_LIST. Do not use a revocation list if the variable is
+not set or empty.
+
+The file is checked for changes every
+API_AUTHTOKEN_REVOCATION_LIST_RELOAD_INTERVAL (Go duration string, default:
+30s), and re-read if it changed.
+
+Return an error if the file cannot be read or parsed now.
+*/
+func (a *Authenticator) readRevocationListConfigFromEnv() error {
+	a.revocationList = nil
+
+	path := os.Getenv("API_AUTHTOKEN_REVOCATION_LIST")
+	if path == "" {
+		log.Infof("API_AUTHTOKEN_REVOCATION_LIST is not set, don't use revocation list")
+		return nil
+	}
+
+	interval, err := durationFromEnv("API_AUTHTOKEN_REVOCATION_LIST_RELOAD_INTERVAL", 30*time.Second)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("API_AUTHTOKEN_REVOCATION_LIST value: %s (reload interval: %s)", path, interval)
+
+	rl := newRevocationList(path)
+	if err := rl.reloadIfChanged(); err != nil {
+		return fmt.Errorf("reading revocation list failed: %s", err)
+	}
+
+	a.revocationList = rl
+	a.revocationListReloadInterval = interval
+	return nil
+}
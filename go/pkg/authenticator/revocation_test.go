@@ -0,0 +1,112 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeRevocationListOrFail(t *testing.T, path string, doc string) {
+	if err := ioutil.WriteFile(path, []byte(doc), 0600); err != nil {
+		t.Fatalf("writing revocation list failed: %v", err)
+	}
+}
+
+func TestRevocationList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked.json")
+	writeRevocationListOrFail(t, path, `{"jti": ["leaked"]}`)
+
+	rl := newRevocationList(path)
+	assert.NoError(t, rl.reloadIfChanged())
+	defaultAuthenticator.revocationList = rl
+	defer func() { defaultAuthenticator.revocationList = nil }()
+
+	iat := time.Now().Add(-10 * time.Minute)
+	claimsFor := func(jti string) *tokenClaims {
+		return &tokenClaims{StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			Subject:   "tenant-default",
+			IssuedAt:  iat.Unix(),
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		}}
+	}
+
+	rejectedBefore := testutil.ToFloat64(revokedTokensRejectedTotal.WithLabelValues("jti"))
+	_, err := defaultAuthenticator.validateAuthTokenGetTenantName(signClaimsOrFail(t, claimsFor("leaked")))
+	assert.Error(t, err)
+	assert.Equal(t, rejectedBefore+1, testutil.ToFloat64(revokedTokensRejectedTotal.WithLabelValues("jti")))
+
+	_, err = defaultAuthenticator.validateAuthTokenGetTenantName(signClaimsOrFail(t, claimsFor("other")))
+	assert.NoError(t, err)
+
+	// Revoke all tokens for the subject issued until now.
+	writeRevocationListOrFail(t, path,
+		`{"issued_before": {"tenant-default": "`+time.Now().Format(time.RFC3339)+`"}}`)
+	assert.NoError(t, rl.reloadIfChanged())
+
+	_, err = defaultAuthenticator.validateAuthTokenGetTenantName(signClaimsOrFail(t, claimsFor("other")))
+	assert.Error(t, err)
+
+	// The jti entry is gone with the new list.
+	assert.False(t, rl.isRevoked(&tokenClaims{StandardClaims: jwt.StandardClaims{Id: "leaked", Subject: "tenant-foo"}}))
+
+	// Token issued after the cutoff.
+	iat = time.Now().Add(time.Minute)
+	assert.False(t, rl.isRevoked(claimsFor("other")))
+
+	// Token without iat claim for a subject with cutoff.
+	assert.True(t, rl.isRevoked(&tokenClaims{StandardClaims: jwt.StandardClaims{Subject: "tenant-default"}}))
+}
+
+func TestRevocationList_KeepLastKnownGood(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked.json")
+	writeRevocationListOrFail(t, path, `{"jti": ["leaked"]}`)
+
+	rl := newRevocationList(path)
+	assert.NoError(t, rl.reloadIfChanged())
+
+	writeRevocationListOrFail(t, path, `{"jti": [`)
+	assert.Error(t, rl.reloadIfChanged())
+	assert.True(t, rl.isRevoked(&tokenClaims{StandardClaims: jwt.StandardClaims{Id: "leaked"}}))
+
+	writeRevocationListOrFail(t, path, `{"issued_before": {"tenant-foo": "yesterday"}}`)
+	assert.Error(t, rl.reloadIfChanged())
+}
+
+func TestRevocationList_ChangeWithoutModTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked.json")
+	mtime := time.Now().Add(-time.Hour)
+	writeRevocationListOrFail(t, path, `{"jti": ["a"]}`)
+	assert.NoError(t, os.Chtimes(path, mtime, mtime))
+
+	rl := newRevocationList(path)
+	assert.NoError(t, rl.reloadIfChanged())
+	assert.Len(t, rl.jtis, 1)
+
+	// As after a symlink swap that keeps the modification time: the change
+	// is detected anyway.
+	writeRevocationListOrFail(t, path, `{"jti": ["a", "b"]}`)
+	assert.NoError(t, os.Chtimes(path, mtime, mtime))
+	assert.NoError(t, rl.reloadIfChanged())
+	assert.Len(t, rl.jtis, 2)
+}
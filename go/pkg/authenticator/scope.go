@@ -0,0 +1,152 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Scopes that can be granted to a tenant API authentication token via the
+// (optional) `scope` claim: a space-separated list, as in RFC 8693.
+const (
+	ScopeMetricsWrite = "metrics:write"
+	ScopeMetricsRead  = "metrics:read"
+	ScopeLogsWrite    = "logs:write"
+	ScopeLogsRead     = "logs:read"
+	// Grants access to administrative/debug endpoints, and implies all other
+	// scopes.
+	ScopeAdmin = "admin"
+)
+
+// Claims expected in a tenant API authentication token: the set of standard
+// claims, plus the optional `scope` and `tenants` claims.
+type tokenClaims struct {
+	jwt.StandardClaims
+	Scope string `json:"scope,omitempty"`
+	// Tenants the token is valid for (multi-tenant tokens, see
+	// multitenant.go). If set, `sub` need not name a tenant.
+	Tenants []string `json:"tenants,omitempty"`
+
+	// Key ID from the token header (not a claim). Set after verification,
+	// for the audit log.
+	keyID string
+}
+
+// TenantIdentity is the outcome of a successful authentication.
+type TenantIdentity struct {
+	TenantName string
+	// Scopes granted to the request. `nil` means: not restricted. That is
+	// the case for tokens without `scope` claim (all tokens issued before
+	// scopes were introduced), and when authentication is disabled.
+	Scopes []string
+
+	// For multi-tenant tokens: the tenants the token is valid for.
+	// `TenantName` is empty until one of them has been selected for the
+	// request, see selectTenantOr401().
+	tenants []string
+
+	// For metrics, the audit log and the whoami endpoint: authentication
+	// method (token, client_cert, oidc, api_key, integration), subject, and
+	// (for tokens) key ID, token ID and expiry (Unix time, 0: does not
+	// expire). For integration keys: the integration's name.
+	method          string
+	subject         string
+	keyID           string
+	tokenID         string
+	expiresAt       int64
+	integrationName string
+}
+
+// HasScope returns true when `scope` has been granted (explicitly, or
+// implicitly via the admin scope or the absence of scope restrictions).
+func (ti *TenantIdentity) HasScope(scope string) bool {
+	if ti.Scopes == nil {
+		return true
+	}
+
+	for _, s := range ti.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true when `scope` has been granted explicitly via the `scope` claim.
+// Unlike HasScope(), the absence of scope restrictions (tokens without `scope`
+// claim, disabled authentication) does not grant it.
+func (ti *TenantIdentity) hasExplicitScope(scope string) bool {
+	for _, s := range ti.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse value of `scope` claim. Return `nil` (not restricted) when the claim is
+// not set.
+func parseScopeClaim(scope string) []string {
+	if scope == "" {
+		return nil
+	}
+
+	// Set, but made of whitespace only: no scope granted. Return non-nil
+	// empty slice.
+	return append([]string{}, strings.Fields(scope)...)
+}
+
+/*
+Require `identity` to have been granted `scope`. Write 403 response (with
+insufficient_scope error code) and return `false` otherwise.
+
+Callers can rely on a 403 response to have been emitted when `false` is
+returned, and should terminate request processing.
+*/
+func RequireScopeOr403(w http.ResponseWriter, r *http.Request, identity *TenantIdentity, scope string) bool {
+	if identity.HasScope(scope) {
+		return true
+	}
+	return exitInsufficientScope(w, r, identity, scope)
+}
+
+// Like RequireScopeOr403(), but require `scope` to have been granted
+// explicitly (see hasExplicitScope()).
+func requireExplicitScopeOr403(w http.ResponseWriter, r *http.Request, identity *TenantIdentity, scope string) bool {
+	if identity.hasExplicitScope(scope) {
+		return true
+	}
+	return exitInsufficientScope(w, r, identity, scope)
+}
+
+// Count failure, then write 403 response (with insufficient_scope error code)
+// and return false.
+func exitInsufficientScope(w http.ResponseWriter, r *http.Request, identity *TenantIdentity, scope string) bool {
+	log.Infof("tenant %s: insufficient scope (required: %s, granted: %v)", identity.TenantName, scope, identity.Scopes)
+	authFailuresTotal.WithLabelValues(reasonInsufficientScope).Inc()
+
+	errmsg := fmt.Sprintf("insufficient scope: %s required", scope)
+	return writeAuthError(w, r, authErrorResponse{
+		status:      http.StatusForbidden,
+		code:        bearerErrorInsufficientScope,
+		description: errmsg,
+		scope:       scope,
+	}, errmsg)
+}
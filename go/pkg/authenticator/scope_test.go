@@ -0,0 +1,88 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantIdentity_HasScope(t *testing.T) {
+	unrestricted := &TenantIdentity{TenantName: "foo"}
+	assert.True(t, unrestricted.HasScope(ScopeMetricsWrite))
+	assert.True(t, unrestricted.HasScope(ScopeAdmin))
+
+	pushOnly := &TenantIdentity{TenantName: "foo", Scopes: parseScopeClaim("metrics:write logs:write")}
+	assert.True(t, pushOnly.HasScope(ScopeMetricsWrite))
+	assert.True(t, pushOnly.HasScope(ScopeLogsWrite))
+	assert.False(t, pushOnly.HasScope(ScopeMetricsRead))
+	assert.False(t, pushOnly.HasScope(ScopeAdmin))
+
+	admin := &TenantIdentity{TenantName: "foo", Scopes: parseScopeClaim("admin")}
+	assert.True(t, admin.HasScope(ScopeLogsRead))
+
+	// Claim set, but empty: nothing granted.
+	none := &TenantIdentity{TenantName: "foo", Scopes: parseScopeClaim("  ")}
+	assert.False(t, none.HasScope(ScopeMetricsRead))
+}
+
+func TestGetTenantIdentity_Scope(t *testing.T) {
+	token := signClaimsOrFail(t, &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "tenant-default",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		Scope: "metrics:read",
+	})
+
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	w := httptest.NewRecorder()
+	expectedTenantName := "default"
+	identity, ok := GetTenantIdentityOr401(w, req, &expectedTenantName, false)
+	assert.True(t, ok)
+	assert.Equal(t, []string{ScopeMetricsRead}, identity.Scopes)
+
+	assert.True(t, RequireScopeOr403(w, req, identity, ScopeMetricsRead))
+
+	w = httptest.NewRecorder()
+	assert.False(t, RequireScopeOr403(w, req, identity, ScopeMetricsWrite))
+	assert.Equal(t, 403, w.Result().StatusCode)
+	assert.Equal(t, "insufficient scope: metrics:write required", w.Body.String())
+}
+
+func TestAuthenticateSpecificTenantByDDQueryParam_Scope(t *testing.T) {
+	token := signClaimsOrFail(t, &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "tenant-default",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		Scope: "metrics:read",
+	})
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/series?api_key="+token, nil)
+
+	// Without scope requirement: any valid token for the tenant.
+	assert.True(t, AuthenticateSpecificTenantByDDQueryParamOr401(httptest.NewRecorder(), req, "default"))
+
+	assert.True(t, AuthenticateSpecificTenantByDDQueryParamWithScopeOr401(httptest.NewRecorder(), req, "default", ScopeMetricsRead))
+	w := httptest.NewRecorder()
+	assert.False(t, AuthenticateSpecificTenantByDDQueryParamWithScopeOr401(w, req, "default", ScopeMetricsWrite))
+	assert.Equal(t, 403, w.Result().StatusCode)
+}
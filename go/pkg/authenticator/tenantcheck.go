@@ -0,0 +1,229 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/opstrace/opstrace/go/pkg/graphql"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Minimum time between two tenant set refreshes triggered by requests for
+// unknown tenants.
+const tenantSetMinRefreshInterval = 30 * time.Second
+
+var tenantsKnown = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "authenticator",
+	Name:      "tenants_known",
+	Help:      "Number of tenants in the tenant set that authenticated requests are checked against.",
+})
+
+var tenantSetRefreshesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "authenticator",
+	Name:      "tenant_set_refreshes_total",
+	Help:      "Tenant set refreshes by outcome (success, failure).",
+}, []string{"outcome"})
+
+func init() {
+	prometheus.MustRegister(tenantsKnown)
+	prometheus.MustRegister(tenantSetRefreshesTotal)
+}
+
+// Source of the names of existing tenants.
+type tenantDirectory interface {
+	listTenants() (map[string]bool, error)
+}
+
+/*
+Names of the existing tenants, read from the tenant directory. Re-read
+periodically, and on demand when a tenant is not in the set (rate-limited), so
+that new tenants can be used right away. If reading fails, the last known good
+set stays in use.
+
+Tokens do not expire when their tenant is deleted: checking authenticated
+requests against this set makes deleting a tenant revoke its tokens.
+*/
+type tenantSet struct {
+	directory tenantDirectory
+	// For refreshes triggered by unknown tenants.
+	refreshLimit refreshLimiter
+
+	// Protects the field below.
+	mu      sync.RWMutex
+	tenants map[string]bool
+}
+
+func newTenantSet(directory tenantDirectory) *tenantSet {
+	return &tenantSet{
+		directory:    directory,
+		refreshLimit: refreshLimiter{minInterval: tenantSetMinRefreshInterval},
+		tenants:      make(map[string]bool),
+	}
+}
+
+// Return true if the tenant exists. If it is not in the set, refresh
+// (rate-limited) and check again.
+func (ts *tenantSet) contains(tenantName string) bool {
+	ts.mu.RLock()
+	ok := ts.tenants[tenantName]
+	ts.mu.RUnlock()
+
+	if ok || !ts.refreshLimit.reserve() {
+		return ok
+	}
+
+	log.Infof("tenant set: unknown tenant %s, refresh", tenantName)
+	if err := ts.update(); err != nil {
+		log.Errorf("tenant set: refresh failed, keep using last known tenant set: %s", err)
+	}
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.tenants[tenantName]
+}
+
+// Re-read tenant set. Replace the current set only if that succeeded.
+func (ts *tenantSet) refresh() error {
+	ts.refreshLimit.start()
+	return ts.update()
+}
+
+// Like refresh(), for callers that reserved the refresh, see contains().
+func (ts *tenantSet) update() error {
+	tenants, err := ts.directory.listTenants()
+	if err != nil {
+		tenantSetRefreshesTotal.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	ts.mu.Lock()
+	ts.tenants = tenants
+	ts.mu.Unlock()
+
+	tenantSetRefreshesTotal.WithLabelValues("success").Inc()
+	tenantsKnown.Set(float64(len(tenants)))
+	return nil
+}
+
+func (ts *tenantSet) refreshPeriodically(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := ts.refresh(); err != nil {
+			log.Errorf("tenant set: periodic refresh failed, keep using last known tenant set: %s", err)
+		}
+	}
+}
+
+// Tenant directory backed by Hasura.
+type hasuraTenantDirectory struct {
+	access *graphql.GraphqlAccess
+}
+
+// Read tenant names via GetTenants.
+func (h *hasuraTenantDirectory) listTenants() (map[string]bool, error) {
+	req, err := graphql.NewGetTenantsRequest(h.access.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	var result graphql.GetTenantsResponse
+	if err := h.access.Execute(req.Request, &result); err != nil {
+		return nil, err
+	}
+
+	tenants := make(map[string]bool, len(result.Tenant))
+	for _, t := range result.Tenant {
+		tenants[t.Name] = true
+	}
+	return tenants, nil
+}
+
+/*
+Read tenant existence check config from environment:
+
+	API_AUTH_TENANT_CHECK: if true, reject requests for tenants that do not
+	  exist (anymore). Default: false.
+	API_AUTH_TENANT_CHECK_REFRESH_INTERVAL: how often the tenant set is
+	  re-read (default: 1m). Bounds the time a deleted tenant's tokens are
+	  still accepted.
+	GRAPHQL_ENDPOINT, HASURA_GRAPHQL_ADMIN_SECRET: Hasura access.
+*/
+func (a *Authenticator) readTenantCheckConfigFromEnv() error {
+	a.tenantSet = nil
+
+	enabled := false
+	if s := os.Getenv("API_AUTH_TENANT_CHECK"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid API_AUTH_TENANT_CHECK: %s", s)
+		}
+		enabled = b
+	}
+	if !enabled {
+		return nil
+	}
+
+	interval, err := durationFromEnv("API_AUTH_TENANT_CHECK_REFRESH_INTERVAL", time.Minute)
+	if err != nil {
+		return err
+	}
+
+	access, err := graphqlAccessFromEnv("API_AUTH_TENANT_CHECK")
+	if err != nil {
+		return err
+	}
+
+	ts := newTenantSet(&hasuraTenantDirectory{access})
+	if err := ts.refresh(); err != nil {
+		return fmt.Errorf("reading tenant set failed: %s", err)
+	}
+
+	log.Infof("reject requests for unknown tenants (tenant set refresh interval: %s)", interval)
+	a.tenantSet = ts
+	a.tenantSetRefreshInterval = interval
+	return nil
+}
+
+/*
+Final step of each successful authentication: if enabled, require the tenant
+to exist (403 response otherwise). Then count the authentication and write it
+to the audit log (if enabled).
+
+Callers can rely on a 403 response to have been emitted when `false` is
+returned.
+*/
+func (a *Authenticator) acceptIdentityOr403(w http.ResponseWriter, r *http.Request, identity *TenantIdentity) bool {
+	if a.tenantSet != nil && !a.tenantSet.contains(identity.TenantName) {
+		return exitAuthFailure(w, r, reasonUnknownTenant, fmt.Sprintf("unknown tenant: %s", identity.TenantName))
+	}
+
+	a.recordSuccess(r, identity)
+	return true
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/opstrace/opstrace/go/pkg/graphql"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTenantDirectory struct {
+	tenants map[string]bool
+	err     error
+	fetches int32
+	delay   time.Duration
+}
+
+func (d *fakeTenantDirectory) listTenants() (map[string]bool, error) {
+	atomic.AddInt32(&d.fetches, 1)
+	time.Sleep(d.delay)
+	if d.err != nil {
+		return nil, d.err
+	}
+	tenants := make(map[string]bool)
+	for name := range d.tenants {
+		tenants[name] = true
+	}
+	return tenants, nil
+}
+
+func TestAuthenticate_TenantCheck(t *testing.T) {
+	directory := &fakeTenantDirectory{tenants: map[string]bool{"default": true}}
+	ts := newTenantSet(directory)
+	assert.NoError(t, ts.refresh())
+
+	defaultAuthenticator.tenantSet = ts
+	defer func() { defaultAuthenticator.tenantSet = nil }()
+
+	token := signClaimsOrFail(t, &jwt.StandardClaims{
+		Subject:   "tenant-default",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	authenticate := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		GetTenantIdentityOr401(w, req, nil, false)
+		return w
+	}
+
+	assert.Equal(t, 200, authenticate().Result().StatusCode)
+
+	// Tenant deleted.
+	delete(directory.tenants, "default")
+	assert.NoError(t, ts.refresh())
+	w := authenticate()
+	assert.Equal(t, 403, w.Result().StatusCode)
+	assert.Contains(t, w.Result().Header.Get("WWW-Authenticate"), `error="insufficient_scope"`)
+
+	// Hasura unreachable: keep last known tenant set.
+	directory.tenants["default"] = true
+	assert.NoError(t, ts.refresh())
+	directory.err = fmt.Errorf("connection refused")
+	assert.Error(t, ts.refresh())
+	assert.Equal(t, 200, authenticate().Result().StatusCode)
+
+	// Also checked for the DD API key.
+	delete(directory.tenants, "default")
+	directory.err = nil
+	assert.NoError(t, ts.refresh())
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/series?api_key="+token, nil)
+	w = httptest.NewRecorder()
+	assert.False(t, AuthenticateSpecificTenantByDDQueryParamWithScopeOr401(w, req, "default", ScopeMetricsWrite))
+	assert.Equal(t, 403, w.Result().StatusCode)
+}
+
+func TestTenantSet_UnknownTenant(t *testing.T) {
+	directory := &fakeTenantDirectory{tenants: map[string]bool{"default": true}}
+	ts := newTenantSet(directory)
+	assert.NoError(t, ts.refresh())
+
+	// Tenant created after the last refresh: refreshed right away, unless
+	// the last refresh is too recent.
+	directory.tenants["new"] = true
+	assert.False(t, ts.contains("new"))
+	ts.refreshLimit.lastStart = time.Now().Add(-tenantSetMinRefreshInterval)
+	assert.True(t, ts.contains("new"))
+	assert.False(t, ts.contains("other"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&directory.fetches))
+
+	// Concurrent requests for unknown tenants: one refresh.
+	directory.delay = 50 * time.Millisecond
+	ts.refreshLimit.lastStart = time.Now().Add(-tenantSetMinRefreshInterval)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ts.contains(fmt.Sprintf("tenant-%d", i))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&directory.fetches))
+}
+
+func TestHasuraTenantDirectory(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"tenant": [{"id": "t1", "name": "default"}, {"id": "t2", "name": "prod"}]}}`)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	tenants, err := (&hasuraTenantDirectory{graphql.NewGraphqlAccess(u, "")}).listTenants()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"default": true, "prod": true}, tenants)
+}
@@ -0,0 +1,190 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultTokenCacheSize = 10000
+
+var tokenCacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "authenticator",
+	Name:      "token_cache_requests_total",
+	Help:      "Lookups in the cache of verified tokens (result: hit, miss).",
+}, []string{"result"})
+
+var tokenCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "authenticator",
+	Name:      "token_cache_entries",
+	Help:      "Number of entries in the cache of verified tokens.",
+})
+
+func init() {
+	prometheus.MustRegister(tokenCacheRequestsTotal)
+	prometheus.MustRegister(tokenCacheEntries)
+}
+
+/*
+Bounded LRU cache of verified tokens, so that the signature of a token that is
+presented over and over again (the common case for push clients) is checked
+only once.
+
+Keyed by the SHA-256 hash of the token string (do not keep tokens in memory).
+Stores the verified claims, so that checks that may change over time (such as
+revocation) can still be applied upon a cache hit. Entries are evicted when
+the token expires, and the whole cache is invalidated when the key set
+changes.
+*/
+type tokenCache struct {
+	maxSize int
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[[sha256.Size]byte]*list.Element
+	// Incremented upon invalidation. Results of a verification that started
+	// before the invalidation must not be added.
+	generation uint64
+}
+
+type tokenCacheEntry struct {
+	key       [sha256.Size]byte
+	claims    *tokenClaims
+	expiresAt time.Time
+}
+
+func newTokenCache(maxSize int) *tokenCache {
+	return &tokenCache{
+		maxSize: maxSize,
+		ll:      list.New(),
+		items:   make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// Return verified claims for `token` if cached and not expired.
+func (tc *tokenCache) get(token string) (*tokenClaims, bool) {
+	key := sha256.Sum256([]byte(token))
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	elem, ok := tc.items[key]
+	if !ok {
+		tokenCacheRequestsTotal.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+
+	entry := elem.Value.(*tokenCacheEntry)
+	if !entry.expiresAt.IsZero() && !time.Now().Before(entry.expiresAt) {
+		tc.removeElement(elem)
+		tokenCacheRequestsTotal.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+
+	tc.ll.MoveToFront(elem)
+	tokenCacheRequestsTotal.WithLabelValues("hit").Inc()
+	return entry.claims, true
+}
+
+// Return current generation, to be passed to add() after verification.
+func (tc *tokenCache) currentGeneration() uint64 {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.generation
+}
+
+/*
+Add verified token. Do nothing if the cache has been invalidated since
+`generation` was obtained (the token may have been verified with a key that is
+gone now). Evict the least recently used entry if the cache is full.
+*/
+func (tc *tokenCache) add(token string, claims *tokenClaims, generation uint64) {
+	key := sha256.Sum256([]byte(token))
+
+	var expiresAt time.Time
+	if claims.ExpiresAt != 0 {
+		expiresAt = time.Unix(claims.ExpiresAt, 0)
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if generation != tc.generation {
+		return
+	}
+
+	if elem, ok := tc.items[key]; ok {
+		tc.ll.MoveToFront(elem)
+		return
+	}
+
+	tc.items[key] = tc.ll.PushFront(&tokenCacheEntry{key: key, claims: claims, expiresAt: expiresAt})
+	for tc.ll.Len() > tc.maxSize {
+		tc.removeElement(tc.ll.Back())
+	}
+	tokenCacheEntries.Set(float64(tc.ll.Len()))
+}
+
+// Drop all entries.
+func (tc *tokenCache) invalidate() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.generation++
+	tc.ll.Init()
+	tc.items = make(map[[sha256.Size]byte]*list.Element)
+	tokenCacheEntries.Set(0)
+}
+
+// Expects `tc.mu` to be held.
+func (tc *tokenCache) removeElement(elem *list.Element) {
+	tc.ll.Remove(elem)
+	delete(tc.items, elem.Value.(*tokenCacheEntry).key)
+	tokenCacheEntries.Set(float64(tc.ll.Len()))
+}
+
+/*
+Read maximum number of cached tokens from environment variable
+API_AUTHTOKEN_CACHE_SIZE (default: 10000). 0 disables the cache.
+*/
+func (a *Authenticator) readTokenCacheConfigFromEnv() error {
+	size := defaultTokenCacheSize
+	if s := os.Getenv("API_AUTHTOKEN_CACHE_SIZE"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid API_AUTHTOKEN_CACHE_SIZE: %s", s)
+		}
+		size = n
+	}
+
+	if size == 0 {
+		log.Infof("token cache disabled")
+		a.tokenCache = nil
+		return nil
+	}
+
+	log.Infof("token cache size: %d", size)
+	a.tokenCache = newTokenCache(size)
+	return nil
+}
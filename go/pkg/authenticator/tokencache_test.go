@@ -0,0 +1,94 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func claimsExpiringAt(t time.Time) *tokenClaims {
+	return &tokenClaims{StandardClaims: jwt.StandardClaims{Subject: "tenant-foo", ExpiresAt: t.Unix()}}
+}
+
+func TestTokenCache_LRU(t *testing.T) {
+	tc := newTokenCache(2)
+	exp := time.Now().Add(time.Hour)
+
+	tc.add("a", claimsExpiringAt(exp), tc.currentGeneration())
+	tc.add("b", claimsExpiringAt(exp), tc.currentGeneration())
+
+	// Touch a, so that b is the least recently used entry.
+	_, ok := tc.get("a")
+	assert.True(t, ok)
+
+	tc.add("c", claimsExpiringAt(exp), tc.currentGeneration())
+	_, ok = tc.get("b")
+	assert.False(t, ok)
+	_, ok = tc.get("a")
+	assert.True(t, ok)
+	_, ok = tc.get("c")
+	assert.True(t, ok)
+}
+
+func TestTokenCache_Expiry(t *testing.T) {
+	tc := newTokenCache(10)
+	tc.add("a", claimsExpiringAt(time.Now().Add(-time.Second)), tc.currentGeneration())
+
+	_, ok := tc.get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, tc.ll.Len())
+}
+
+func TestTokenCache_Invalidate(t *testing.T) {
+	tc := newTokenCache(10)
+	exp := time.Now().Add(time.Hour)
+
+	// Verification started before invalidation: result must not be added.
+	generation := tc.currentGeneration()
+	tc.add("a", claimsExpiringAt(exp), generation)
+	tc.invalidate()
+	tc.add("b", claimsExpiringAt(exp), generation)
+
+	_, ok := tc.get("a")
+	assert.False(t, ok)
+	_, ok = tc.get("b")
+	assert.False(t, ok)
+}
+
+func TestValidateAuthToken_Cached(t *testing.T) {
+	key := genRSAKeyOrFail(t)
+	a := newAuthenticator()
+	a.setPubKeys(map[string]*verificationKey{"key1": {alg: "RS256", key: &key.PublicKey}})
+
+	token := signRS256OrFail(t, key, "key1", "tenant-foo")
+
+	hitsBefore := testutil.ToFloat64(tokenCacheRequestsTotal.WithLabelValues("hit"))
+	for i := 0; i < 3; i++ {
+		tenantName, err := a.validateAuthTokenGetTenantName(token)
+		assert.NoError(t, err)
+		assert.Equal(t, "foo", tenantName)
+	}
+	assert.Equal(t, hitsBefore+2, testutil.ToFloat64(tokenCacheRequestsTotal.WithLabelValues("hit")))
+
+	// Key removed from key set: the cached token must not be accepted.
+	a.setPubKeys(map[string]*verificationKey{})
+	_, err := a.validateAuthTokenGetTenantName(token)
+	assert.Error(t, err)
+}
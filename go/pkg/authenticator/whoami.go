@@ -0,0 +1,241 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	json "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Upper limit for the size of an introspection request body.
+const maxIntrospectionRequestSize = 64 * 1024
+
+// Response of the whoami endpoint: the identity of the authenticated request.
+type whoamiResponse struct {
+	Tenant string `json:"tenant"`
+	// For multi-tenant tokens: all tenants the token is valid for.
+	Tenants []string `json:"tenants,omitempty"`
+	Method  string   `json:"method"`
+	Subject string   `json:"subject,omitempty"`
+	KeyID   string   `json:"kid,omitempty"`
+	TokenID string   `json:"jti,omitempty"`
+	// For integration keys: the integration's name.
+	Integration string `json:"integration,omitempty"`
+	// RFC 3339. Empty if the token does not expire.
+	ExpiresAt string `json:"expires_at,omitempty"`
+	// `null`: not restricted.
+	Scopes []string `json:"scopes"`
+}
+
+/*
+Response of the introspection endpoint. For invalid tokens, `Reason` is the
+failure reason (as in the authenticator_failures_total metric), and the other
+fields are read from the token without verifying it.
+*/
+type introspectionResponse struct {
+	Valid     bool     `json:"valid"`
+	Reason    string   `json:"reason,omitempty"`
+	Tenant    string   `json:"tenant,omitempty"`
+	Tenants   []string `json:"tenants,omitempty"`
+	Subject   string   `json:"subject,omitempty"`
+	KeyID     string   `json:"kid,omitempty"`
+	Algorithm string   `json:"alg,omitempty"`
+	TokenID   string   `json:"jti,omitempty"`
+	Audience  string   `json:"aud,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	IssuedAt  string   `json:"issued_at,omitempty"`
+	NotBefore string   `json:"not_before,omitempty"`
+	ExpiresAt string   `json:"expires_at,omitempty"`
+	Scopes    []string `json:"scopes,omitempty"`
+}
+
+type introspectionRequest struct {
+	Token string `json:"token"`
+}
+
+func formatUnixTime(t int64) string {
+	if t == 0 {
+		return ""
+	}
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("marshalling response failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, werr := w.Write(body); werr != nil {
+		log.Errorf("writing response failed: %v", werr)
+	}
+}
+
+/*
+Authenticate request like the proxies do: by Authorization header (or TLS
+client certificate), and for requests with the DD api_key URL query parameter
+and without Authorization header, by that parameter (see
+AuthenticateSpecificTenantByDDQueryParamOr401()).
+*/
+func (a *Authenticator) identifyRequestOr401(
+	w http.ResponseWriter,
+	r *http.Request,
+	expectedTenantName *string,
+	disableAPIAuthentication bool,
+) (*TenantIdentity, bool) {
+	if !disableAPIAuthentication && expectedTenantName != nil &&
+		r.Header.Get("Authorization") == "" && r.URL.Query().Get("api_key") != "" {
+		return a.authenticateTenantByDDQueryParamOr401(w, r, *expectedTenantName)
+	}
+	return a.GetTenantIdentityOr401(w, r, expectedTenantName, disableAPIAuthentication)
+}
+
+/*
+WhoamiHandler returns a handler reporting the identity of the authenticated
+request (tenant, subject, key ID, expiry and scopes), meant for debugging
+client configuration. `expectedTenantName` and `disableAPIAuthentication` are
+as for GetTenantIdentityOr401(): use the proxy's settings.
+*/
+func (a *Authenticator) WhoamiHandler(expectedTenantName *string, disableAPIAuthentication bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := a.identifyRequestOr401(w, r, expectedTenantName, disableAPIAuthentication)
+		if !ok {
+			return
+		}
+
+		method := identity.method
+		if method == "" {
+			method = "none"
+		}
+
+		writeJSON(w, &whoamiResponse{
+			Tenant:      identity.TenantName,
+			Tenants:     identity.tenants,
+			Method:      method,
+			Subject:     identity.subject,
+			KeyID:       identity.keyID,
+			TokenID:     identity.tokenID,
+			Integration: identity.integrationName,
+			ExpiresAt:   formatUnixTime(identity.expiresAt),
+			Scopes:      identity.Scopes,
+		})
+	}
+}
+
+/*
+IntrospectionHandler returns a handler that verifies the token in the request
+body, and reports its claims or why it is invalid. The body is the token, or a
+JSON document `{"token": "<token>"}`.
+
+The request itself must be authenticated with a token explicitly granted the
+admin scope: tokens without `scope` claim (and requests with authentication
+disabled) are not allowed, since the endpoint lets callers test arbitrary
+tokens. For the same reason, the introspected token is subject to brute-force
+protection like a token presented for authentication.
+
+If `expectedTenantName` is non-nil, a token for another tenant is reported as
+invalid (reason: wrong_tenant), as the proxy would reject it.
+*/
+func (a *Authenticator) IntrospectionHandler(expectedTenantName *string, disableAPIAuthentication bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := a.identifyRequestOr401(w, r, expectedTenantName, disableAPIAuthentication)
+		if !ok {
+			return
+		}
+		if !requireExplicitScopeOr403(w, r, identity, ScopeAdmin) {
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIntrospectionRequestSize))
+		if err != nil {
+			http.Error(w, "reading request body failed", http.StatusBadRequest)
+			return
+		}
+
+		token := strings.TrimSpace(string(body))
+		if strings.HasPrefix(token, "{") {
+			var req introspectionRequest
+			if err := json.Unmarshal(body, &req); err != nil {
+				http.Error(w, "invalid JSON document", http.StatusBadRequest)
+				return
+			}
+			token = req.Token
+		}
+		if token == "" {
+			http.Error(w, "token missing", http.StatusBadRequest)
+			return
+		}
+
+		if !a.rejectIfBlockedOr429(w, r, token) {
+			return
+		}
+
+		resp := a.introspect(token, expectedTenantName)
+		if !resp.Valid {
+			a.recordBruteForceFailure(r, token, resp.Reason)
+		}
+		writeJSON(w, resp)
+	}
+}
+
+// Verify token as validateAuthToken() does, and report the outcome.
+func (a *Authenticator) introspect(token string, expectedTenantName *string) *introspectionResponse {
+	resp := &introspectionResponse{}
+
+	// Read claims without verifying, for reporting them in any case.
+	claims := &tokenClaims{}
+	if unverified, _, err := new(jwt.Parser).ParseUnverified(token, claims); err == nil {
+		resp.KeyID, _ = unverified.Header["kid"].(string)
+		resp.Algorithm, _ = unverified.Header["alg"].(string)
+		resp.Subject = claims.Subject
+		resp.Tenants = claims.Tenants
+		resp.TokenID = claims.Id
+		resp.Audience = claims.Audience
+		resp.Issuer = claims.Issuer
+		resp.IssuedAt = formatUnixTime(claims.IssuedAt)
+		resp.NotBefore = formatUnixTime(claims.NotBefore)
+		resp.ExpiresAt = formatUnixTime(claims.ExpiresAt)
+		resp.Scopes = parseScopeClaim(claims.Scope)
+		if len(claims.Tenants) == 0 && strings.HasPrefix(claims.Subject, "tenant-") {
+			resp.Tenant = strings.TrimPrefix(claims.Subject, "tenant-")
+		}
+	}
+
+	identity, err := a.validateAuthToken(token)
+	if err != nil {
+		resp.Reason = failureReason(err)
+		return resp
+	}
+
+	if expectedTenantName != nil {
+		if len(identity.tenants) > 0 && !identity.allowsTenant(*expectedTenantName) ||
+			len(identity.tenants) == 0 && identity.TenantName != *expectedTenantName {
+			resp.Reason = reasonWrongTenant
+			return resp
+		}
+	}
+
+	resp.Valid = true
+	return resp
+}
@@ -0,0 +1,152 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authenticator
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWhoamiHandler(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	token := signClaimsOrFail(t, &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "tenant-default",
+			Id:        "token-1",
+			ExpiresAt: expiresAt,
+		},
+		Scope: "metrics:read",
+	})
+
+	expectedTenantName := "default"
+	handler := Default().WhoamiHandler(&expectedTenantName, false)
+
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/whoami", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	var resp map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "default", resp["tenant"])
+	assert.Equal(t, "token", resp["method"])
+	assert.Equal(t, "tenant-default", resp["subject"])
+	assert.Equal(t, "rsakey", resp["kid"])
+	assert.Equal(t, "token-1", resp["jti"])
+	assert.Equal(t, time.Unix(expiresAt, 0).UTC().Format(time.RFC3339), resp["expires_at"])
+	assert.Equal(t, []interface{}{"metrics:read"}, resp["scopes"])
+
+	// Authenticated by the DD api_key query parameter.
+	req = httptest.NewRequest("GET", "http://localhost/api/v1/whoami?api_key="+token, nil)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "http://localhost/api/v1/whoami", nil))
+	assert.Equal(t, 401, w.Result().StatusCode)
+}
+
+func TestIntrospectionHandler(t *testing.T) {
+	key := genRSAKeyOrFail(t)
+	useKeySet(t, map[string]*verificationKey{
+		"rsakey": {alg: "RS256", key: &key.PublicKey},
+	})
+	sign := func(claims jwt.Claims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "rsakey"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("signing failed: %v", err)
+		}
+		return signed
+	}
+	tokenWithScope := func(subject string, scope string, expiresAt time.Time) string {
+		return sign(&tokenClaims{
+			StandardClaims: jwt.StandardClaims{Subject: subject, ExpiresAt: expiresAt.Unix()},
+			Scope:          scope,
+		})
+	}
+
+	expectedTenantName := "default"
+	handler := Default().IntrospectionHandler(&expectedTenantName, false)
+	adminToken := tokenWithScope("tenant-default", ScopeAdmin, time.Now().Add(time.Hour))
+
+	introspect := func(callerToken string, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "http://localhost/api/v1/introspect", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+callerToken)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		var resp map[string]interface{}
+		if w.Result().StatusCode == 200 {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		}
+		return w.Result().StatusCode, resp
+	}
+
+	// Caller without admin scope.
+	status, _ := introspect(tokenWithScope("tenant-default", "metrics:read", time.Now().Add(time.Hour)), "foo")
+	assert.Equal(t, 403, status)
+
+	// Caller with a token without scope claim: not restricted elsewhere, but
+	// not allowed to introspect tokens.
+	status, _ = introspect(tokenWithScope("tenant-default", "", time.Now().Add(time.Hour)), "foo")
+	assert.Equal(t, 403, status)
+
+	status, resp := introspect(adminToken, adminToken)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, true, resp["valid"])
+	assert.Equal(t, "default", resp["tenant"])
+	assert.Equal(t, "rsakey", resp["kid"])
+	assert.Equal(t, "RS256", resp["alg"])
+
+	expired := tokenWithScope("tenant-default", "", time.Now().Add(-time.Hour))
+	status, resp = introspect(adminToken, `{"token": "`+expired+`"}`)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, false, resp["valid"])
+	assert.Equal(t, reasonExpired, resp["reason"])
+	assert.Equal(t, "tenant-default", resp["subject"])
+
+	_, resp = introspect(adminToken, tokenWithScope("tenant-other", "", time.Now().Add(time.Hour)))
+	assert.Equal(t, false, resp["valid"])
+	assert.Equal(t, reasonWrongTenant, resp["reason"])
+
+	_, resp = introspect(adminToken, "foobarbadtoken")
+	assert.Equal(t, false, resp["valid"])
+	assert.Equal(t, reasonMalformedToken, resp["reason"])
+
+	status, _ = introspect(adminToken, "")
+	assert.Equal(t, 400, status)
+
+	// Introspected tokens are subject to brute-force protection.
+	defaultAuthenticator.bruteForce = newFailureTracker(2, time.Minute, time.Hour, time.Hour)
+	defer func() { defaultAuthenticator.bruteForce = nil }()
+
+	forged := adminToken[:len(adminToken)-4] + "AAAA"
+	for i := 0; i < 2; i++ {
+		status, resp = introspect(adminToken, forged)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, false, resp["valid"])
+	}
+	status, _ = introspect(adminToken, forged)
+	assert.Equal(t, 429, status)
+}
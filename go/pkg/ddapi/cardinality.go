@@ -0,0 +1,420 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+)
+
+// Upper bound for the number of distinct values tracked per label name (per
+// metric). Only used for reporting the worst-offending tags, i.e. there is no
+// need to be precise beyond that number.
+const maxTrackedLabelValues = 10000
+
+// Default upper bound for the number of series tracked per tenant when there
+// is no per tenant series limit. Tracking a series takes roughly 50 bytes.
+const defaultMaxTrackedSeries = 1000000
+
+// Upper bound for the number of untracked metric names per tenant that drops
+// are recorded for between two reports (see tenantCardinality).
+const maxReportedUntrackedMetrics = 1000
+
+var (
+	cardinalityActiveSeries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "dd_api",
+		Name:      "cardinality_active_series",
+		Help:      "Approximate number of active series per tenant, as seen by the cardinality limiter.",
+	}, []string{"tenant"})
+
+	cardinalityDroppedSeries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dd_api",
+		Name:      "cardinality_dropped_series_total",
+		Help:      "Number of time series fragments dropped by the cardinality limiter.",
+	}, []string{"tenant", "reason"})
+
+	// Only the top N metrics (by active series count) are exposed, to not
+	// create a cardinality problem while reporting on one.
+	cardinalityTopMetrics = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "dd_api",
+		Name:      "cardinality_top_metric_active_series",
+		Help:      "Approximate number of active series for the metrics with the highest series count.",
+	}, []string{"tenant", "metric"})
+)
+
+func init() {
+	prometheus.MustRegister(cardinalityActiveSeries, cardinalityDroppedSeries, cardinalityTopMetrics)
+}
+
+type CardinalityLimiterConfig struct {
+	// Maximum number of active series per metric name (per tenant). Zero
+	// means: no limit.
+	MaxSeriesPerMetric int
+	// Maximum number of active series per tenant. Zero means: no limit.
+	MaxSeriesPerTenant int
+	// Maximum number of series tracked per tenant, bounding the memory used
+	// by the limiter. New series beyond that are dropped. Default:
+	// MaxSeriesPerTenant if set, otherwise one million.
+	MaxTrackedSeries int
+	// A series that has not been seen for this long is not considered to be
+	// active anymore (and does not count towards the limits).
+	ActiveWindow time.Duration
+	// How often to prune inactive series and to report (log, expose) the
+	// worst-offending metrics and tags.
+	ReportInterval time.Duration
+	// Number of worst-offending metrics to report.
+	TopN int
+}
+
+/*
+CardinalityLimiter keeps track of the active series per metric name and per
+tenant, and drops series that would exceed the configured limits. Series that
+are already known keep flowing; only new series are dropped.
+
+Series are identified by a 64-bit hash of their label set (including the metric
+name). Hash collisions and the active window make the series counts
+approximate, which is good enough for protecting Cortex from a cardinality
+explosion. The number of tracked series per tenant is capped (see
+MaxTrackedSeries), so that memory usage does not grow with the cardinality
+the limiter is meant to cap. Inactive series (and tenants) are pruned every
+ReportInterval, until Stop() is called.
+*/
+type CardinalityLimiter struct {
+	cfg CardinalityLimiterConfig
+	now func() time.Time
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+
+	mu      sync.Mutex
+	tenants map[string]*tenantCardinality
+}
+
+type tenantCardinality struct {
+	activeSeries int
+	metrics      map[string]*metricCardinality
+	// Number of series dropped since the last report, for metrics that are
+	// not tracked (see Filter()). Map key: metric name. Holds at most
+	// maxReportedUntrackedMetrics entries.
+	droppedUntracked map[string]int
+}
+
+type metricCardinality struct {
+	// Map key: series hash. Map value: last seen (unix seconds).
+	series map[uint64]int64
+	// Distinct label values per label name, for reporting.
+	labelValues map[string]map[uint64]struct{}
+	// Number of series dropped since the last report.
+	dropped int
+}
+
+func NewCardinalityLimiter(cfg CardinalityLimiterConfig) *CardinalityLimiter {
+	if cfg.ActiveWindow == 0 {
+		cfg.ActiveWindow = 30 * time.Minute
+	}
+	if cfg.ReportInterval == 0 {
+		cfg.ReportInterval = time.Minute
+	}
+	if cfg.TopN == 0 {
+		cfg.TopN = 10
+	}
+	if cfg.MaxTrackedSeries == 0 {
+		cfg.MaxTrackedSeries = cfg.MaxSeriesPerTenant
+	}
+	if cfg.MaxTrackedSeries == 0 {
+		cfg.MaxTrackedSeries = defaultMaxTrackedSeries
+	}
+
+	cl := &CardinalityLimiter{
+		cfg:     cfg,
+		now:     time.Now,
+		stopCh:  make(chan struct{}),
+		tenants: make(map[string]*tenantCardinality),
+	}
+	go cl.pruneAndReportPeriodically()
+	return cl
+}
+
+// Stop stops pruning and reporting.
+func (cl *CardinalityLimiter) Stop() {
+	cl.stopOnce.Do(func() { close(cl.stopCh) })
+}
+
+func (cl *CardinalityLimiter) pruneAndReportPeriodically() {
+	ticker := time.NewTicker(cl.cfg.ReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cl.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		cl.mu.Lock()
+		cl.pruneAndReport(cl.now())
+		cl.mu.Unlock()
+	}
+}
+
+/*
+Return the subset of `ptsf` that is allowed to be written for tenant
+`tenantName`. Time series fragments for known (active) series are always kept.
+Fragments for new series are dropped when admitting them would exceed the per
+metric or per tenant series limit.
+*/
+func (cl *CardinalityLimiter) Filter(tenantName string, ptsf []*prompb.TimeSeries) []*prompb.TimeSeries {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	now := cl.now()
+
+	tc, ok := cl.tenants[tenantName]
+	if !ok {
+		tc = &tenantCardinality{
+			metrics:          make(map[string]*metricCardinality),
+			droppedUntracked: make(map[string]int),
+		}
+		cl.tenants[tenantName] = tc
+	}
+
+	kept := ptsf[:0]
+	for _, pts := range ptsf {
+		metricName := getMetricName(pts.Labels)
+		h := hashLabels(pts.Labels)
+
+		// Only tracked metrics get an entry, so that a flood of new metric
+		// names does not grow the limiter's memory either.
+		mc := tc.metrics[metricName]
+		if mc != nil {
+			mc.recordLabelValues(pts.Labels)
+			if _, known := mc.series[h]; known {
+				mc.series[h] = now.Unix()
+				kept = append(kept, pts)
+				continue
+			}
+		}
+
+		if reason := cl.admissionFailure(tc, mc); reason != "" {
+			tc.recordDrop(metricName, mc)
+			cardinalityDroppedSeries.WithLabelValues(tenantName, reason).Inc()
+			log.Debugf("cardinality limiter: tenant %s: %s reached, drop new series for metric %s",
+				tenantName, reason, metricName)
+			continue
+		}
+
+		if mc == nil {
+			mc = &metricCardinality{
+				series:      make(map[uint64]int64),
+				labelValues: make(map[string]map[uint64]struct{}),
+			}
+			mc.recordLabelValues(pts.Labels)
+			tc.metrics[metricName] = mc
+		}
+		mc.series[h] = now.Unix()
+		tc.activeSeries++
+		kept = append(kept, pts)
+	}
+
+	return kept
+}
+
+// Count a dropped series for the report. Record drops for untracked metrics
+// (`mc` nil) by name, up to maxReportedUntrackedMetrics names.
+func (tc *tenantCardinality) recordDrop(metricName string, mc *metricCardinality) {
+	if mc != nil {
+		mc.dropped++
+		return
+	}
+	if _, ok := tc.droppedUntracked[metricName]; ok || len(tc.droppedUntracked) < maxReportedUntrackedMetrics {
+		tc.droppedUntracked[metricName]++
+	}
+}
+
+// Return the reason for dropping a new series for metric `mc` (nil: metric
+// not tracked yet), or an empty string if the series can be admitted. Expect
+// `cl.mu` to be held.
+func (cl *CardinalityLimiter) admissionFailure(tc *tenantCardinality, mc *metricCardinality) string {
+	switch {
+	case cl.cfg.MaxSeriesPerTenant > 0 && tc.activeSeries >= cl.cfg.MaxSeriesPerTenant:
+		return "tenant_limit"
+	case tc.activeSeries >= cl.cfg.MaxTrackedSeries:
+		return "tracking_limit"
+	case mc != nil && cl.cfg.MaxSeriesPerMetric > 0 && len(mc.series) >= cl.cfg.MaxSeriesPerMetric:
+		return "metric_limit"
+	}
+	return ""
+}
+
+// Remove series that have not been seen within the active window, update the
+// exposed metrics and log the worst-offending metrics (and their tags). Expect
+// `cl.mu` to be held.
+func (cl *CardinalityLimiter) pruneAndReport(now time.Time) {
+	cutoff := now.Add(-cl.cfg.ActiveWindow).Unix()
+	cardinalityTopMetrics.Reset()
+
+	for tenantName, tc := range cl.tenants {
+		tc.activeSeries = 0
+		for metricName, mc := range tc.metrics {
+			for h, lastSeen := range mc.series {
+				if lastSeen < cutoff {
+					delete(mc.series, h)
+				}
+			}
+			if len(mc.series) == 0 && mc.dropped == 0 {
+				delete(tc.metrics, metricName)
+				continue
+			}
+			tc.activeSeries += len(mc.series)
+		}
+
+		// Forget tenants that stopped pushing.
+		if len(tc.metrics) == 0 && len(tc.droppedUntracked) == 0 {
+			delete(cl.tenants, tenantName)
+			cardinalityActiveSeries.DeleteLabelValues(tenantName)
+			continue
+		}
+
+		cardinalityActiveSeries.WithLabelValues(tenantName).Set(float64(tc.activeSeries))
+
+		for _, metricName := range tc.topMetrics(cl.cfg.TopN) {
+			mc := tc.metrics[metricName]
+			cardinalityTopMetrics.WithLabelValues(tenantName, metricName).Set(float64(len(mc.series)))
+			if mc.dropped == 0 {
+				log.Infof("cardinality limiter: tenant %s: metric %s: %d active series. "+
+					"Labels with most distinct values: %s",
+					tenantName, metricName, len(mc.series), mc.topLabels(3))
+			}
+		}
+
+		// Always report the metrics for which series were dropped, regardless
+		// of their rank.
+		for metricName, mc := range tc.metrics {
+			if mc.dropped > 0 {
+				log.Warnf("cardinality limiter: tenant %s: metric %s: %d active series, dropped %d new series "+
+					"since last report. Labels with most distinct values: %s",
+					tenantName, metricName, len(mc.series), mc.dropped, mc.topLabels(3))
+			}
+		}
+		for metricName, dropped := range tc.droppedUntracked {
+			log.Warnf("cardinality limiter: tenant %s: metric %s: not tracked, dropped %d new series "+
+				"since last report", tenantName, metricName, dropped)
+		}
+
+		// Start counting distinct label values and drops from scratch for
+		// the next report.
+		for _, mc := range tc.metrics {
+			mc.dropped = 0
+			mc.labelValues = make(map[string]map[uint64]struct{})
+		}
+		tc.droppedUntracked = make(map[string]int)
+	}
+}
+
+// Return the names of the `n` metrics with the highest active series count.
+func (tc *tenantCardinality) topMetrics(n int) []string {
+	names := make([]string, 0, len(tc.metrics))
+	for name := range tc.metrics {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return len(tc.metrics[names[i]].series) > len(tc.metrics[names[j]].series)
+	})
+	if len(names) > n {
+		names = names[:n]
+	}
+	return names
+}
+
+func (mc *metricCardinality) recordLabelValues(labels []*prompb.Label) {
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			continue
+		}
+		values, ok := mc.labelValues[l.Name]
+		if !ok {
+			values = make(map[uint64]struct{})
+			mc.labelValues[l.Name] = values
+		}
+		if len(values) < maxTrackedLabelValues {
+			values[hashString(l.Value)] = struct{}{}
+		}
+	}
+}
+
+// Return a human-readable summary of the `n` label names with the most
+// distinct values, e.g. `ddtag_request_id=9999, instance=3`.
+func (mc *metricCardinality) topLabels(n int) string {
+	names := make([]string, 0, len(mc.labelValues))
+	for name := range mc.labelValues {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return len(mc.labelValues[names[i]]) > len(mc.labelValues[names[j]])
+	})
+	if len(names) > n {
+		names = names[:n]
+	}
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+"="+strconv.Itoa(len(mc.labelValues[name])))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func getMetricName(labels []*prompb.Label) string {
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// Build a hash from the label set. The translator constructs label sets from a
+// map, i.e. the label order is random: sort a copy before hashing.
+func hashLabels(labels []*prompb.Label) uint64 {
+	sorted := make([]*prompb.Label, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	h := fnv.New64a()
+	for _, l := range sorted {
+		h.Write([]byte(l.Name))
+		// Use a byte that is not valid in label names or (UTF-8) label values
+		// as separator, so that e.g. {a="bc"} and {ab="c"} do not collide.
+		h.Write([]byte{0xff})
+		h.Write([]byte(l.Value))
+		h.Write([]byte{0xff})
+	}
+	return h.Sum64()
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
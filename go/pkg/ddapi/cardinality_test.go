@@ -0,0 +1,138 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddapi
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func genSeries(metricname string, requestID int) *prompb.TimeSeries {
+	return &prompb.TimeSeries{
+		Labels: []*prompb.Label{
+			{Name: "__name__", Value: metricname},
+			{Name: "instance", Value: "x1carb6"},
+			{Name: "ddtag_request_id", Value: fmt.Sprintf("%d", requestID)},
+		},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1610030000000}},
+	}
+}
+
+func TestCardinalityLimiter_MetricLimit(t *testing.T) {
+	cl := NewCardinalityLimiter(CardinalityLimiterConfig{MaxSeriesPerMetric: 2})
+	defer cl.Stop()
+
+	kept := cl.Filter(TenantName, []*prompb.TimeSeries{
+		genSeries("foo", 1),
+		genSeries("foo", 2),
+		genSeries("foo", 3),
+		genSeries("bar", 1),
+	})
+	// The third series for `foo` exceeds the limit.
+	assert.Equal(t, 3, len(kept))
+
+	// Known series keep flowing, new series for `foo` are still dropped.
+	kept = cl.Filter(TenantName, []*prompb.TimeSeries{
+		genSeries("foo", 2),
+		genSeries("foo", 1),
+		genSeries("foo", 4),
+	})
+	assert.Equal(t, 2, len(kept))
+}
+
+func TestCardinalityLimiter_TenantLimit(t *testing.T) {
+	cl := NewCardinalityLimiter(CardinalityLimiterConfig{MaxSeriesPerTenant: 2})
+	defer cl.Stop()
+
+	kept := cl.Filter(TenantName, []*prompb.TimeSeries{
+		genSeries("foo", 1),
+		genSeries("bar", 1),
+		genSeries("baz", 1),
+	})
+	assert.Equal(t, 2, len(kept))
+
+	// Limits are tracked per tenant.
+	kept = cl.Filter("other", []*prompb.TimeSeries{genSeries("baz", 1)})
+	assert.Equal(t, 1, len(kept))
+}
+
+func TestCardinalityLimiter_LabelOrder(t *testing.T) {
+	cl := NewCardinalityLimiter(CardinalityLimiterConfig{MaxSeriesPerMetric: 1})
+	defer cl.Stop()
+
+	s := genSeries("foo", 1)
+	assert.Equal(t, 1, len(cl.Filter(TenantName, []*prompb.TimeSeries{s})))
+
+	// Same label set, different order: expect this to be the same series.
+	reordered := &prompb.TimeSeries{
+		Labels: []*prompb.Label{s.Labels[2], s.Labels[0], s.Labels[1]},
+	}
+	assert.Equal(t, 1, len(cl.Filter(TenantName, []*prompb.TimeSeries{reordered})))
+}
+
+func TestCardinalityLimiter_ActiveWindow(t *testing.T) {
+	now := time.Unix(1610030000, 0)
+	cl := NewCardinalityLimiter(CardinalityLimiterConfig{
+		MaxSeriesPerMetric: 1,
+		ActiveWindow:       10 * time.Minute,
+	})
+	defer cl.Stop()
+	cl.now = func() time.Time { return now }
+
+	assert.Equal(t, 1, len(cl.Filter(TenantName, []*prompb.TimeSeries{genSeries("foo", 1)})))
+	assert.Equal(t, 0, len(cl.Filter(TenantName, []*prompb.TimeSeries{genSeries("foo", 2)})))
+
+	// After the first series went inactive, there is room for a new one.
+	now = now.Add(11 * time.Minute)
+	cl.pruneAndReport(now)
+	assert.Equal(t, 1, len(cl.Filter(TenantName, []*prompb.TimeSeries{genSeries("foo", 2)})))
+
+	// Tenants that stopped pushing are forgotten.
+	cl.Filter("other", []*prompb.TimeSeries{genSeries("foo", 1)})
+	now = now.Add(11 * time.Minute)
+	cl.pruneAndReport(now)
+	assert.Equal(t, 0, len(cl.tenants))
+}
+
+func TestCardinalityLimiter_TrackingLimit(t *testing.T) {
+	cl := NewCardinalityLimiter(CardinalityLimiterConfig{MaxSeriesPerMetric: 10, MaxTrackedSeries: 2})
+	defer cl.Stop()
+
+	kept := cl.Filter(TenantName, []*prompb.TimeSeries{
+		genSeries("foo", 1),
+		genSeries("foo", 2),
+		genSeries("foo", 3),
+		genSeries("bar", 1),
+	})
+	assert.Equal(t, 2, len(kept))
+
+	// Dropped series of metrics that are not tracked yet take no memory,
+	// but are counted by metric name for the report.
+	tc := cl.tenants[TenantName]
+	assert.Equal(t, 1, len(tc.metrics))
+	assert.Equal(t, 1, tc.metrics["foo"].dropped)
+	assert.Equal(t, map[string]int{"bar": 1}, tc.droppedUntracked)
+	cl.pruneAndReport(cl.now())
+	assert.Empty(t, tc.droppedUntracked)
+
+	// The tenant limit bounds the number of tracked series by default.
+	cl = NewCardinalityLimiter(CardinalityLimiterConfig{MaxSeriesPerTenant: 5})
+	defer cl.Stop()
+	assert.Equal(t, 5, cl.cfg.MaxTrackedSeries)
+}
@@ -38,6 +38,14 @@ type DDCortexProxy struct {
 	authenticatorEnabled bool
 	remoteWriteURL       string
 	rwHTTPClient         *http.Client
+
+	// Optional: when set, new series beyond the configured cardinality
+	// limits are dropped before writing to Cortex.
+	CardinalityLimiter *CardinalityLimiter
+
+	// Optional: authenticator used for verifying requests. When not set, the
+	// default authenticator is used.
+	Authenticator *authenticator.Authenticator
 }
 
 func NewDDCortexProxy(
@@ -56,6 +64,13 @@ func NewDDCortexProxy(
 	return p
 }
 
+func (ddcp *DDCortexProxy) getAuthenticator() *authenticator.Authenticator {
+	if ddcp.Authenticator != nil {
+		return ddcp.Authenticator
+	}
+	return authenticator.Default()
+}
+
 func logErrorEmit500(w http.ResponseWriter, e error) {
 	log.Error(fmt.Errorf("emit 500: %v", e))
 	http.Error(w, e.Error(), 500)
@@ -132,6 +147,10 @@ func (ddcp *DDCortexProxy) HandlerCommonAfterJSONTranslate(
 	r *http.Request,
 	ptsf []*prompb.TimeSeries,
 ) {
+	if ddcp.CardinalityLimiter != nil {
+		ptsf = ddcp.CardinalityLimiter.Filter(ddcp.tenantName, ptsf)
+	}
+
 	// Create Prometheus/Cortex "write request", and serialize it into
 	// protobuf message (a byte sequence).
 	writeRequest := &prompb.WriteRequest{
@@ -165,7 +184,8 @@ func (ddcp *DDCortexProxy) HandlerCommonAfterJSONTranslate(
 }
 
 func (ddcp *DDCortexProxy) HandlerCheckPost(w http.ResponseWriter, r *http.Request) {
-	if ddcp.authenticatorEnabled && !authenticator.AuthenticateSpecificTenantByDDQueryParamOr401(w, r, ddcp.tenantName) {
+	if ddcp.authenticatorEnabled && !ddcp.getAuthenticator().AuthenticateSpecificTenantByDDQueryParamWithScopeOr401(
+		w, r, ddcp.tenantName, authenticator.ScopeMetricsWrite) {
 		// Error response has already been written. Terminate request handling.
 		return
 	}
@@ -190,7 +210,8 @@ func (ddcp *DDCortexProxy) HandlerCheckPost(w http.ResponseWriter, r *http.Reque
 }
 
 func (ddcp *DDCortexProxy) HandlerSeriesPost(w http.ResponseWriter, r *http.Request) {
-	if ddcp.authenticatorEnabled && !authenticator.AuthenticateSpecificTenantByDDQueryParamOr401(w, r, ddcp.tenantName) {
+	if ddcp.authenticatorEnabled && !ddcp.getAuthenticator().AuthenticateSpecificTenantByDDQueryParamWithScopeOr401(
+		w, r, ddcp.tenantName, authenticator.ScopeMetricsWrite) {
 		// Error response has already been written. Terminate request handling.
 		return
 	}
@@ -0,0 +1,72 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package filewatch detects changes of re-read configuration documents (files,
+// or documents fetched via HTTP) by their content.
+package filewatch
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"sync"
+)
+
+/*
+Digest remembers the SHA-256 digest of the document content last applied, so
+that a re-read document is only parsed and applied if it changed.
+
+Content is compared rather than e.g. file modification times: Kubernetes
+updates mounted Secrets and ConfigMaps by atomically swapping a symlink, which
+does not reliably change the modification time.
+
+The zero value is ready to use. Safe for concurrent use: applying is
+serialized.
+*/
+type Digest struct {
+	mu  sync.Mutex
+	sum [sha256.Size]byte
+}
+
+/*
+Apply calls `apply` with `data`, unless `data` equals the content last applied.
+The content counts as applied only if `apply` returns no error: upon error, the
+caller is expected to keep using the last known good state, and the same
+content is tried again next time.
+
+Return whether `data` changed, and the error returned by `apply`.
+*/
+func (d *Digest) Apply(data []byte, apply func(data []byte) error) (bool, error) {
+	sum := sha256.Sum256(data)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if sum == d.sum {
+		return false, nil
+	}
+	if err := apply(data); err != nil {
+		return true, err
+	}
+	d.sum = sum
+	return true, nil
+}
+
+// ApplyFile reads the file at `path` and passes its content to Apply().
+func (d *Digest) ApplyFile(path string, apply func(data []byte) error) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	return d.Apply(data, apply)
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filewatch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDigest_Apply(t *testing.T) {
+	var d Digest
+	var applied []string
+	apply := func(data []byte) error {
+		if string(data) == "invalid" {
+			return fmt.Errorf("invalid document")
+		}
+		applied = append(applied, string(data))
+		return nil
+	}
+
+	changed, err := d.Apply([]byte("a"), apply)
+	assert.True(t, changed)
+	assert.NoError(t, err)
+
+	// Same content: not applied again.
+	changed, err = d.Apply([]byte("a"), apply)
+	assert.False(t, changed)
+	assert.NoError(t, err)
+
+	// Failed to apply: tried again next time.
+	for i := 0; i < 2; i++ {
+		changed, err = d.Apply([]byte("invalid"), apply)
+		assert.True(t, changed)
+		assert.Error(t, err)
+	}
+
+	changed, err = d.Apply([]byte("b"), apply)
+	assert.True(t, changed)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, applied)
+}
+
+func TestDigest_ApplyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "doc")
+
+	var d Digest
+	apply := func([]byte) error { return nil }
+
+	_, err = d.ApplyFile(path, apply)
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("a"), 0600))
+	changed, err := d.ApplyFile(path, apply)
+	assert.True(t, changed)
+	assert.NoError(t, err)
+	changed, _ = d.ApplyFile(path, apply)
+	assert.False(t, changed)
+}
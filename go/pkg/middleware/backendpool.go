@@ -0,0 +1,614 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Prefix of backend specs to be resolved via DNS SRV records, as in Cortex
+// and Thanos: `dnssrv+http://_http._tcp.querier.cortex.svc.cluster.local`.
+const dnsSRVPrefix = "dnssrv+"
+
+var backendRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tenant_proxy",
+	Name:      "backend_requests_total",
+	Help:      "Requests sent to backends, by backend and outcome (success, error). Errors: transport errors and 502/503/504 responses.",
+}, []string{"backend", "outcome"})
+
+var backendRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tenant_proxy",
+	Name:      "backend_retries_total",
+	Help:      "Idempotent requests retried on another backend, by the backend that failed.",
+}, []string{"backend"})
+
+var backendInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "tenant_proxy",
+	Name:      "backend_in_flight_requests",
+	Help:      "Requests currently in flight, by backend.",
+}, []string{"backend"})
+
+var backendUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "tenant_proxy",
+	Name:      "backend_up",
+	Help:      "1 if the backend receives requests (passes health checks and is not ejected), 0 otherwise.",
+}, []string{"backend"})
+
+func init() {
+	prometheus.MustRegister(backendRequestsTotal)
+	prometheus.MustRegister(backendRetriesTotal)
+	prometheus.MustRegister(backendInFlight)
+	prometheus.MustRegister(backendUp)
+}
+
+// Load balancing strategies.
+const (
+	RoundRobin       = "round-robin"
+	LeastConnections = "least-connections"
+)
+
+// BackendPoolConfig configures load balancing, health checking and failover.
+type BackendPoolConfig struct {
+	// RoundRobin (default) or LeastConnections.
+	Strategy string
+
+	// Active health checks: GET HealthCheckPath on each backend every
+	// HealthCheckInterval; a backend is healthy while that returns a 2xx
+	// response within HealthCheckTimeout. Empty path: no active health
+	// checks.
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+
+	// Passive ejection: after MaxFailures consecutive failed requests
+	// (transport errors, 502/503/504 responses), a backend does not get
+	// requests for EjectionTime. Zero MaxFailures: no passive ejection.
+	MaxFailures  int
+	EjectionTime time.Duration
+
+	// Idempotent requests failing with a transport error or a 502/503/504
+	// response are retried on up to MaxRetries other backends.
+	MaxRetries int
+
+	// For DNS SRV specs: how often the SRV records are looked up again.
+	DiscoveryInterval time.Duration
+
+	// Circuit breaker per backend, see CircuitBreakerConfig.
+	CircuitBreaker CircuitBreakerConfig
+}
+
+// DefaultBackendPoolConfig returns the config used by the proxies when not
+// configured otherwise. For query backends, use
+// DefaultQueryCircuitBreakerConfig() for the circuit breaker.
+func DefaultBackendPoolConfig() BackendPoolConfig {
+	return BackendPoolConfig{
+		Strategy:            RoundRobin,
+		HealthCheckInterval: 10 * time.Second,
+		HealthCheckTimeout:  2 * time.Second,
+		MaxFailures:         3,
+		EjectionTime:        30 * time.Second,
+		MaxRetries:          1,
+		DiscoveryInterval:   30 * time.Second,
+		CircuitBreaker:      DefaultCircuitBreakerConfig(),
+	}
+}
+
+type backend struct {
+	url *url.URL
+	// Metric label value.
+	label string
+
+	inFlight int64
+	// 1: passes health checks (or none configured).
+	healthy int32
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	ejectedUntil        time.Time
+
+	// Optional.
+	breaker *circuitBreaker
+}
+
+func (p *BackendPool) newBackend(u *url.URL) *backend {
+	b := &backend{url: u, label: u.Host, healthy: 1}
+	if p.config.CircuitBreaker.ErrorRateThreshold > 0 {
+		b.breaker = newCircuitBreaker(p.config.CircuitBreaker, b.label)
+	}
+	return b
+}
+
+func (b *backend) available(now time.Time) bool {
+	if atomic.LoadInt32(&b.healthy) == 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !now.Before(b.ejectedUntil)
+}
+
+func (b *backend) updateUpMetric(now time.Time) {
+	up := 0.0
+	if b.available(now) {
+		up = 1
+	}
+	backendUp.WithLabelValues(b.label).Set(up)
+}
+
+/*
+BackendPool is a set of equivalent backends (e.g. Cortex queriers) that
+requests are balanced across. Use it via TenantReverseProxy.WithBackendPool().
+
+Backends that fail active health checks, or (passively) requests, do not get
+requests until they recover. If no backend is available, all of them are tried
+anyway: better than failing every request.
+*/
+type BackendPool struct {
+	config BackendPoolConfig
+	// Scheme and (if discovered via DNS SRV) SRV record name.
+	scheme  string
+	srvName string
+
+	// Allow for faking DNS lookups and time in tests.
+	lookupSRV func(service, proto, name string) (string, []*net.SRV, error)
+	now       func() time.Time
+
+	mu       sync.RWMutex
+	backends []*backend
+
+	next          uint64
+	healthClient  *http.Client
+	stopCh        chan struct{}
+	stopOnce      sync.Once
+	baseTransport http.RoundTripper
+}
+
+/*
+NewBackendPool builds a pool from `spec`: a comma-separated list of backend
+URLs (without path), or a DNS SRV spec (`dnssrv+http://<SRV record name>`).
+Starts health checks and (for DNS SRV specs) periodic discovery; see Stop().
+*/
+func NewBackendPool(spec string, config BackendPoolConfig) (*BackendPool, error) {
+	p, err := newBackendPool(spec, config, net.LookupSRV)
+	if err != nil {
+		return nil, err
+	}
+	p.start()
+	return p, nil
+}
+
+func newBackendPool(
+	spec string,
+	config BackendPoolConfig,
+	lookupSRV func(service, proto, name string) (string, []*net.SRV, error),
+) (*BackendPool, error) {
+	switch config.Strategy {
+	case "":
+		config.Strategy = RoundRobin
+	case RoundRobin, LeastConnections:
+	default:
+		return nil, fmt.Errorf("invalid load balancing strategy: %s", config.Strategy)
+	}
+	if err := config.CircuitBreaker.validate(); err != nil {
+		return nil, err
+	}
+
+	p := &BackendPool{
+		config:        config,
+		lookupSRV:     lookupSRV,
+		now:           time.Now,
+		healthClient:  &http.Client{Timeout: config.HealthCheckTimeout},
+		stopCh:        make(chan struct{}),
+		baseTransport: http.DefaultTransport,
+	}
+
+	if strings.HasPrefix(spec, dnsSRVPrefix) {
+		u, err := url.Parse(strings.TrimPrefix(spec, dnsSRVPrefix))
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid DNS SRV backend spec: %s", spec)
+		}
+		p.scheme, p.srvName = u.Scheme, u.Host
+		if err := p.discover(); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+
+	var backends []*backend
+	for _, s := range strings.Split(spec, ",") {
+		u, err := url.Parse(strings.TrimSpace(s))
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid backend URL: %s", s)
+		}
+		if u.Path != "" && u.Path != "/" {
+			return nil, fmt.Errorf("backend URL must not have a path: %s", s)
+		}
+		if p.scheme != "" && u.Scheme != p.scheme {
+			return nil, fmt.Errorf("backend URLs must have the same scheme: %s", spec)
+		}
+		p.scheme = u.Scheme
+		backends = append(backends, p.newBackend(&url.URL{Scheme: u.Scheme, Host: u.Host}))
+	}
+	p.backends = backends
+	return p, nil
+}
+
+// URL returns a URL (scheme and host of one of the backends) for building the
+// TenantReverseProxy. Requests are sent to the backend picked per request.
+func (p *BackendPool) URL() *url.URL {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.backends) == 0 {
+		return &url.URL{Scheme: p.scheme, Host: p.srvName}
+	}
+	return &url.URL{Scheme: p.scheme, Host: p.backends[0].url.Host}
+}
+
+// Look up SRV records and update the set of backends. Keep the state of
+// backends that are still there. Keep the current set if the lookup fails or
+// yields no backend.
+func (p *BackendPool) discover() error {
+	_, records, err := p.lookupSRV("", "", p.srvName)
+	if err != nil {
+		return fmt.Errorf("DNS SRV lookup for %s failed: %s", p.srvName, err)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("DNS SRV lookup for %s: no records", p.srvName)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := make(map[string]*backend, len(p.backends))
+	for _, b := range p.backends {
+		current[b.url.Host] = b
+	}
+
+	backends := make([]*backend, 0, len(records))
+	for _, srv := range records {
+		host := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+		if b, ok := current[host]; ok {
+			backends = append(backends, b)
+			delete(current, host)
+			continue
+		}
+		log.Infof("backend pool %s: new backend %s", p.srvName, host)
+		backends = append(backends, p.newBackend(&url.URL{Scheme: p.scheme, Host: host}))
+	}
+	for host, b := range current {
+		log.Infof("backend pool %s: backend %s is gone", p.srvName, host)
+		backendUp.DeleteLabelValues(b.label)
+		circuitState.DeleteLabelValues(b.label)
+	}
+	p.backends = backends
+	return nil
+}
+
+func (p *BackendPool) start() {
+	if p.srvName != "" && p.config.DiscoveryInterval > 0 {
+		go p.every(p.config.DiscoveryInterval, func() {
+			if err := p.discover(); err != nil {
+				log.Errorf("backend discovery failed, keep using last known backends: %s", err)
+			}
+		})
+	}
+	if p.config.HealthCheckPath != "" && p.config.HealthCheckInterval > 0 {
+		p.checkHealth()
+		go p.every(p.config.HealthCheckInterval, p.checkHealth)
+	}
+}
+
+// Stop stops health checks and discovery.
+func (p *BackendPool) Stop() {
+	p.stopOnce.Do(func() { close(p.stopCh) })
+}
+
+func (p *BackendPool) every(interval time.Duration, f func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ticker.C:
+			f()
+		}
+	}
+}
+
+func (p *BackendPool) snapshot() []*backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.backends
+}
+
+// Run one round of active health checks, concurrently.
+func (p *BackendPool) checkHealth() {
+	var wg sync.WaitGroup
+	for _, b := range p.snapshot() {
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			healthy := p.probe(b)
+			var v int32
+			if healthy {
+				v = 1
+			}
+			if old := atomic.SwapInt32(&b.healthy, v); old != v {
+				log.Infof("backend %s: healthy: %v", b.label, healthy)
+			}
+			b.updateUpMetric(p.now())
+		}(b)
+	}
+	wg.Wait()
+}
+
+func (p *BackendPool) probe(b *backend) bool {
+	resp, err := p.healthClient.Get(b.url.String() + p.config.HealthCheckPath)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+/*
+Pick a backend for the next attempt, skipping the ones in `tried`, and take a
+trial slot if its circuit is half-open (see the returned ticket). Prefer
+available backends; if there is none, fall back to all backends, except for
+those with an open circuit.
+
+Return nil if there is no backend to try. In that case, if circuits are open,
+also return when the first of them will be half-open.
+*/
+func (p *BackendPool) pick(tried map[*backend]bool) (*backend, circuitTicket, time.Duration) {
+	now := p.now()
+	skip := make(map[*backend]bool, len(tried))
+	for b := range tried {
+		skip[b] = true
+	}
+
+	for {
+		var available, untried []*backend
+		var retryAfter time.Duration
+		for _, b := range p.snapshot() {
+			if skip[b] {
+				continue
+			}
+			if b.breaker != nil {
+				if ok, d := b.breaker.allows(now); !ok {
+					if retryAfter == 0 || d < retryAfter {
+						retryAfter = d
+					}
+					continue
+				}
+			}
+			untried = append(untried, b)
+			if b.available(now) {
+				available = append(available, b)
+			}
+		}
+
+		candidates := available
+		if len(candidates) == 0 {
+			candidates = untried
+		}
+		if len(candidates) == 0 {
+			return nil, 0, retryAfter
+		}
+
+		b := p.choose(candidates)
+		if b.breaker == nil {
+			return b, 0, 0
+		}
+		if ticket, ok := b.breaker.acquire(now); ok {
+			return b, ticket, 0
+		}
+		// Lost the race for the last trial slot.
+		skip[b] = true
+	}
+}
+
+// Choose among candidates according to the load balancing strategy.
+func (p *BackendPool) choose(candidates []*backend) *backend {
+	// Rotate the starting point, also for least-connections (to spread
+	// requests across backends with equal load).
+	offset := int(atomic.AddUint64(&p.next, 1) % uint64(len(candidates)))
+	if p.config.Strategy == RoundRobin {
+		return candidates[offset]
+	}
+
+	var best *backend
+	for i := range candidates {
+		b := candidates[(offset+i)%len(candidates)]
+		if best == nil || atomic.LoadInt64(&b.inFlight) < atomic.LoadInt64(&best.inFlight) {
+			best = b
+		}
+	}
+	return best
+}
+
+// Record the outcome of a request for passive ejection and for the circuit
+// breaker.
+func (p *BackendPool) recordOutcome(b *backend, ticket circuitTicket, failed bool, latency time.Duration) {
+	outcome := "success"
+	if failed {
+		outcome = "error"
+	}
+	backendRequestsTotal.WithLabelValues(b.label, outcome).Inc()
+
+	if b.breaker != nil {
+		b.breaker.record(p.now(), ticket, failed, latency)
+	}
+
+	if p.config.MaxFailures <= 0 {
+		return
+	}
+
+	now := p.now()
+	b.mu.Lock()
+	if !failed {
+		b.consecutiveFailures = 0
+		b.mu.Unlock()
+		return
+	}
+	b.consecutiveFailures++
+	ejected := b.consecutiveFailures >= p.config.MaxFailures && !now.Before(b.ejectedUntil)
+	if ejected {
+		b.ejectedUntil = now.Add(p.config.EjectionTime)
+		b.consecutiveFailures = 0
+	}
+	b.mu.Unlock()
+
+	if ejected {
+		log.Warnf("backend %s: ejected for %s after %d consecutive failures", b.label, p.config.EjectionTime, p.config.MaxFailures)
+		backendUp.WithLabelValues(b.label).Set(0)
+		// Update the metric once the ejection is over.
+		time.AfterFunc(p.config.EjectionTime, func() { b.updateUpMetric(p.now()) })
+	}
+}
+
+// Requests that may be sent again (RFC 7231 section 4.2.2, excluding PUT and
+// DELETE) and that have no body to replay.
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0
+}
+
+func isFailureStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+/*
+RoundTrip sends the request to a backend picked from the pool, and retries
+idempotent requests on another backend upon transport errors and 502/503/504
+responses. If there is no other backend to retry on, the last failed response
+is returned.
+
+If the circuits of all backends are open, fail fast with a circuitOpenError
+(see proxyErrorHandler()).
+*/
+func (p *BackendPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	tried := make(map[*backend]bool)
+	var lastErr error
+	var lastResp *http.Response
+	for attempt := 0; ; attempt++ {
+		b, ticket, retryAfter := p.pick(tried)
+		if b == nil {
+			switch {
+			case lastResp != nil:
+				// No backend left to retry on.
+				return lastResp, nil
+			case lastErr != nil:
+				// No backend left to retry on.
+				return nil, lastErr
+			case retryAfter > 0:
+				circuitRejectedTotal.Inc()
+				return nil, &circuitOpenError{retryAfter: retryAfter}
+			}
+			return nil, errors.New("no backend available")
+		}
+		tried[b] = true
+		if lastResp != nil {
+			discardResponse(lastResp)
+			lastResp = nil
+		}
+
+		outreq := req.Clone(req.Context())
+		outreq.URL.Scheme = b.url.Scheme
+		outreq.URL.Host = b.url.Host
+
+		atomic.AddInt64(&b.inFlight, 1)
+		backendInFlight.WithLabelValues(b.label).Inc()
+		start := p.now()
+		resp, err := p.baseTransport.RoundTrip(outreq)
+		latency := p.now().Sub(start)
+		if err != nil {
+			p.requestDone(b)
+			if req.Context().Err() != nil {
+				// Canceled by the client (or timed out): not the backend's
+				// fault, record no outcome.
+				if b.breaker != nil {
+					b.breaker.release(ticket)
+				}
+				return nil, err
+			}
+			p.recordOutcome(b, ticket, true, latency)
+			if attempt < p.config.MaxRetries && isRetryable(req) {
+				log.Infof("backend %s: %s, retry on another backend", b.label, err)
+				backendRetriesTotal.WithLabelValues(b.label).Inc()
+				lastErr = err
+				continue
+			}
+			return nil, err
+		}
+
+		failed := isFailureStatus(resp.StatusCode)
+		p.recordOutcome(b, ticket, failed, latency)
+		// The request is in flight until the response body is closed.
+		resp.Body = &backendResponseBody{ReadCloser: resp.Body, done: func() { p.requestDone(b) }}
+		if failed && attempt < p.config.MaxRetries && isRetryable(req) {
+			log.Infof("backend %s: %s response, retry on another backend", b.label, resp.Status)
+			backendRetriesTotal.WithLabelValues(b.label).Inc()
+			lastResp, lastErr = resp, nil
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// Read and close the body of a response that is not passed on, so that the
+// connection can be reused.
+func discardResponse(resp *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func (p *BackendPool) requestDone(b *backend) {
+	atomic.AddInt64(&b.inFlight, -1)
+	backendInFlight.WithLabelValues(b.label).Dec()
+}
+
+type backendResponseBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (body *backendResponseBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.once.Do(body.done)
+	return err
+}
@@ -0,0 +1,254 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Backend writing its name to the response. `/ready` returns `readyStatus`.
+func createNamedUpstream(name string, readyStatus *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ready" {
+			w.WriteHeader(*readyStatus)
+			return
+		}
+		fmt.Fprintf(w, "%s %s", name, r.Header.Get(tenantHeaderName))
+	}))
+}
+
+// Pick backend, ignoring the circuit breaker's retry-after.
+func pick(pool *BackendPool, tried map[*backend]bool) *backend {
+	b, _, _ := pool.pick(tried)
+	return b
+}
+
+func TestBackendPool_Spec(t *testing.T) {
+	p, err := newBackendPool("http://a:80, http://b:80", BackendPoolConfig{}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, p.backends, 2)
+	assert.Equal(t, "http://a:80", p.URL().String())
+	assert.Equal(t, RoundRobin, p.config.Strategy)
+
+	for _, spec := range []string{"", "http://a/path", "http://a,https://b", "dnssrv+"} {
+		_, err = newBackendPool(spec, BackendPoolConfig{}, nil)
+		assert.Error(t, err, spec)
+	}
+	_, err = newBackendPool("http://a", BackendPoolConfig{Strategy: "random"}, nil)
+	assert.Error(t, err)
+}
+
+func TestBackendPool_Balancing(t *testing.T) {
+	ready := http.StatusOK
+	a, b := createNamedUpstream("a", &ready), createNamedUpstream("b", &ready)
+	defer a.Close()
+	defer b.Close()
+
+	pool, err := NewBackendPool(a.URL+","+b.URL, BackendPoolConfig{})
+	assert.NoError(t, err)
+	defer pool.Stop()
+
+	rp := NewReverseProxyFixedTenant(tenantName, tenantHeaderName, pool.URL(), true).WithBackendPool(pool)
+
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		rp.HandleWithProxy(w, httptest.NewRequest("GET", "http://localhost/api/v1/query", nil))
+		assert.Equal(t, 200, w.Result().StatusCode)
+		seen[GetStrippedBody(w.Result())]++
+	}
+	assert.Equal(t, map[string]int{"a test": 2, "b test": 2}, seen)
+
+	// Least connections: the backend with fewer requests in flight wins.
+	pool.config.Strategy = LeastConnections
+	pool.backends[0].inFlight = 3
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, pool.backends[1], pick(pool, nil))
+	}
+	pool.backends[0].inFlight = 0
+}
+
+func TestBackendPool_FailoverAndEjection(t *testing.T) {
+	ready := http.StatusOK
+	alive := createNamedUpstream("alive", &ready)
+	defer alive.Close()
+	dead := createNamedUpstream("dead", &ready)
+	dead.Close()
+
+	pool, err := NewBackendPool(dead.URL+","+alive.URL, BackendPoolConfig{MaxFailures: 2, EjectionTime: time.Hour, MaxRetries: 1})
+	assert.NoError(t, err)
+	defer pool.Stop()
+
+	rp := NewReverseProxyFixedTenant(tenantName, tenantHeaderName, pool.URL(), true).WithBackendPool(pool)
+
+	// GET requests are retried on the other backend.
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		rp.HandleWithProxy(w, httptest.NewRequest("GET", "http://localhost/api/v1/query", nil))
+		assert.Equal(t, 200, w.Result().StatusCode)
+		assert.Equal(t, "alive test", GetStrippedBody(w.Result()))
+	}
+
+	// The dead backend has been ejected: POST requests (not retried) go to
+	// the other backend.
+	assert.False(t, pool.backends[0].available(pool.now()))
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		rp.HandleWithProxy(w, httptest.NewRequest("POST", "http://localhost/api/v1/push", strings.NewReader("data")))
+		assert.Equal(t, 200, w.Result().StatusCode)
+	}
+
+	// Nothing in flight after the responses have been read.
+	assert.Equal(t, int64(0), pool.backends[1].inFlight)
+}
+
+func TestBackendPool_RetryFailureStatus(t *testing.T) {
+	ready := http.StatusOK
+	alive := createNamedUpstream("alive", &ready)
+	defer alive.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "unavailable")
+	}))
+	defer unavailable.Close()
+
+	pool, err := NewBackendPool(unavailable.URL+","+alive.URL, BackendPoolConfig{MaxRetries: 1})
+	assert.NoError(t, err)
+	defer pool.Stop()
+
+	rp := NewReverseProxyFixedTenant(tenantName, tenantHeaderName, pool.URL(), true).WithBackendPool(pool)
+
+	// GET requests are retried on the other backend.
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		rp.HandleWithProxy(w, httptest.NewRequest("GET", "http://localhost/api/v1/query", nil))
+		assert.Equal(t, 200, w.Result().StatusCode)
+		assert.Equal(t, "alive test", GetStrippedBody(w.Result()))
+	}
+	assert.Equal(t, int64(0), pool.backends[0].inFlight)
+
+	// POST requests are not.
+	seen := make(map[int]int)
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		rp.HandleWithProxy(w, httptest.NewRequest("POST", "http://localhost/api/v1/push", strings.NewReader("data")))
+		seen[w.Result().StatusCode]++
+	}
+	assert.Equal(t, map[int]int{200: 1, 503: 1}, seen)
+
+	// No other backend to retry on: the failed response is passed on.
+	single, err := NewBackendPool(unavailable.URL, BackendPoolConfig{MaxRetries: 1})
+	assert.NoError(t, err)
+	defer single.Stop()
+	w := httptest.NewRecorder()
+	NewReverseProxyFixedTenant(tenantName, tenantHeaderName, single.URL(), true).WithBackendPool(single).
+		HandleWithProxy(w, httptest.NewRequest("GET", "http://localhost/api/v1/query", nil))
+	assert.Equal(t, 503, w.Result().StatusCode)
+	assert.Equal(t, "unavailable", GetStrippedBody(w.Result()))
+	assert.Equal(t, int64(0), single.backends[0].inFlight)
+}
+
+func TestBackendPool_ClientCancellation(t *testing.T) {
+	ready := http.StatusOK
+	upstream := createNamedUpstream("a", &ready)
+	defer upstream.Close()
+
+	cbConfig := DefaultCircuitBreakerConfig()
+	cbConfig.MinRequests = 2
+	pool, err := NewBackendPool(upstream.URL, BackendPoolConfig{MaxFailures: 2, EjectionTime: time.Hour, MaxRetries: 1, CircuitBreaker: cbConfig})
+	assert.NoError(t, err)
+	defer pool.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("GET", upstream.URL+"/api/v1/query", nil).WithContext(ctx)
+		_, err := pool.RoundTrip(req)
+		assert.Error(t, err)
+	}
+
+	// Canceled requests are not the backend's failures.
+	b := pool.backends[0]
+	assert.True(t, b.available(pool.now()))
+	assert.Equal(t, 0, b.consecutiveFailures)
+	assert.Equal(t, circuitClosed, b.breaker.state)
+	assert.Equal(t, 0, b.breaker.requests)
+	assert.Equal(t, int64(0), b.inFlight)
+}
+
+func TestBackendPool_HealthCheck(t *testing.T) {
+	readyA, readyB := http.StatusOK, http.StatusOK
+	a, b := createNamedUpstream("a", &readyA), createNamedUpstream("b", &readyB)
+	defer a.Close()
+	defer b.Close()
+
+	pool, err := newBackendPool(a.URL+","+b.URL, BackendPoolConfig{HealthCheckPath: "/ready"}, nil)
+	assert.NoError(t, err)
+
+	readyA = http.StatusServiceUnavailable
+	pool.checkHealth()
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, pool.backends[1], pick(pool, nil))
+	}
+
+	// No backend healthy: try all of them anyway.
+	readyB = http.StatusServiceUnavailable
+	pool.checkHealth()
+	assert.NotNil(t, pick(pool, nil))
+	assert.Nil(t, pick(pool, map[*backend]bool{pool.backends[0]: true, pool.backends[1]: true}))
+
+	readyA = http.StatusOK
+	pool.checkHealth()
+	assert.Equal(t, pool.backends[0], pick(pool, nil))
+}
+
+func TestBackendPool_DNSSRVDiscovery(t *testing.T) {
+	records := []*net.SRV{{Target: "querier-0.example.com.", Port: 9009}, {Target: "querier-1.example.com.", Port: 9009}}
+	var lookupErr error
+	lookup := func(service, proto, name string) (string, []*net.SRV, error) {
+		assert.Equal(t, "_http._tcp.querier.example.com", name)
+		return "", records, lookupErr
+	}
+
+	pool, err := newBackendPool("dnssrv+http://_http._tcp.querier.example.com", BackendPoolConfig{}, lookup)
+	assert.NoError(t, err)
+	assert.Len(t, pool.backends, 2)
+	assert.Equal(t, "http://querier-0.example.com:9009", pool.backends[0].url.String())
+	assert.Equal(t, "http", pool.URL().Scheme)
+
+	// Backends that are still there keep their state.
+	pool.backends[1].healthy = 0
+	records = []*net.SRV{{Target: "querier-1.example.com.", Port: 9009}, {Target: "querier-2.example.com.", Port: 9009}}
+	assert.NoError(t, pool.discover())
+	assert.Len(t, pool.backends, 2)
+	assert.Equal(t, int32(0), pool.backends[0].healthy)
+	assert.Equal(t, "querier-2.example.com:9009", pool.backends[1].url.Host)
+
+	// Lookup failures and empty results: keep the last known backends.
+	lookupErr = fmt.Errorf("no such host")
+	assert.Error(t, pool.discover())
+	lookupErr, records = nil, nil
+	assert.Error(t, pool.discover())
+	assert.Len(t, pool.backends, 2)
+}
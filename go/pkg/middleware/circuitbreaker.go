@@ -0,0 +1,309 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Circuit breaker states. The values are those of the state metric.
+const (
+	circuitClosed   = 0
+	circuitHalfOpen = 1
+	circuitOpen     = 2
+)
+
+var circuitStateNames = map[int]string{
+	circuitClosed:   "closed",
+	circuitHalfOpen: "half-open",
+	circuitOpen:     "open",
+}
+
+var circuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "tenant_proxy",
+	Name:      "backend_circuit_state",
+	Help:      "Circuit breaker state by backend: 0 (closed), 1 (half-open), 2 (open).",
+}, []string{"backend"})
+
+var circuitRejectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "tenant_proxy",
+	Name:      "circuit_open_rejected_requests_total",
+	Help:      "Requests rejected with a 503 response because the circuit breakers of all backends are open.",
+})
+
+func init() {
+	prometheus.MustRegister(circuitState)
+	prometheus.MustRegister(circuitRejectedTotal)
+}
+
+/*
+CircuitBreakerConfig configures the circuit breaker of each backend.
+
+A request fails if it fails with a transport error or a 502/503/504 response,
+or if the response takes longer than SlowRequestThreshold to arrive (zero: no
+latency limit).
+
+When at least MinRequests requests were sent in the current Window and at
+least ErrorRateThreshold (0..1) of them failed, the circuit opens: the backend
+gets no requests for OpenDuration. Then the circuit is half-open: up to
+HalfOpenRequests trial requests are let through. If they all succeed, the
+circuit closes; if one fails, it opens again.
+
+Zero ErrorRateThreshold disables the circuit breaker.
+*/
+type CircuitBreakerConfig struct {
+	Window               time.Duration
+	MinRequests          int
+	ErrorRateThreshold   float64
+	SlowRequestThreshold time.Duration
+	OpenDuration         time.Duration
+	HalfOpenRequests     int
+}
+
+// DefaultCircuitBreakerConfig returns the circuit breaker config used by the
+// proxies for push (distributor) backends when not configured otherwise.
+func DefaultCircuitBreakerConfig() CircuitBreakerConfig {
+	return CircuitBreakerConfig{
+		Window:               10 * time.Second,
+		MinRequests:          20,
+		ErrorRateThreshold:   0.5,
+		SlowRequestThreshold: 10 * time.Second,
+		OpenDuration:         10 * time.Second,
+		HalfOpenRequests:     3,
+	}
+}
+
+// DefaultQueryCircuitBreakerConfig returns the circuit breaker config used by
+// the proxies for query (querier) backends when not configured otherwise. Like
+// DefaultCircuitBreakerConfig(), but without latency limit: long range queries
+// are slow, and not failures.
+func DefaultQueryCircuitBreakerConfig() CircuitBreakerConfig {
+	c := DefaultCircuitBreakerConfig()
+	c.SlowRequestThreshold = 0
+	return c
+}
+
+// RegisterFlags registers command line flags for the fields of `c`, with names
+// starting with `prefix` (e.g. `querier-`). The current values are the
+// defaults.
+func (c *CircuitBreakerConfig) RegisterFlags(f *flag.FlagSet, prefix string) {
+	f.DurationVar(&c.Window, prefix+"circuit-breaker-window", c.Window,
+		"circuit breaker: time window in which request outcomes are counted")
+	f.IntVar(&c.MinRequests, prefix+"circuit-breaker-min-requests", c.MinRequests,
+		"circuit breaker: requests in the window before the circuit can open")
+	f.Float64Var(&c.ErrorRateThreshold, prefix+"circuit-breaker-error-rate-threshold", c.ErrorRateThreshold,
+		"circuit breaker: fraction of failed requests in the window that opens the circuit (0: disabled)")
+	f.DurationVar(&c.SlowRequestThreshold, prefix+"circuit-breaker-slow-request-threshold", c.SlowRequestThreshold,
+		"circuit breaker: requests taking longer count as failed (0: no latency limit)")
+	f.DurationVar(&c.OpenDuration, prefix+"circuit-breaker-open-duration", c.OpenDuration,
+		"circuit breaker: how long an open circuit stays open")
+	f.IntVar(&c.HalfOpenRequests, prefix+"circuit-breaker-half-open-requests", c.HalfOpenRequests,
+		"circuit breaker: trial requests that must succeed to close a half-open circuit")
+}
+
+// Return an error if `c` is invalid. A disabled circuit breaker (zero
+// ErrorRateThreshold) is always valid.
+func (c CircuitBreakerConfig) validate() error {
+	if c.ErrorRateThreshold == 0 {
+		return nil
+	}
+
+	switch {
+	case c.ErrorRateThreshold < 0 || c.ErrorRateThreshold > 1:
+		return fmt.Errorf("circuit breaker error rate threshold must be between 0 and 1: %v", c.ErrorRateThreshold)
+	case c.Window <= 0:
+		return fmt.Errorf("circuit breaker window must be positive: %s", c.Window)
+	case c.MinRequests <= 0:
+		return fmt.Errorf("circuit breaker min requests must be positive: %d", c.MinRequests)
+	case c.OpenDuration <= 0:
+		return fmt.Errorf("circuit breaker open duration must be positive: %s", c.OpenDuration)
+	case c.HalfOpenRequests <= 0:
+		// The circuit would never close again.
+		return fmt.Errorf("circuit breaker half-open requests must be positive: %d", c.HalfOpenRequests)
+	case c.SlowRequestThreshold < 0:
+		return fmt.Errorf("circuit breaker slow request threshold must not be negative: %s", c.SlowRequestThreshold)
+	}
+	return nil
+}
+
+// Error returned by BackendPool.RoundTrip() when the circuits of all
+// backends are open.
+type circuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("backend unavailable (circuit open), retry after %s", e.retryAfter)
+}
+
+/*
+Returned by circuitBreaker.acquire() for each admitted request, to be passed
+to record() (or release()). For trial requests: the half-open period they were
+admitted in (see circuitBreaker.halfOpenPeriod). Zero: not a trial request.
+*/
+type circuitTicket uint64
+
+type circuitBreaker struct {
+	config CircuitBreakerConfig
+	// Metric label value.
+	label string
+
+	mu    sync.Mutex
+	state int
+	// Closed state: outcomes in the current window.
+	windowStart time.Time
+	requests    int
+	failures    int
+	// Open state.
+	openUntil time.Time
+	// Half-open state. Incremented each time the circuit becomes half-open,
+	// so that only trial requests of the current half-open period take (and
+	// free) trial slots.
+	halfOpenPeriod uint64
+	trialsInFlight int
+	trialSuccesses int
+}
+
+func newCircuitBreaker(config CircuitBreakerConfig, label string) *circuitBreaker {
+	circuitState.WithLabelValues(label).Set(circuitClosed)
+	return &circuitBreaker{config: config, label: label}
+}
+
+// Expect `cb.mu` to be held.
+func (cb *circuitBreaker) setState(state int, now time.Time) {
+	if state == cb.state {
+		return
+	}
+	log.Infof("backend %s: circuit %s", cb.label, circuitStateNames[state])
+
+	cb.state = state
+	switch state {
+	case circuitOpen:
+		cb.openUntil = now.Add(cb.config.OpenDuration)
+	case circuitHalfOpen:
+		cb.halfOpenPeriod++
+		cb.trialsInFlight, cb.trialSuccesses = 0, 0
+	case circuitClosed:
+		cb.windowStart, cb.requests, cb.failures = now, 0, 0
+	}
+	circuitState.WithLabelValues(cb.label).Set(float64(state))
+}
+
+/*
+Return whether a request may be sent now, without taking a half-open trial
+slot (see acquire()). If not, also return how long the circuit will stay open
+(one second if the circuit is half-open with all trial slots taken).
+*/
+func (cb *circuitBreaker) allows(now time.Time) (bool, time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if now.Before(cb.openUntil) {
+			return false, cb.openUntil.Sub(now)
+		}
+		return true, 0
+	case circuitHalfOpen:
+		return cb.trialsInFlight < cb.config.HalfOpenRequests, time.Second
+	}
+	return true, 0
+}
+
+// Take a trial slot if the circuit is (or is due to become) half-open. Return
+// false if the request may not be sent after all.
+func (cb *circuitBreaker) acquire(now time.Time) (circuitTicket, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == circuitOpen {
+		if now.Before(cb.openUntil) {
+			return 0, false
+		}
+		cb.setState(circuitHalfOpen, now)
+	}
+	if cb.state == circuitHalfOpen {
+		if cb.trialsInFlight >= cb.config.HalfOpenRequests {
+			return 0, false
+		}
+		cb.trialsInFlight++
+		return circuitTicket(cb.halfOpenPeriod), true
+	}
+	return 0, true
+}
+
+// Expect `cb.mu` to be held. Return whether `ticket` holds a trial slot of
+// the current half-open period.
+func (cb *circuitBreaker) isCurrentTrial(ticket circuitTicket) bool {
+	return cb.state == circuitHalfOpen && ticket != 0 && uint64(ticket) == cb.halfOpenPeriod
+}
+
+// Free the trial slot (if any) of a request that was not completed, e.g.
+// because the client canceled it, without recording an outcome.
+func (cb *circuitBreaker) release(ticket circuitTicket) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.isCurrentTrial(ticket) {
+		cb.trialsInFlight--
+	}
+}
+
+// Record the outcome of a request admitted by acquire().
+func (cb *circuitBreaker) record(now time.Time, ticket circuitTicket, failed bool, latency time.Duration) {
+	if cb.config.SlowRequestThreshold > 0 && latency > cb.config.SlowRequestThreshold {
+		failed = true
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitHalfOpen:
+		// Only trial requests decide: others were admitted before the
+		// circuit opened (or in an earlier half-open period).
+		if !cb.isCurrentTrial(ticket) {
+			return
+		}
+		cb.trialsInFlight--
+		if failed {
+			cb.setState(circuitOpen, now)
+			return
+		}
+		cb.trialSuccesses++
+		if cb.trialSuccesses >= cb.config.HalfOpenRequests {
+			cb.setState(circuitClosed, now)
+		}
+	case circuitClosed:
+		if now.Sub(cb.windowStart) > cb.config.Window {
+			cb.windowStart, cb.requests, cb.failures = now, 0, 0
+		}
+		cb.requests++
+		if failed {
+			cb.failures++
+		}
+		if cb.requests >= cb.config.MinRequests &&
+			float64(cb.failures)/float64(cb.requests) >= cb.config.ErrorRateThreshold {
+			cb.setState(circuitOpen, now)
+		}
+	}
+	// Open: a request sent before the circuit opened. Ignore.
+}
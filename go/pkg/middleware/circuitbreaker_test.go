@@ -0,0 +1,215 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker_States(t *testing.T) {
+	cb := newCircuitBreaker(CircuitBreakerConfig{
+		Window:               time.Minute,
+		MinRequests:          4,
+		ErrorRateThreshold:   0.5,
+		SlowRequestThreshold: time.Second,
+		OpenDuration:         10 * time.Second,
+		HalfOpenRequests:     2,
+	}, "test")
+	now := time.Unix(1000, 0)
+	acquire := func() circuitTicket {
+		ticket, ok := cb.acquire(now)
+		assert.True(t, ok)
+		return ticket
+	}
+
+	// Below MinRequests: stays closed.
+	for i := 0; i < 3; i++ {
+		cb.record(now, acquire(), true, 0)
+	}
+	assert.Equal(t, circuitClosed, cb.state)
+
+	// Slow requests count as failures.
+	cb.record(now, acquire(), false, 2*time.Second)
+	assert.Equal(t, circuitOpen, cb.state)
+
+	ok, retryAfter := cb.allows(now.Add(4 * time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, 6*time.Second, retryAfter)
+	_, ok = cb.acquire(now.Add(4 * time.Second))
+	assert.False(t, ok)
+
+	// Half-open: two trial requests at a time.
+	now = now.Add(10 * time.Second)
+	ok, _ = cb.allows(now)
+	assert.True(t, ok)
+	trial := acquire()
+	assert.Equal(t, circuitHalfOpen, cb.state)
+	acquire()
+	_, ok = cb.acquire(now)
+	assert.False(t, ok)
+
+	// A failed trial opens the circuit again.
+	cb.record(now, trial, true, 0)
+	assert.Equal(t, circuitOpen, cb.state)
+	cb.record(now, trial, false, 0)
+	assert.Equal(t, circuitOpen, cb.state)
+
+	// Successful trials close it.
+	now = now.Add(10 * time.Second)
+	for i := 0; i < 2; i++ {
+		cb.record(now, acquire(), false, 0)
+	}
+	assert.Equal(t, circuitClosed, cb.state)
+
+	// Failures are counted per window.
+	for i := 0; i < 3; i++ {
+		cb.record(now, 0, true, 0)
+		now = now.Add(40 * time.Second)
+	}
+	assert.Equal(t, circuitClosed, cb.state)
+}
+
+func TestCircuitBreaker_TrialSlots(t *testing.T) {
+	cb := newCircuitBreaker(CircuitBreakerConfig{
+		Window:             time.Minute,
+		MinRequests:        1,
+		ErrorRateThreshold: 0.5,
+		OpenDuration:       10 * time.Second,
+		HalfOpenRequests:   1,
+	}, "test")
+	now := time.Unix(1000, 0)
+
+	// Admitted while closed, completes after the circuit opened and became
+	// half-open.
+	early, ok := cb.acquire(now)
+	assert.True(t, ok)
+	failing, _ := cb.acquire(now)
+	cb.record(now, failing, true, 0)
+	assert.Equal(t, circuitOpen, cb.state)
+
+	now = now.Add(10 * time.Second)
+	trial, ok := cb.acquire(now)
+	assert.True(t, ok)
+	assert.Equal(t, circuitHalfOpen, cb.state)
+
+	// Neither frees the trial slot nor decides on the circuit.
+	cb.record(now, early, false, 0)
+	assert.Equal(t, circuitHalfOpen, cb.state)
+	_, ok = cb.acquire(now)
+	assert.False(t, ok)
+
+	// Released (e.g. canceled) trial: the slot is free again.
+	cb.release(trial)
+	trial, ok = cb.acquire(now)
+	assert.True(t, ok)
+	cb.record(now, trial, false, 0)
+	assert.Equal(t, circuitClosed, cb.state)
+}
+
+func TestBackendPool_CircuitBreaker(t *testing.T) {
+	var hits int32
+	var failing int32 = 1
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+
+	pool, err := NewBackendPool(upstream.URL, BackendPoolConfig{CircuitBreaker: CircuitBreakerConfig{
+		Window:             time.Minute,
+		MinRequests:        2,
+		ErrorRateThreshold: 0.5,
+		OpenDuration:       5 * time.Second,
+		HalfOpenRequests:   1,
+	}})
+	assert.NoError(t, err)
+	defer pool.Stop()
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	rp := NewReverseProxyFixedTenant(tenantName, tenantHeaderName, pool.URL(), true).WithBackendPool(pool)
+	push := func() *http.Response {
+		w := httptest.NewRecorder()
+		rp.HandleWithProxy(w, httptest.NewRequest("POST", "http://localhost/loki/api/v1/push", strings.NewReader("data")))
+		return w.Result()
+	}
+
+	assert.Equal(t, 503, push().StatusCode)
+	assert.Equal(t, 503, push().StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+
+	// Open: fail fast, without sending the request.
+	now = now.Add(1500 * time.Millisecond)
+	resp := push()
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, "4", resp.Header.Get("Retry-After"))
+	assert.Equal(t, "backend unavailable, retry later", GetStrippedBody(resp))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+
+	// Half-open: a successful trial request closes the circuit.
+	atomic.StoreInt32(&failing, 0)
+	now = now.Add(5 * time.Second)
+	assert.Equal(t, 200, push().StatusCode)
+	assert.Equal(t, 200, push().StatusCode)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&hits))
+	assert.Equal(t, circuitClosed, pool.backends[0].breaker.state)
+}
+
+func TestCircuitBreakerConfig_Validate(t *testing.T) {
+	assert.NoError(t, DefaultCircuitBreakerConfig().validate())
+	assert.NoError(t, DefaultQueryCircuitBreakerConfig().validate())
+	assert.Zero(t, DefaultQueryCircuitBreakerConfig().SlowRequestThreshold)
+	// Disabled.
+	assert.NoError(t, CircuitBreakerConfig{}.validate())
+
+	for _, modify := range []func(*CircuitBreakerConfig){
+		func(c *CircuitBreakerConfig) { c.HalfOpenRequests = 0 },
+		func(c *CircuitBreakerConfig) { c.MinRequests = 0 },
+		func(c *CircuitBreakerConfig) { c.ErrorRateThreshold = 1.5 },
+		func(c *CircuitBreakerConfig) { c.Window = 0 },
+		func(c *CircuitBreakerConfig) { c.OpenDuration = 0 },
+		func(c *CircuitBreakerConfig) { c.SlowRequestThreshold = -time.Second },
+	} {
+		c := DefaultCircuitBreakerConfig()
+		modify(&c)
+		assert.Error(t, c.validate())
+
+		_, err := newBackendPool("http://a:80", BackendPoolConfig{CircuitBreaker: c}, nil)
+		assert.Error(t, err)
+	}
+}
+
+func TestCircuitBreakerConfig_RegisterFlags(t *testing.T) {
+	c := DefaultQueryCircuitBreakerConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.RegisterFlags(fs, "querier-")
+	assert.NoError(t, fs.Parse([]string{
+		"-querier-circuit-breaker-error-rate-threshold=0.8",
+		"-querier-circuit-breaker-slow-request-threshold=2m",
+	}))
+	assert.Equal(t, 0.8, c.ErrorRateThreshold)
+	assert.Equal(t, 2*time.Minute, c.SlowRequestThreshold)
+	assert.Equal(t, 3, c.HalfOpenRequests)
+}
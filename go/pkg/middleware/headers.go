@@ -0,0 +1,123 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var rejectedHeadersTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tenant_proxy",
+	Name:      "rejected_request_headers_total",
+	Help:      "Requests rejected by the reverse proxy because of a client-supplied header, by header name.",
+}, []string{"header"})
+
+func init() {
+	prometheus.MustRegister(rejectedHeadersTotal)
+}
+
+/*
+HeaderPolicy defines how the reverse proxy treats client-supplied request
+headers that upstream trusts (hop-sensitive headers), other than the tenant
+header (see checkTenantHeader()).
+
+Header names are case-insensitive.
+*/
+type HeaderPolicy struct {
+	// Removed from each request before it is forwarded.
+	Strip []string
+	// Requests carrying any of these are rejected with a 400 response.
+	Reject []string
+}
+
+// NewHeaderPolicy builds a header policy from comma-separated lists of header
+// names (as passed via command line flags).
+func NewHeaderPolicy(strip string, reject string) HeaderPolicy {
+	return HeaderPolicy{Strip: splitHeaderList(strip), Reject: splitHeaderList(reject)}
+}
+
+func splitHeaderList(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+/*
+Apply the policy to `r`. Write a 400 response and return `false` if the
+request carries a rejected header. Otherwise remove stripped headers and
+return `true`.
+*/
+func (hp *HeaderPolicy) applyOr400(w http.ResponseWriter, r *http.Request) bool {
+	for _, name := range hp.Reject {
+		if _, ok := r.Header[http.CanonicalHeaderKey(name)]; ok {
+			return rejectHeader(w, name, fmt.Sprintf("request header not allowed: %s", name))
+		}
+	}
+	for _, name := range hp.Strip {
+		r.Header.Del(name)
+	}
+	return true
+}
+
+/*
+Check the tenant header supplied by the client (if any) against the
+authenticated tenant. Write a 400 response and return `false` if the client
+tries to pick another tenant, or more than one: Cortex treats `a|b` as a
+multi-tenant query.
+
+A single value naming the authenticated tenant is fine: that is how a tenant is
+selected for multi-tenant tokens, and how the tenant is specified when
+authentication is disabled. If `disableAPIAuthentication` is `true` the header
+is not checked.
+
+Either way, the caller must replace the header with the authenticated tenant
+before forwarding the request.
+*/
+func checkTenantHeaderOr400(
+	w http.ResponseWriter,
+	r *http.Request,
+	headerName string,
+	tenantName string,
+	disableAPIAuthentication bool,
+) bool {
+	if disableAPIAuthentication {
+		return true
+	}
+
+	values := r.Header.Values(headerName)
+	if len(values) == 0 {
+		return true
+	}
+	if len(values) > 1 || strings.Contains(values[0], "|") || values[0] != tenantName {
+		return rejectHeader(w, headerName, fmt.Sprintf("%s header does not match the authenticated tenant", headerName))
+	}
+	return true
+}
+
+func rejectHeader(w http.ResponseWriter, name string, errmsg string) bool {
+	rejectedHeadersTotal.WithLabelValues(http.CanonicalHeaderKey(name)).Inc()
+	log.Infof("emit 400. Err: %s", errmsg)
+	http.Error(w, errmsg, http.StatusBadRequest)
+	return false
+}
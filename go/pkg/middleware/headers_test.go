@@ -0,0 +1,118 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/authenticator"
+)
+
+// Upstream recording the headers of the last request.
+func createUpstreamHeaderRecorder(t *testing.T) (*url.URL, *http.Header, func()) {
+	var last http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		last = r.Header.Clone()
+	}))
+
+	upstreamURL, err := url.Parse(backend.URL)
+	if err != nil {
+		panic(err)
+	}
+	return upstreamURL, &last, backend.Close
+}
+
+func TestReverseProxy_tenantHeaderSpoofing(t *testing.T) {
+	upstreamURL, lastHeader, upstreamClose := createUpstreamHeaderRecorder(t)
+	defer upstreamClose()
+
+	rp := NewReverseProxyFixedTenant(tenantName, tenantHeaderName, upstreamURL, false).WithResolvers(
+		authenticator.NewStaticAPIKeyResolver("X-Api-Key", map[string]string{"secret": tenantName}),
+	)
+
+	request := func(tenantHeaderValues ...string) *http.Response {
+		req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+		req.Header.Set("X-Api-Key", "secret")
+		for _, v := range tenantHeaderValues {
+			req.Header.Add(tenantHeaderName, v)
+		}
+		w := httptest.NewRecorder()
+		rp.HandleWithProxy(w, req)
+		return w.Result()
+	}
+
+	// No tenant header: set by the proxy.
+	assert.Equal(t, 200, request().StatusCode)
+	assert.Equal(t, []string{tenantName}, lastHeader.Values(tenantHeaderName))
+
+	// The authenticated tenant: not duplicated.
+	assert.Equal(t, 200, request(tenantName).StatusCode)
+	assert.Equal(t, []string{tenantName}, lastHeader.Values(tenantHeaderName))
+
+	// Another tenant, more than one tenant.
+	for _, values := range [][]string{{"other"}, {tenantName, "other"}, {tenantName + "|other"}} {
+		*lastHeader = nil
+		resp := request(values...)
+		assert.Equal(t, 400, resp.StatusCode, values)
+		assert.Nil(t, *lastHeader, values)
+	}
+}
+
+func TestReverseProxy_tenantHeaderWithAuthDisabled(t *testing.T) {
+	upstreamURL, lastHeader, upstreamClose := createUpstreamHeaderRecorder(t)
+	defer upstreamClose()
+
+	// The fixed tenant wins over the client-supplied header.
+	rp := NewReverseProxyFixedTenant(tenantName, tenantHeaderName, upstreamURL, true)
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+	req.Header.Add(tenantHeaderName, "other")
+	req.Header.Add(tenantHeaderName, "other2")
+	w := httptest.NewRecorder()
+	rp.HandleWithProxy(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Equal(t, []string{tenantName}, lastHeader.Values(tenantHeaderName))
+}
+
+func TestReverseProxy_headerPolicy(t *testing.T) {
+	upstreamURL, lastHeader, upstreamClose := createUpstreamHeaderRecorder(t)
+	defer upstreamClose()
+
+	rp := NewReverseProxyFixedTenant(tenantName, tenantHeaderName, upstreamURL, true).WithHeaderPolicy(HeaderPolicy{
+		Strip:  []string{"x-forwarded-host", "Authorization"},
+		Reject: []string{"X-Cortex-Internal"},
+	})
+
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+	req.Header.Set("X-Forwarded-Host", "evil.example.com")
+	req.Header.Set("Authorization", "Bearer foo")
+	req.Header.Set("X-Other", "kept")
+	w := httptest.NewRecorder()
+	rp.HandleWithProxy(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Empty(t, lastHeader.Get("X-Forwarded-Host"))
+	assert.Empty(t, lastHeader.Get("Authorization"))
+	assert.Equal(t, "kept", lastHeader.Get("X-Other"))
+
+	req.Header.Set("x-cortex-internal", "1")
+	w = httptest.NewRecorder()
+	rp.HandleWithProxy(w, req)
+	assert.Equal(t, 400, w.Result().StatusCode)
+	assert.Equal(t, "request header not allowed: X-Cortex-Internal", GetStrippedBody(w.Result()))
+}
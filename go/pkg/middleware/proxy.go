@@ -15,9 +15,12 @@
 package middleware
 
 import (
+	"errors"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 
 	log "github.com/sirupsen/logrus"
 
@@ -65,6 +68,17 @@ type TenantReverseProxy struct {
 	backendURL               *url.URL
 	Revproxy                 *httputil.ReverseProxy
 	disableAPIAuthentication bool
+	// Authenticator used for verifying requests. `nil`: use the default
+	// authenticator (see authenticator.ReadConfigFromEnvOrCrash()).
+	authenticator *authenticator.Authenticator
+	// If set, the tenant is resolved by this chain instead, see
+	// WithResolvers().
+	resolvers authenticator.ResolverChain
+	// Optional: treatment of hop-sensitive request headers other than the
+	// tenant header, see WithHeaderPolicy().
+	headerPolicy *HeaderPolicy
+	// Optional: per-tenant rate limits, see WithRateLimiter().
+	rateLimiter *RateLimiter
 }
 
 func NewReverseProxyFixedTenant(
@@ -73,11 +87,11 @@ func NewReverseProxyFixedTenant(
 	backendURL *url.URL,
 	disableAPIAuthentication bool) *TenantReverseProxy {
 	trp := &TenantReverseProxy{
-		&tenantName,
-		headerName,
-		backendURL,
-		httputil.NewSingleHostReverseProxy(backendURL),
-		disableAPIAuthentication,
+		tenantName:               &tenantName,
+		headerName:               headerName,
+		backendURL:               backendURL,
+		Revproxy:                 httputil.NewSingleHostReverseProxy(backendURL),
+		disableAPIAuthentication: disableAPIAuthentication,
 	}
 	trp.Revproxy.ErrorHandler = proxyErrorHandler
 	if backendURL.Path != "" && backendURL.Path != "/" {
@@ -91,11 +105,10 @@ func NewReverseProxyDynamicTenant(
 	backendURL *url.URL,
 	disableAPIAuthentication bool) *TenantReverseProxy {
 	trp := &TenantReverseProxy{
-		nil,
-		headerName,
-		backendURL,
-		httputil.NewSingleHostReverseProxy(backendURL),
-		disableAPIAuthentication,
+		headerName:               headerName,
+		backendURL:               backendURL,
+		Revproxy:                 httputil.NewSingleHostReverseProxy(backendURL),
+		disableAPIAuthentication: disableAPIAuthentication,
 	}
 	trp.Revproxy.ErrorHandler = proxyErrorHandler
 	if backendURL.Path != "" && backendURL.Path != "/" {
@@ -115,6 +128,46 @@ func (trp *TenantReverseProxy) ReplacePaths(reqPathReplacement func(*url.URL) st
 	return trp
 }
 
+// Use the provided authenticator instead of the default one for verifying
+// requests.
+func (trp *TenantReverseProxy) WithAuthenticator(a *authenticator.Authenticator) *TenantReverseProxy {
+	trp.authenticator = a
+	return trp
+}
+
+// Resolve the tenant of each request by asking `resolvers` in order (see
+// authenticator.ResolverChain), instead of by GetTenantIdentityOr401(). The
+// chain defines what is accepted: `disableAPIAuthentication` does not apply
+// (use authenticator.TestHeaderResolver for that).
+func (trp *TenantReverseProxy) WithResolvers(resolvers ...authenticator.TenantResolver) *TenantReverseProxy {
+	trp.resolvers = resolvers
+	return trp
+}
+
+// Strip or reject client-supplied request headers as defined by `policy`
+// before forwarding requests. The tenant header is always taken care of.
+func (trp *TenantReverseProxy) WithHeaderPolicy(policy HeaderPolicy) *TenantReverseProxy {
+	trp.headerPolicy = &policy
+	return trp
+}
+
+// Balance requests across the backends in `pool` (see BackendPool) instead of
+// sending them to the backend URL the proxy was built with. Build the proxy
+// with pool.URL().
+func (trp *TenantReverseProxy) WithBackendPool(pool *BackendPool) *TenantReverseProxy {
+	trp.Revproxy.Transport = pool
+	return trp
+}
+
+// Limit the requests of each tenant as defined by `rl`. Requests are limited
+// per route class, which follows from the scope required by the route (see
+// HandleWithScope()): push for write scopes, query for read scopes. Other
+// requests are not limited.
+func (trp *TenantReverseProxy) WithRateLimiter(rl *RateLimiter) *TenantReverseProxy {
+	trp.rateLimiter = rl
+	return trp
+}
+
 // Copied from httputil.NewSingleHostReverseProxy with tweaks to url.Path handling to support non-append overrides.
 func pathReplacementDirector(backendURL *url.URL, reqPathReplacement func(*url.URL) string) func(req *http.Request) {
 	targetQuery := backendURL.RawQuery
@@ -144,26 +197,74 @@ func pathReplacementDirector(backendURL *url.URL, reqPathReplacement func(*url.U
 }
 
 func (trp *TenantReverseProxy) HandleWithProxy(w http.ResponseWriter, r *http.Request) {
-	tenantName, ok := authenticator.GetTenantNameOr401(w, r, trp.tenantName, trp.disableAPIAuthentication)
+	trp.handleWithProxy(w, r, "")
+}
+
+// HandleWithScope returns a handler that behaves like HandleWithProxy(), but
+// additionally requires the authenticated request to have been granted
+// `scope` (otherwise a 403 response is emitted). Use this to enforce scopes
+// per route.
+func (trp *TenantReverseProxy) HandleWithScope(scope string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		trp.handleWithProxy(w, r, scope)
+	}
+}
+
+func (trp *TenantReverseProxy) handleWithProxy(w http.ResponseWriter, r *http.Request, requiredScope string) {
+	var identity *authenticator.TenantIdentity
+	var ok bool
+	if trp.resolvers != nil {
+		identity, ok = trp.resolvers.ResolveTenantOr401(w, r, trp.tenantName)
+	} else {
+		a := trp.authenticator
+		if a == nil {
+			a = authenticator.Default()
+		}
+		identity, ok = a.GetTenantIdentityOr401(w, r, trp.tenantName, trp.disableAPIAuthentication)
+	}
 	if !ok {
 		// Error response has already been written. Terminate request handling.
 		return
 	}
 
-	// Add the tenant in the request header and then forward the request to the backend.
-	r.Header.Add(trp.headerName, tenantName)
+	if requiredScope != "" && !authenticator.RequireScopeOr403(w, r, identity, requiredScope) {
+		// Error response has already been written. Terminate request handling.
+		return
+	}
+
+	// Do not let clients pick another tenant (or more than one) via the
+	// tenant header.
+	if !checkTenantHeaderOr400(w, r, trp.headerName, identity.TenantName, trp.disableAPIAuthentication && trp.resolvers == nil) {
+		return
+	}
+	if trp.headerPolicy != nil && !trp.headerPolicy.applyOr400(w, r) {
+		return
+	}
+
+	if trp.rateLimiter != nil {
+		if class := routeClassForScope(requiredScope); class != "" && !trp.rateLimiter.allowOr429(w, r, identity.TenantName, class) {
+			return
+		}
+	}
+
+	// Replace any client-supplied tenant header value(s) with the
+	// authenticated tenant and then forward the request to the backend.
+	r.Header.Set(trp.headerName, identity.TenantName)
 	trp.Revproxy.ServeHTTP(w, r)
 }
 
 func proxyErrorHandler(resp http.ResponseWriter, r *http.Request, proxyerr error) {
-	// Native error handler behavior: set status and log
-	resp.WriteHeader(http.StatusBadGateway)
-	log.Warnf("http: proxy error: %s", proxyerr)
-
-	// Additional: write string representation of proxy error (as bytes) to
-	// response stream. Log when that fails.
-	_, werr := resp.Write([]byte(proxyerr.Error()))
-	if werr != nil {
-		log.Errorf("writing response failed: %v", werr)
+	// Backends are known to be unavailable: fail fast, and tell the client
+	// when to retry.
+	var coe *circuitOpenError
+	if errors.As(proxyerr, &coe) {
+		resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(coe.retryAfter.Seconds()))))
+		http.Error(resp, "backend unavailable, retry later", http.StatusServiceUnavailable)
+		return
 	}
+
+	// Native error handler behavior: set status and log. Do not expose the
+	// error to the client: it reveals backend addresses and the like.
+	log.Warnf("http: proxy error: %s", proxyerr)
+	http.Error(resp, "bad gateway", http.StatusBadGateway)
 }
@@ -19,12 +19,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"regexp"
 	"strings"
 	"testing"
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/authenticator"
 )
 
 const tenantName string = "test"
@@ -136,7 +137,7 @@ func TestReverseProxy_unhealthy(t *testing.T) {
 	// simulate an error reaching the backend
 	u, err := url.Parse("http://localhost:0")
 	if err != nil {
-		t.Errorf("got %w", err)
+		t.Errorf("got %v", err)
 	}
 
 	// we can reuse the same backend to send both the querier and distributor
@@ -151,13 +152,9 @@ func TestReverseProxy_unhealthy(t *testing.T) {
 	resp := w.Result()
 	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
 
-	// Confirm that the original error message (for why the request could
-	// not be proxied) is contained in the response body.
-	assert.Regexp(
-		t,
-		regexp.MustCompile("^dial tcp .* connect: connection refused$"),
-		GetStrippedBody(resp),
-	)
+	// The original error message (for why the request could not be proxied)
+	// is logged, not exposed in the response body.
+	assert.Equal(t, "bad gateway", GetStrippedBody(resp))
 }
 
 func TestReverseProxyAuthenticator_noheader(t *testing.T) {
@@ -206,3 +203,73 @@ func TestReverseProxyAuthenticator_badtoken(t *testing.T) {
 	// Confirm that a helpful error message is in the body.
 	assert.Equal(t, "bad authentication token", GetStrippedBody(resp))
 }
+
+func TestReverseProxy_scopeWithAuthDisabled(t *testing.T) {
+	upstreamURL, upstreamClose := createUpstreamTenantEcho(tenantName, t)
+	defer upstreamClose()
+
+	// With authentication disabled, scopes are not restricted.
+	disableAPIAuth := true
+	rp := NewReverseProxyFixedTenant(tenantName, tenantHeaderName, upstreamURL, disableAPIAuth)
+
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/push", nil)
+	w := httptest.NewRecorder()
+	rp.HandleWithScope("metrics:write")(w, req)
+	resp := w.Result()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "/api/v1/push test", GetStrippedBody(resp))
+}
+
+func TestReverseProxy_withAuthenticator(t *testing.T) {
+	upstreamURL, upstreamClose := createUpstreamTenantEcho(tenantName, t)
+	defer upstreamClose()
+
+	a, err := authenticator.NewAuthenticatorFromKeys(map[string]string{
+		"df99d68cf04b53c2697e4b537d6236a7a1ee79e9": authenticator.TestPubKey,
+	})
+	assert.NoError(t, err)
+
+	disableAPIAuth := false
+	rp := NewReverseProxyFixedTenant(tenantName, tenantHeaderName, upstreamURL, disableAPIAuth).WithAuthenticator(a)
+
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	w := httptest.NewRecorder()
+	rp.HandleWithProxy(w, req)
+	assert.Equal(t, 401, w.Result().StatusCode)
+}
+
+func TestReverseProxy_withResolvers(t *testing.T) {
+	upstreamURL, upstreamClose := createUpstreamTenantEcho(tenantName, t)
+	defer upstreamClose()
+
+	a, err := authenticator.NewAuthenticatorFromKeys(map[string]string{
+		"df99d68cf04b53c2697e4b537d6236a7a1ee79e9": authenticator.TestPubKey,
+	})
+	assert.NoError(t, err)
+
+	disableAPIAuth := false
+	rp := NewReverseProxyFixedTenant(tenantName, tenantHeaderName, upstreamURL, disableAPIAuth).WithResolvers(
+		authenticator.NewTokenResolver(a),
+		authenticator.NewStaticAPIKeyResolver("X-Api-Key", map[string]string{"secret": tenantName}),
+	)
+
+	// Static API key, after the token resolver passed.
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/query", nil)
+	req.Header.Set("X-Api-Key", "secret")
+	w := httptest.NewRecorder()
+	rp.HandleWithProxy(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	// The token resolver rejects: the API key is not looked at.
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	w = httptest.NewRecorder()
+	rp.HandleWithProxy(w, req)
+	assert.Equal(t, 401, w.Result().StatusCode)
+
+	// No proof at all.
+	w = httptest.NewRecorder()
+	rp.HandleWithProxy(w, httptest.NewRequest("GET", "http://localhost/api/v1/query", nil))
+	assert.Equal(t, 401, w.Result().StatusCode)
+	assert.Equal(t, "authentication proof missing", GetStrippedBody(w.Result()))
+}
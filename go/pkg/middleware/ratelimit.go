@@ -0,0 +1,401 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/opstrace/opstrace/go/pkg/authenticator"
+	"github.com/opstrace/opstrace/go/pkg/filewatch"
+)
+
+// Route classes: requests of each class are limited separately.
+const (
+	RouteClassPush  = "push"
+	RouteClassQuery = "query"
+)
+
+var rateLimitedRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tenant_proxy",
+	Name:      "rate_limited_requests_total",
+	Help:      "Requests rejected with a 429 response by the rate limiter, by tenant, route class and limit (requests, bytes).",
+}, []string{"tenant", "class", "limit"})
+
+var rateLimitOverridesReloadFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "tenant_proxy",
+	Name:      "rate_limit_overrides_reload_failures_total",
+	Help:      "Number of failed attempts to re-read the rate limit overrides file.",
+})
+
+func init() {
+	prometheus.MustRegister(rateLimitedRequestsTotal)
+	prometheus.MustRegister(rateLimitOverridesReloadFailuresTotal)
+}
+
+/*
+RateLimits are the limits for the requests of one tenant in one route class.
+
+Zero rates mean no limit. Zero bursts default to one second's worth of the
+rate (at least one request, or byte).
+*/
+type RateLimits struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	RequestBurst      float64 `yaml:"request_burst"`
+	BytesPerSecond    float64 `yaml:"bytes_per_second"`
+	ByteBurst         float64 `yaml:"byte_burst"`
+}
+
+/*
+Rate limit overrides document (YAML). Example:
+
+	defaults:
+	  push:
+	    requests_per_second: 100
+	    bytes_per_second: 10485760
+	  query:
+	    requests_per_second: 20
+	overrides:
+	  foo:
+	    push:
+	      requests_per_second: 500
+	      bytes_per_second: 52428800
+
+`defaults`: limits by route class, for all tenants.
+
+`overrides`: limits by tenant name (as in the tenant header sent upstream, e.g.
+`foo`, not the token subject `tenant-foo`) and route class. These replace the
+defaults for that tenant and class (limits not given are not limited).
+
+A route class without limits is not limited.
+*/
+type rateLimitDocument struct {
+	Defaults  map[string]RateLimits            `yaml:"defaults"`
+	Overrides map[string]map[string]RateLimits `yaml:"overrides"`
+}
+
+func parseRateLimitDocument(data []byte) (*rateLimitDocument, error) {
+	var doc rateLimitDocument
+	if err := yaml.UnmarshalStrict(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid rate limit overrides document: %s", err)
+	}
+
+	if err := validateClassLimits(doc.Defaults); err != nil {
+		return nil, fmt.Errorf("invalid defaults: %s", err)
+	}
+	for tenantName, classLimits := range doc.Overrides {
+		if err := validateClassLimits(classLimits); err != nil {
+			return nil, fmt.Errorf("invalid overrides for tenant %s: %s", tenantName, err)
+		}
+	}
+	return &doc, nil
+}
+
+func validateClassLimits(classLimits map[string]RateLimits) error {
+	for class, limits := range classLimits {
+		if class != RouteClassPush && class != RouteClassQuery {
+			return fmt.Errorf("unknown route class: %s", class)
+		}
+		if limits.RequestsPerSecond < 0 || limits.RequestBurst < 0 || limits.BytesPerSecond < 0 || limits.ByteBurst < 0 {
+			return fmt.Errorf("negative limit for route class %s", class)
+		}
+	}
+	return nil
+}
+
+// Return the limits for `tenantName` in `class`.
+func (doc *rateLimitDocument) limitsFor(tenantName string, class string) RateLimits {
+	if classLimits, ok := doc.Overrides[tenantName]; ok {
+		if limits, ok := classLimits[class]; ok {
+			return limits
+		}
+	}
+	return doc.Defaults[class]
+}
+
+/*
+Token bucket: holds up to `burst` tokens and is refilled at `rate` tokens per
+second. A zero rate means no limit.
+*/
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64, now time.Time) *tokenBucket {
+	if burst == 0 {
+		burst = math.Max(rate, 1)
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	if now.After(tb.last) {
+		tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+		tb.last = now
+	}
+}
+
+/*
+Return whether `n` tokens can be taken now. If not, also return how long it
+takes until they can.
+
+Taking more than `burst` tokens is possible when the bucket is full (which
+leaves the bucket in debt): otherwise such requests would never pass.
+*/
+func (tb *tokenBucket) available(now time.Time, n float64) (bool, time.Duration) {
+	if tb.rate == 0 {
+		return true, 0
+	}
+	tb.refill(now)
+
+	need := math.Min(n, tb.burst)
+	if tb.tokens >= need {
+		return true, 0
+	}
+	return false, time.Duration((need - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// Take `n` tokens, regardless of whether they are available.
+func (tb *tokenBucket) take(now time.Time, n float64) {
+	if tb.rate == 0 {
+		return
+	}
+	tb.refill(now)
+	tb.tokens -= n
+}
+
+// Buckets of one tenant in one route class.
+type rateLimitBuckets struct {
+	// Limits the buckets were built with.
+	limits RateLimits
+
+	mu       sync.Mutex
+	requests *tokenBucket
+	bytes    *tokenBucket
+}
+
+type rateLimitKey struct {
+	tenantName string
+	class      string
+}
+
+/*
+RateLimiter limits the requests of each tenant, separately per route class
+(push, query), to a number of requests per second and to a number of request
+body bytes per second, with token buckets.
+
+Limits are read from an overrides file (see rateLimitDocument), which is
+re-read periodically if it changed. If re-reading fails, the last known good
+limits stay in use.
+*/
+type RateLimiter struct {
+	path string
+	now  func() time.Time
+	// Of the file contents the limits were read from.
+	digest filewatch.Digest
+
+	mu      sync.RWMutex
+	doc     *rateLimitDocument
+	buckets map[rateLimitKey]*rateLimitBuckets
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+/*
+NewRateLimiter reads limits from the overrides file at `path` and checks it
+for changes every `reloadInterval` (zero: never); see Stop(). Return an error
+if the file cannot be read or parsed now.
+*/
+func NewRateLimiter(path string, reloadInterval time.Duration) (*RateLimiter, error) {
+	rl := &RateLimiter{
+		path:    path,
+		now:     time.Now,
+		buckets: make(map[rateLimitKey]*rateLimitBuckets),
+		stopCh:  make(chan struct{}),
+	}
+	if err := rl.reloadIfChanged(); err != nil {
+		return nil, fmt.Errorf("reading rate limit overrides failed: %s", err)
+	}
+
+	if reloadInterval > 0 {
+		go rl.reloadPeriodically(reloadInterval)
+	}
+	return rl, nil
+}
+
+// Stop stops checking the overrides file for changes.
+func (rl *RateLimiter) Stop() {
+	rl.stopOnce.Do(func() { close(rl.stopCh) })
+}
+
+/*
+Re-read the overrides file and replace the limits if the contents changed since
+it was last read (see filewatch.Digest). Replace the limits only if reading and
+parsing succeeded.
+
+Buckets are rebuilt (full) for the tenants and classes whose limits changed.
+*/
+func (rl *RateLimiter) reloadIfChanged() error {
+	_, err := rl.digest.ApplyFile(rl.path, func(data []byte) error {
+		doc, err := parseRateLimitDocument(data)
+		if err != nil {
+			return err
+		}
+
+		rl.mu.Lock()
+		rl.doc = doc
+		rl.mu.Unlock()
+
+		log.Infof("rate limits: read defaults for %d route class(es) and overrides for %d tenant(s) from %s",
+			len(doc.Defaults), len(doc.Overrides), rl.path)
+		return nil
+	})
+	return err
+}
+
+func (rl *RateLimiter) reloadPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rl.stopCh:
+			return
+		case <-ticker.C:
+			if err := rl.reloadIfChanged(); err != nil {
+				rateLimitOverridesReloadFailuresTotal.Inc()
+				log.Errorf("rate limits: reload failed, keep using last known limits: %s", err)
+			}
+		}
+	}
+}
+
+// Return the buckets for `tenantName` in `class`, built from the current
+// limits.
+func (rl *RateLimiter) bucketsFor(tenantName string, class string) *rateLimitBuckets {
+	key := rateLimitKey{tenantName, class}
+
+	rl.mu.RLock()
+	limits := rl.doc.limitsFor(tenantName, class)
+	b, ok := rl.buckets[key]
+	rl.mu.RUnlock()
+
+	if ok && b.limits == limits {
+		return b
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	// Another request may have rebuilt the buckets in the meantime.
+	if b, ok := rl.buckets[key]; ok && b.limits == limits {
+		return b
+	}
+
+	now := rl.now()
+	b = &rateLimitBuckets{
+		limits:   limits,
+		requests: newTokenBucket(limits.RequestsPerSecond, limits.RequestBurst, now),
+		bytes:    newTokenBucket(limits.BytesPerSecond, limits.ByteBurst, now),
+	}
+	rl.buckets[key] = b
+	return b
+}
+
+/*
+Admit request `r` of `tenantName` in route class `class`, or write a 429
+response with Retry-After header and return `false`.
+
+The request body counts against the byte limit: as given by the
+Content-Length header if known, and as it is read otherwise (so that it
+delays later requests).
+*/
+func (rl *RateLimiter) allowOr429(w http.ResponseWriter, r *http.Request, tenantName string, class string) bool {
+	b := rl.bucketsFor(tenantName, class)
+	now := rl.now()
+
+	size := r.ContentLength
+	if size < 0 {
+		size = 0
+	}
+
+	b.mu.Lock()
+	ok, retryAfter := b.requests.available(now, 1)
+	limit := "requests"
+	if ok {
+		ok, retryAfter = b.bytes.available(now, float64(size))
+		limit = "bytes"
+	}
+	if ok {
+		b.requests.take(now, 1)
+		b.bytes.take(now, float64(size))
+	}
+	b.mu.Unlock()
+
+	if !ok {
+		rateLimitedRequestsTotal.WithLabelValues(tenantName, class, limit).Inc()
+		errmsg := fmt.Sprintf("rate limit exceeded for tenant %s (%s %s per second), retry later", tenantName, class, limit)
+		return authenticator.Exit429(w, retryAfter, errmsg)
+	}
+
+	if r.ContentLength < 0 && r.Body != nil && r.Body != http.NoBody {
+		r.Body = &rateLimitedBody{ReadCloser: r.Body, buckets: b, now: rl.now}
+	}
+	return true
+}
+
+// Request body of unknown length: take tokens from the byte bucket as the
+// body is read.
+type rateLimitedBody struct {
+	io.ReadCloser
+	buckets *rateLimitBuckets
+	now     func() time.Time
+}
+
+func (body *rateLimitedBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	if n > 0 {
+		body.buckets.mu.Lock()
+		body.buckets.bytes.take(body.now(), float64(n))
+		body.buckets.mu.Unlock()
+	}
+	return n, err
+}
+
+/*
+Route class of requests requiring `scope`: push for write scopes, query for
+read scopes. Requests requiring other scopes (admin), or none, are not rate
+limited: return the empty string.
+*/
+func routeClassForScope(scope string) string {
+	switch scope {
+	case authenticator.ScopeMetricsWrite, authenticator.ScopeLogsWrite:
+		return RouteClassPush
+	case authenticator.ScopeMetricsRead, authenticator.ScopeLogsRead:
+		return RouteClassQuery
+	}
+	return ""
+}
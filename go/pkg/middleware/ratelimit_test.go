@@ -0,0 +1,254 @@
+// Copyright 2021 Opstrace, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opstrace/opstrace/go/pkg/authenticator"
+)
+
+const rateLimitTestDoc = `
+defaults:
+  push:
+    requests_per_second: 2
+    bytes_per_second: 100
+  query:
+    requests_per_second: 1
+overrides:
+  big:
+    push:
+      requests_per_second: 10
+`
+
+// Write `doc` to a temporary overrides file. Return its path and a cleanup
+// function.
+func writeRateLimitFile(t *testing.T, doc string) (string, func()) {
+	dir, err := ioutil.TempDir("", "ratelimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "overrides.yaml")
+	if err := ioutil.WriteFile(path, []byte(doc), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// Rate limiter with a clock that only moves when `advance` is called.
+func newTestRateLimiter(t *testing.T, doc string) (*RateLimiter, func(time.Duration), func()) {
+	path, cleanup := writeRateLimitFile(t, doc)
+	rl, err := NewRateLimiter(path, 0)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1600000000, 0)
+	rl.now = func() time.Time { return now }
+	return rl, func(d time.Duration) { now = now.Add(d) }, cleanup
+}
+
+func allow(rl *RateLimiter, tenantName string, class string, body string) int {
+	w := httptest.NewRecorder()
+	rl.allowOr429(w, httptest.NewRequest("POST", "http://localhost/api/v1/push", strings.NewReader(body)), tenantName, class)
+	return w.Code
+}
+
+func TestParseRateLimitDocument(t *testing.T) {
+	doc, err := parseRateLimitDocument([]byte(rateLimitTestDoc))
+	assert.NoError(t, err)
+	assert.Equal(t, RateLimits{RequestsPerSecond: 2, BytesPerSecond: 100}, doc.limitsFor("a", RouteClassPush))
+	assert.Equal(t, RateLimits{RequestsPerSecond: 10}, doc.limitsFor("big", RouteClassPush))
+	assert.Equal(t, RateLimits{RequestsPerSecond: 1}, doc.limitsFor("big", RouteClassQuery))
+
+	for _, bad := range []string{
+		"defaults: {ingest: {requests_per_second: 1}}",
+		"overrides: {a: {push: {requests_per_second: -1}}}",
+		"defaults: {push: {request_per_second: 1}}",
+		"defaults: [",
+	} {
+		_, err := parseRateLimitDocument([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestRateLimiter_requests(t *testing.T) {
+	rl, advance, cleanup := newTestRateLimiter(t, rateLimitTestDoc)
+	defer cleanup()
+
+	// Burst defaults to the rate: two requests, then 429.
+	assert.Equal(t, 200, allow(rl, "a", RouteClassPush, ""))
+	assert.Equal(t, 200, allow(rl, "a", RouteClassPush, ""))
+
+	w := httptest.NewRecorder()
+	rl.allowOr429(w, httptest.NewRequest("POST", "http://localhost/api/v1/push", nil), "a", RouteClassPush)
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	// Route classes and tenants are limited separately.
+	assert.Equal(t, 200, allow(rl, "a", RouteClassQuery, ""))
+	assert.Equal(t, 429, allow(rl, "a", RouteClassQuery, ""))
+	assert.Equal(t, 200, allow(rl, "b", RouteClassPush, ""))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 200, allow(rl, "big", RouteClassPush, ""))
+	}
+	assert.Equal(t, 429, allow(rl, "big", RouteClassPush, ""))
+
+	// Refill at the configured rate.
+	advance(500 * time.Millisecond)
+	assert.Equal(t, 200, allow(rl, "a", RouteClassPush, ""))
+	assert.Equal(t, 429, allow(rl, "a", RouteClassPush, ""))
+}
+
+func TestRateLimiter_bytes(t *testing.T) {
+	rl, advance, cleanup := newTestRateLimiter(t, rateLimitTestDoc)
+	defer cleanup()
+
+	assert.Equal(t, 200, allow(rl, "a", RouteClassPush, strings.Repeat("x", 80)))
+
+	// 20 bytes left: 60 more bytes are available in 0.4s.
+	w := httptest.NewRecorder()
+	rl.allowOr429(w, httptest.NewRequest("POST", "http://localhost/api/v1/push", strings.NewReader(strings.Repeat("x", 60))), "a", RouteClassPush)
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	// The rejected request did not take a request token.
+	advance(400 * time.Millisecond)
+	assert.Equal(t, 200, allow(rl, "a", RouteClassPush, strings.Repeat("x", 60)))
+
+	// Requests larger than the burst pass when the bucket is full, leaving
+	// it in debt.
+	advance(10 * time.Second)
+	assert.Equal(t, 200, allow(rl, "a", RouteClassPush, strings.Repeat("x", 300)))
+	assert.Equal(t, 429, allow(rl, "a", RouteClassPush, "x"))
+}
+
+func TestRateLimiter_unknownLength(t *testing.T) {
+	rl, _, cleanup := newTestRateLimiter(t, rateLimitTestDoc)
+	defer cleanup()
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/push", strings.NewReader(strings.Repeat("x", 150)))
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	assert.True(t, rl.allowOr429(w, req, "a", RouteClassPush))
+
+	// The body is counted as it is read.
+	_, err := ioutil.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 429, allow(rl, "a", RouteClassPush, "x"))
+}
+
+func TestRateLimiter_reload(t *testing.T) {
+	rl, _, cleanup := newTestRateLimiter(t, rateLimitTestDoc)
+	defer cleanup()
+
+	assert.Equal(t, 200, allow(rl, "a", RouteClassQuery, ""))
+	assert.Equal(t, 429, allow(rl, "a", RouteClassQuery, ""))
+
+	// Invalid document: keep the last known limits.
+	assert.NoError(t, ioutil.WriteFile(rl.path, []byte("defaults: ["), 0600))
+	assert.Error(t, rl.reloadIfChanged())
+	assert.Equal(t, 429, allow(rl, "a", RouteClassQuery, ""))
+
+	// Changed limits take effect right away, with full buckets.
+	assert.NoError(t, ioutil.WriteFile(rl.path, []byte("defaults: {query: {requests_per_second: 3}}"), 0600))
+	assert.NoError(t, rl.reloadIfChanged())
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 200, allow(rl, "a", RouteClassQuery, ""))
+	}
+	assert.Equal(t, 429, allow(rl, "a", RouteClassQuery, ""))
+
+	// No longer limited.
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 200, allow(rl, "a", RouteClassPush, ""))
+	}
+}
+
+func TestReverseProxy_rateLimiter(t *testing.T) {
+	upstreamURL, upstreamClose := createUpstreamTenantEcho(tenantName, t)
+	defer upstreamClose()
+
+	rl, _, cleanup := newTestRateLimiter(t, "defaults: {push: {requests_per_second: 1}, query: {requests_per_second: 1}}")
+	defer cleanup()
+
+	disableAPIAuth := true
+	rp := NewReverseProxyFixedTenant(tenantName, tenantHeaderName, upstreamURL, disableAPIAuth).WithRateLimiter(rl)
+
+	push := func() int {
+		w := httptest.NewRecorder()
+		rp.HandleWithScope("metrics:write")(w, httptest.NewRequest("POST", "http://localhost/api/v1/push", strings.NewReader("data")))
+		return w.Code
+	}
+	assert.Equal(t, 200, push())
+	assert.Equal(t, 429, push())
+
+	// Routes requiring the admin scope are not limited.
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		rp.HandleWithScope("admin")(w, httptest.NewRequest("GET", "http://localhost/runtime_config", nil))
+		assert.Equal(t, 200, w.Code)
+	}
+}
+
+func TestReverseProxy_rateLimiterOverrides(t *testing.T) {
+	router := http.NewServeMux()
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get(tenantHeaderName))
+	})
+	upstream := httptest.NewServer(router)
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	rl, _, cleanup := newTestRateLimiter(t, rateLimitTestDoc)
+	defer cleanup()
+
+	// Tenants resolved by the proxy, as they are for authenticated requests
+	// (bare tenant names, as sent upstream).
+	disableAPIAuth := false
+	rp := NewReverseProxyDynamicTenant(tenantHeaderName, upstreamURL, disableAPIAuth).WithResolvers(
+		authenticator.NewStaticAPIKeyResolver("X-Api-Key", map[string]string{"key-a": "a", "key-big": "big"}),
+	).WithRateLimiter(rl)
+
+	push := func(apiKey string) int {
+		req := httptest.NewRequest("POST", "http://localhost/api/v1/push", strings.NewReader("data"))
+		req.Header.Set("X-Api-Key", apiKey)
+		w := httptest.NewRecorder()
+		rp.HandleWithScope(authenticator.ScopeMetricsWrite)(w, req)
+		return w.Code
+	}
+
+	// Defaults: 2 push requests.
+	assert.Equal(t, 200, push("key-a"))
+	assert.Equal(t, 200, push("key-a"))
+	assert.Equal(t, 429, push("key-a"))
+
+	// Override for tenant `big`: 10 push requests.
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 200, push("key-big"))
+	}
+	assert.Equal(t, 429, push("key-big"))
+}